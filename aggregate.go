@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const maxAggregateBuckets = 5000
+
+// aggregateBucketSizes are the bucket widths accepted by GET /data/aggregate,
+// a zero duration stands for a calendar day in the configured timezone.
+var aggregateBucketSizes = map[string]time.Duration{
+	"1m":  time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"30m": 30 * time.Minute,
+	"1h":  time.Hour,
+	"6h":  6 * time.Hour,
+	"12h": 12 * time.Hour,
+	"1d":  0,
+}
+
+var aggregateFns = []string{"avg", "min", "max", "count"}
+
+type MetricAggregate struct {
+	Avg *float64
+	Min *float64
+	Max *float64
+}
+
+type AggregateBucket struct {
+	Start    int64
+	End      int64
+	Count    int64
+	TempCo   MetricAggregate
+	TempRoom MetricAggregate
+	Humidity MetricAggregate
+}
+
+type AggregateResponse struct {
+	Bucket   string                    `json:"bucket"`
+	Timezone string                    `json:"timezone"`
+	From     int64                     `json:"from"`
+	To       int64                     `json:"to"`
+	Device   string                    `json:"device,omitempty"`
+	Buckets  []AggregateBucketResponse `json:"buckets"`
+}
+
+// AggregateBucketResponse holds the requested functions of each metric, they
+// are null for buckets without readings.
+type AggregateBucketResponse struct {
+	Start    int64          `json:"start"`
+	End      int64          `json:"end"`
+	Empty    bool           `json:"empty"`
+	TempCo   map[string]any `json:"tempCo"`
+	TempRoom map[string]any `json:"tempRoom"`
+	Humidity map[string]any `json:"humidity"`
+}
+
+// bucketBounds splits [from, to] into consecutive buckets aligned to loc,
+// e.g. 1d buckets start at local midnight. The last bucket contains to.
+func bucketBounds(from, to time.Time, size time.Duration, loc *time.Location) (starts, ends []int64) {
+	from = from.In(loc)
+	midnight := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+
+	start := midnight
+	next := func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	if size > 0 {
+		start = midnight.Add(from.Sub(midnight) / size * size)
+		next = func(t time.Time) time.Time { return t.Add(size) }
+	}
+
+	for !start.After(to) && len(starts) <= maxAggregateBuckets {
+		end := next(start)
+		starts = append(starts, start.Unix())
+		ends = append(ends, end.Unix())
+		start = end
+	}
+	return starts, ends
+}
+
+func (a *app) timezone() *time.Location {
+	if a.location != nil {
+		return a.location
+	}
+	return time.UTC
+}
+
+type aggregateQuery struct {
+	from   time.Time
+	to     time.Time
+	bucket string
+	size   time.Duration
+	fns    []string
+	device string
+	loc    *time.Location
+}
+
+var errInvalidAggregateQuery = errors.New("invalid aggregate query")
+
+func parseAggregateQuery(r *http.Request, defaultLoc *time.Location, now time.Time) (aggregateQuery, error) {
+	q := aggregateQuery{to: now, bucket: "1h", fns: aggregateFns, loc: defaultLoc}
+	query := r.URL.Query()
+
+	if s := query.Get("to"); s != "" {
+		t, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || t < 0 {
+			return q, fmt.Errorf("%w: to", errInvalidAggregateQuery)
+		}
+		q.to = time.Unix(t, 0)
+	}
+	q.from = q.to.Add(-24 * time.Hour)
+	if s := query.Get("from"); s != "" {
+		f, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || f < 0 {
+			return q, fmt.Errorf("%w: from", errInvalidAggregateQuery)
+		}
+		q.from = time.Unix(f, 0)
+	}
+	if q.from.After(q.to) {
+		return q, fmt.Errorf("%w: from is after to", errInvalidAggregateQuery)
+	}
+
+	if s := query.Get("bucket"); s != "" {
+		q.bucket = s
+	}
+	size, ok := aggregateBucketSizes[q.bucket]
+	if !ok {
+		return q, fmt.Errorf("%w: bucket", errInvalidAggregateQuery)
+	}
+	q.size = size
+
+	if s := query.Get("fn"); s != "" {
+		q.fns = nil
+		for fn := range strings.SplitSeq(s, ",") {
+			fn = strings.TrimSpace(fn)
+			known := false
+			for _, f := range aggregateFns {
+				known = known || f == fn
+			}
+			if !known {
+				return q, fmt.Errorf("%w: fn %q", errInvalidAggregateQuery, fn)
+			}
+			q.fns = append(q.fns, fn)
+		}
+	}
+
+	if s := query.Get("tz"); s != "" {
+		loc, err := time.LoadLocation(s)
+		if err != nil {
+			return q, fmt.Errorf("%w: tz", errInvalidAggregateQuery)
+		}
+		q.loc = loc
+	}
+
+	q.device = query.Get("device")
+	return q, nil
+}
+
+func (q aggregateQuery) render(b AggregateBucket) AggregateBucketResponse {
+	metric := func(m MetricAggregate) map[string]any {
+		values := make(map[string]any, len(q.fns))
+		for _, fn := range q.fns {
+			switch fn {
+			case "avg":
+				values[fn] = m.Avg
+			case "min":
+				values[fn] = m.Min
+			case "max":
+				values[fn] = m.Max
+			case "count":
+				values[fn] = b.Count
+			}
+		}
+		return values
+	}
+	return AggregateBucketResponse{
+		Start:    b.Start,
+		End:      b.End,
+		Empty:    b.Count == 0,
+		TempCo:   metric(b.TempCo),
+		TempRoom: metric(b.TempRoom),
+		Humidity: metric(b.Humidity),
+	}
+}
+
+func (a *app) dataAggregateHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		writeProblem(w, problemMethodNotAllowed, "")
+		return
+	}
+
+	q, err := parseAggregateQuery(r, a.timezone(), time.Now().UTC())
+	if err != nil {
+		writeProblem(w, problemInvalidParameter, err.Error())
+		return
+	}
+
+	starts, ends := bucketBounds(q.from, q.to, q.size, q.loc)
+	if len(starts) > maxAggregateBuckets {
+		writeProblem(w, problemInvalidParameter, fmt.Sprintf("too many buckets, at most %d", maxAggregateBuckets), fieldError{"bucket", "too small for the range"})
+		return
+	}
+
+	buckets, err := a.readings.AggregateReadings(r.Context(), q.device, starts, ends)
+	if err != nil {
+		logger.Error("Failed to aggregate temperature readings", "error", err)
+		writeProblem(w, problemInternal, "")
+		return
+	}
+
+	resp := AggregateResponse{
+		Bucket:   q.bucket,
+		Timezone: q.loc.String(),
+		From:     q.from.Unix(),
+		To:       q.to.Unix(),
+		Device:   q.device,
+		Buckets:  make([]AggregateBucketResponse, 0, len(buckets)),
+	}
+	for _, b := range buckets {
+		resp.Buckets = append(resp.Buckets, q.render(b))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketBounds(t *testing.T) {
+	from := time.Date(2024, 1, 1, 10, 7, 0, 0, time.UTC)
+	to := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	starts, ends := bucketBounds(from, to, time.Hour, time.UTC)
+	require.Len(t, starts, 3)
+	assert.Equal(t, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC).Unix(), starts[0])
+	assert.Equal(t, time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC).Unix(), ends[0])
+	assert.Equal(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).Unix(), starts[2])
+
+	// half hour offset zones align hourly buckets to the local hour
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	require.NoError(t, err)
+	starts, _ = bucketBounds(from, to, time.Hour, kolkata)
+	assert.Equal(t, time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC).Unix(), starts[0])
+}
+
+func TestBucketBoundsDaysAcrossDST(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	require.NoError(t, err)
+
+	from := time.Date(2024, 3, 30, 12, 0, 0, 0, warsaw)
+	to := time.Date(2024, 4, 1, 12, 0, 0, 0, warsaw)
+
+	starts, ends := bucketBounds(from, to, 0, warsaw)
+	require.Len(t, starts, 3)
+	assert.Equal(t, time.Date(2024, 3, 30, 0, 0, 0, 0, warsaw).Unix(), starts[0])
+	// the day clocks moved forward is an hour short
+	assert.Equal(t, int64(23*3600), ends[1]-starts[1])
+	assert.Equal(t, time.Date(2024, 4, 2, 0, 0, 0, 0, warsaw).Unix(), ends[2])
+}
+
+func TestParseAggregateQuery(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	req := httptest.NewRequest("GET", "/data/aggregate", nil)
+	q, err := parseAggregateQuery(req, time.UTC, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-24*time.Hour), q.from)
+	assert.Equal(t, "1h", q.bucket)
+	assert.Equal(t, aggregateFns, q.fns)
+
+	req = httptest.NewRequest("GET", "/data/aggregate?from=100&to=200&bucket=1d&fn=avg,max&tz=Europe/Warsaw&device=esp-a", nil)
+	q, err = parseAggregateQuery(req, time.UTC, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), q.from.Unix())
+	assert.Equal(t, int64(200), q.to.Unix())
+	assert.Equal(t, []string{"avg", "max"}, q.fns)
+	assert.Equal(t, "Europe/Warsaw", q.loc.String())
+	assert.Equal(t, "esp-a", q.device)
+
+	for _, query := range []string{
+		"bucket=2h",
+		"fn=median",
+		"tz=Mars/Olympus",
+		"from=200&to=100",
+		"from=abc",
+		"to=-1",
+	} {
+		req := httptest.NewRequest("GET", "/data/aggregate?"+query, nil)
+		_, err := parseAggregateQuery(req, time.UTC, now)
+		assert.ErrorIs(t, err, errInvalidAggregateQuery, query)
+	}
+}
+
+func TestDataAggregateHandlerInvalid(t *testing.T) {
+	app := &app{}
+
+	for _, query := range []string{"bucket=7m", "from=0&to=86400000&bucket=1m"} {
+		req := httptest.NewRequest("GET", "/data/aggregate?"+query, nil)
+		w := httptest.NewRecorder()
+		app.dataAggregateHandler(w, req)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, query)
+	}
+}
+
+func TestDataAggregateHandler(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "dummy"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	for _, r := range []struct {
+		tempCo    float64
+		timestamp int64
+	}{
+		{20.0, baseTime},
+		{30.0, baseTime + 1800},
+		{50.0, baseTime + 2*3600 + 60},
+	} {
+		_, err := db.Exec(context.Background(),
+			"INSERT INTO readings (temp_co, temp_room, humidity, timestamp) VALUES ($1, $2, $3, $4)",
+			r.tempCo, 18.0, 50.0, r.timestamp)
+		require.NoError(t, err)
+	}
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/data/aggregate?from=%d&to=%d&bucket=1h", baseTime, baseTime+2*3600+59), nil)
+	w := httptest.NewRecorder()
+	app.dataAggregateHandler(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp AggregateResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Len(t, resp.Buckets, 3)
+
+	assert.False(t, resp.Buckets[0].Empty)
+	assert.Equal(t, 25.0, resp.Buckets[0].TempCo["avg"])
+	assert.Equal(t, 20.0, resp.Buckets[0].TempCo["min"])
+	assert.Equal(t, 30.0, resp.Buckets[0].TempCo["max"])
+	assert.Equal(t, 2.0, resp.Buckets[0].TempCo["count"])
+
+	assert.True(t, resp.Buckets[1].Empty)
+	assert.Contains(t, resp.Buckets[1].TempCo, "avg")
+	assert.Nil(t, resp.Buckets[1].TempCo["avg"])
+	assert.Equal(t, 0.0, resp.Buckets[1].TempCo["count"])
+
+	assert.Equal(t, 50.0, resp.Buckets[2].TempCo["max"])
+}
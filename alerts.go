@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	alertStateOk      = "ok"
+	alertStatePending = "pending"
+	alertStateFiring  = "firing"
+)
+
+type alertTransition int
+
+const (
+	alertNoChange alertTransition = iota
+	alertFire
+	alertResolve
+)
+
+var alertMetrics = map[string]func(TemperatureReading) float64{
+	"tempCo":   func(tr TemperatureReading) float64 { return tr.TempCo },
+	"tempRoom": func(tr TemperatureReading) float64 { return tr.TempRoom },
+	"humidity": func(tr TemperatureReading) float64 { return tr.Humidity },
+}
+
+var errInvalidAlertRule = errors.New("invalid alert rule")
+
+// AlertRule fires once Metric compared to Threshold has held for Duration
+// seconds of reading time, and resolves once the value is back past the
+// threshold by more than Hysteresis. A rule without DeviceId applies to
+// every device, each device is tracked separately.
+type AlertRule struct {
+	Id         int     `json:"id"`
+	Name       string  `json:"name"`
+	DeviceId   *string `json:"deviceId"`
+	Metric     string  `json:"metric"`
+	Comparator string  `json:"comparator"`
+	Threshold  float64 `json:"threshold"`
+	Duration   int64   `json:"duration"`
+	Hysteresis float64 `json:"hysteresis"`
+	Enabled    bool    `json:"enabled"`
+	CreatedAt  int64   `json:"createdAt"`
+}
+
+type AlertEvent struct {
+	Id            int      `json:"id"`
+	RuleId        *int     `json:"ruleId"`
+	RuleName      string   `json:"ruleName"`
+	DeviceId      string   `json:"deviceId"`
+	Metric        string   `json:"metric"`
+	Comparator    string   `json:"comparator"`
+	Threshold     float64  `json:"threshold"`
+	Value         float64  `json:"value"`
+	FiredAt       int64    `json:"firedAt"`
+	ResolvedAt    *int64   `json:"resolvedAt"`
+	ResolvedValue *float64 `json:"resolvedValue"`
+	State         string   `json:"state"`
+}
+
+type alertState struct {
+	State         string
+	PendingSince  *int64
+	EventId       *int
+	LastTimestamp int64
+}
+
+func (r AlertRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("%w: name is required", errInvalidAlertRule)
+	}
+	if r.DeviceId != nil && !validDeviceId(*r.DeviceId) {
+		return fmt.Errorf("%w: deviceId", errInvalidAlertRule)
+	}
+	if _, ok := alertMetrics[r.Metric]; !ok {
+		return fmt.Errorf("%w: metric must be tempCo, tempRoom or humidity", errInvalidAlertRule)
+	}
+	switch r.Comparator {
+	case ">", ">=", "<", "<=":
+	default:
+		return fmt.Errorf("%w: comparator must be >, >=, < or <=", errInvalidAlertRule)
+	}
+	if r.Duration < 0 {
+		return fmt.Errorf("%w: duration must not be negative", errInvalidAlertRule)
+	}
+	if r.Hysteresis < 0 {
+		return fmt.Errorf("%w: hysteresis must not be negative", errInvalidAlertRule)
+	}
+	return nil
+}
+
+func (r AlertRule) breached(v float64) bool {
+	switch r.Comparator {
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "<":
+		return v < r.Threshold
+	case "<=":
+		return v <= r.Threshold
+	}
+	return false
+}
+
+// recovered reports whether v is back past the threshold by the hysteresis
+func (r AlertRule) recovered(v float64) bool {
+	switch r.Comparator {
+	case ">", ">=":
+		return !r.breached(v + r.Hysteresis)
+	default:
+		return !r.breached(v - r.Hysteresis)
+	}
+}
+
+// next advances the state of the rule for one device by a reading taken at
+// ts. The caller records the event for alertFire and alertResolve.
+func (r AlertRule) next(s alertState, v float64, ts int64) (alertState, alertTransition) {
+	s.LastTimestamp = ts
+	switch s.State {
+	case alertStateFiring:
+		if r.recovered(v) {
+			return alertState{State: alertStateOk, LastTimestamp: ts}, alertResolve
+		}
+		return s, alertNoChange
+	case alertStatePending:
+		if !r.breached(v) {
+			return alertState{State: alertStateOk, LastTimestamp: ts}, alertNoChange
+		}
+	default:
+		if !r.breached(v) {
+			return s, alertNoChange
+		}
+		s.State = alertStatePending
+		s.PendingSince = &ts
+	}
+	if ts-*s.PendingSince >= r.Duration {
+		return alertState{State: alertStateFiring, EventId: s.EventId, LastTimestamp: ts}, alertFire
+	}
+	return s, alertNoChange
+}
+
+func alertEventFromRule(r AlertRule, deviceId string, v float64, ts int64) AlertEvent {
+	ruleId := r.Id
+	return AlertEvent{
+		RuleId:     &ruleId,
+		RuleName:   r.Name,
+		DeviceId:   deviceId,
+		Metric:     r.Metric,
+		Comparator: r.Comparator,
+		Threshold:  r.Threshold,
+		Value:      v,
+		FiredAt:    ts,
+		State:      alertStateFiring,
+	}
+}
+
+const alertRuleColumns = `id, name, device_id, metric, comparator, threshold, duration, hysteresis, enabled, created_at`
+
+func scanAlertRule(row pgx.CollectableRow) (AlertRule, error) {
+	var r AlertRule
+	err := row.Scan(&r.Id, &r.Name, &r.DeviceId, &r.Metric, &r.Comparator, &r.Threshold, &r.Duration, &r.Hysteresis, &r.Enabled, &r.CreatedAt)
+	return r, err
+}
+
+const alertEventColumns = `id, rule_id, rule_name, device_id, metric, comparator, threshold, value, fired_at, resolved_at, resolved_value`
+
+func scanAlertEvent(row pgx.CollectableRow) (AlertEvent, error) {
+	var e AlertEvent
+	err := row.Scan(&e.Id, &e.RuleId, &e.RuleName, &e.DeviceId, &e.Metric, &e.Comparator, &e.Threshold, &e.Value, &e.FiredAt, &e.ResolvedAt, &e.ResolvedValue)
+	e.State = alertStateFiring
+	if e.ResolvedAt != nil {
+		e.State = "resolved"
+	}
+	return e, err
+}
+
+// evaluateAlerts runs a stored reading through every enabled rule of its
+// device. Readings older than the last one evaluated for a rule, such as
+// backfilled ones, are skipped so they can't flip the state back in time.
+// Rules live in Postgres, without it there is nothing to evaluate.
+func (a *app) evaluateAlerts(ctx context.Context, tr TemperatureReading) error {
+	if a.db == nil {
+		return nil
+	}
+	var changed []AlertEvent
+	err := pgx.BeginFunc(ctx, a.db, func(tx pgx.Tx) error {
+		changed = changed[:0]
+		rows, err := tx.Query(ctx, `
+			SELECT `+alertRuleColumns+`
+			FROM alert_rules
+			WHERE enabled AND (device_id IS NULL OR device_id = $1)
+			ORDER BY id`, tr.DeviceId)
+		if err != nil {
+			return err
+		}
+		rules, err := pgx.CollectRows(rows, scanAlertRule)
+		if err != nil {
+			return err
+		}
+
+		for _, rule := range rules {
+			_, err := tx.Exec(ctx, `
+				INSERT INTO alert_states (rule_id, device_id, state, last_timestamp)
+				VALUES ($1, $2, $3, 0)
+				ON CONFLICT DO NOTHING
+			`, rule.Id, tr.DeviceId, alertStateOk)
+			if err != nil {
+				return err
+			}
+			var s alertState
+			err = tx.QueryRow(ctx, `
+				SELECT state, pending_since, event_id, last_timestamp
+				FROM alert_states
+				WHERE rule_id = $1 AND device_id = $2
+				FOR UPDATE`, rule.Id, tr.DeviceId).Scan(&s.State, &s.PendingSince, &s.EventId, &s.LastTimestamp)
+			if err != nil {
+				return err
+			}
+			if *tr.Timestamp < s.LastTimestamp {
+				continue
+			}
+
+			v := alertMetrics[rule.Metric](tr)
+			next, transition := rule.next(s, v, *tr.Timestamp)
+			switch transition {
+			case alertFire:
+				e := alertEventFromRule(rule, tr.DeviceId, v, *tr.Timestamp)
+				err := tx.QueryRow(ctx, `
+					INSERT INTO alert_events (rule_id, rule_name, device_id, metric, comparator, threshold, value, fired_at)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+					RETURNING id
+				`, e.RuleId, e.RuleName, e.DeviceId, e.Metric, e.Comparator, e.Threshold, e.Value, e.FiredAt).Scan(&e.Id)
+				if err != nil {
+					return err
+				}
+				next.EventId = &e.Id
+				if err := queueWebhookEvent(ctx, tx, webhookAlertFiring, e.DeviceId, e); err != nil {
+					return err
+				}
+				changed = append(changed, e)
+			case alertResolve:
+				if s.EventId == nil {
+					break
+				}
+				rows, err := tx.Query(ctx, `
+					UPDATE alert_events SET resolved_at = $2, resolved_value = $3
+					WHERE id = $1
+					RETURNING `+alertEventColumns, *s.EventId, *tr.Timestamp, v)
+				if err != nil {
+					return err
+				}
+				e, err := pgx.CollectExactlyOneRow(rows, scanAlertEvent)
+				if err != nil {
+					return err
+				}
+				if err := queueWebhookEvent(ctx, tx, webhookAlertResolved, e.DeviceId, e); err != nil {
+					return err
+				}
+				changed = append(changed, e)
+			}
+
+			_, err = tx.Exec(ctx, `
+				UPDATE alert_states
+				SET state = $3, pending_since = $4, event_id = $5, last_timestamp = $6
+				WHERE rule_id = $1 AND device_id = $2
+			`, rule.Id, tr.DeviceId, next.State, next.PendingSince, next.EventId, next.LastTimestamp)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	a.publishAlertEvents(changed)
+	return nil
+}
+
+// evaluateAlertsAfterInsert evaluates alerts for a freshly stored reading. A
+// failure is only logged, the reading itself was stored fine.
+func (a *app) evaluateAlertsAfterInsert(ctx context.Context, tr TemperatureReading) {
+	if err := a.evaluateAlerts(ctx, tr); err != nil {
+		slogctx.FromCtx(ctx).Error("Failed to evaluate alert rules", "error", err, "reading_id", tr.Id)
+	}
+}
+
+// resolveRuleAlerts resolves the open events of a rule that is changed or
+// deleted, the condition they fired on no longer applies. The events are
+// queued for the webhooks and returned to be published once tx commits.
+func resolveRuleAlerts(ctx context.Context, tx pgx.Tx, ruleId int, now int64) ([]AlertEvent, error) {
+	rows, err := tx.Query(ctx, `
+		UPDATE alert_events SET resolved_at = $2
+		WHERE rule_id = $1 AND resolved_at IS NULL
+		RETURNING `+alertEventColumns, ruleId, now)
+	if err != nil {
+		return nil, err
+	}
+	events, err := pgx.CollectRows(rows, scanAlertEvent)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		if err := queueWebhookEvent(ctx, tx, webhookAlertResolved, e.DeviceId, e); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (a *app) publishAlertEvents(events []AlertEvent) {
+	for _, e := range events {
+		a.hub.publish(Event{Type: eventAlert, Id: int64(e.Id), DeviceId: e.DeviceId, Data: e})
+	}
+}
+
+// updateAlertRule replaces rule id. Its devices start over from ok, their
+// state was tracked against the old condition, and alerts it was firing are
+// resolved. pgx.ErrNoRows is returned if there is no such rule.
+func (a *app) updateAlertRule(ctx context.Context, id int, rule AlertRule) (AlertRule, error) {
+	var resolved []AlertEvent
+	err := pgx.BeginFunc(ctx, a.db, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			UPDATE alert_rules
+			SET name = $2, device_id = $3, metric = $4, comparator = $5, threshold = $6, duration = $7, hysteresis = $8, enabled = $9
+			WHERE id = $1
+			RETURNING `+alertRuleColumns,
+			id, rule.Name, rule.DeviceId, rule.Metric, rule.Comparator, rule.Threshold, rule.Duration, rule.Hysteresis, rule.Enabled)
+		if err != nil {
+			return err
+		}
+		if rule, err = pgx.CollectExactlyOneRow(rows, scanAlertRule); err != nil {
+			return err
+		}
+		if resolved, err = resolveRuleAlerts(ctx, tx, id, time.Now().UTC().Unix()); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM alert_states WHERE rule_id = $1`, id)
+		return err
+	})
+	if err != nil {
+		return rule, err
+	}
+	a.publishAlertEvents(resolved)
+	return rule, nil
+}
+
+// deleteAlertRule deletes rule id, resolving the alerts it was firing. Events
+// outlive their rule, they keep a copy of what they fired on. It reports
+// false if there is no such rule.
+func (a *app) deleteAlertRule(ctx context.Context, id int) (bool, error) {
+	var resolved []AlertEvent
+	var deleted bool
+	err := pgx.BeginFunc(ctx, a.db, func(tx pgx.Tx) error {
+		var err error
+		if resolved, err = resolveRuleAlerts(ctx, tx, id, time.Now().UTC().Unix()); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `DELETE FROM alert_rules WHERE id = $1`, id)
+		deleted = tag.RowsAffected() == 1
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	a.publishAlertEvents(resolved)
+	return deleted, nil
+}
+
+func decodeAlertRule(r *http.Request) (AlertRule, error) {
+	rule := AlertRule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		return rule, fmt.Errorf("%w: %s", errInvalidAlertRule, err)
+	}
+	return rule, rule.validate()
+}
+
+func (a *app) alertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(r.Context(), `SELECT `+alertRuleColumns+` FROM alert_rules ORDER BY id`)
+		if err != nil {
+			logger.Error("Failed to query alert rules", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		rules, err := pgx.CollectRows(rows, scanAlertRule)
+		if err != nil {
+			logger.Error("Failed to scan alert rules", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		if rules == nil {
+			rules = make([]AlertRule, 0)
+		}
+		json.NewEncoder(w).Encode(rules)
+
+	case http.MethodPost:
+		if !a.isAdmin(r) {
+			writeProblem(w, problemForbidden, "")
+			return
+		}
+		rule, err := decodeAlertRule(r)
+		if err != nil {
+			writeProblem(w, problemInvalidAlertRule, err.Error())
+			return
+		}
+		rows, err := a.db.Query(r.Context(), `
+			INSERT INTO alert_rules (name, device_id, metric, comparator, threshold, duration, hysteresis, enabled, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING `+alertRuleColumns,
+			rule.Name, rule.DeviceId, rule.Metric, rule.Comparator, rule.Threshold, rule.Duration, rule.Hysteresis, rule.Enabled, time.Now().UTC().Unix())
+		if err != nil {
+			logger.Error("Failed to insert alert rule", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		rule, err = pgx.CollectExactlyOneRow(rows, scanAlertRule)
+		if err != nil {
+			logger.Error("Failed to insert alert rule", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+
+	default:
+		writeProblem(w, problemMethodNotAllowed, "")
+	}
+}
+
+func (a *app) alertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeProblem(w, problemNotFound, "")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(r.Context(), `SELECT `+alertRuleColumns+` FROM alert_rules WHERE id = $1`, id)
+		if err != nil {
+			logger.Error("Failed to query alert rule", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		rule, err := pgx.CollectExactlyOneRow(rows, scanAlertRule)
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeProblem(w, problemNotFound, "")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to scan alert rule", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		json.NewEncoder(w).Encode(rule)
+
+	case http.MethodPut:
+		if !a.isAdmin(r) {
+			writeProblem(w, problemForbidden, "")
+			return
+		}
+		rule, err := decodeAlertRule(r)
+		if err != nil {
+			writeProblem(w, problemInvalidAlertRule, err.Error())
+			return
+		}
+		rule, err = a.updateAlertRule(r.Context(), id, rule)
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeProblem(w, problemNotFound, "")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to update alert rule", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		json.NewEncoder(w).Encode(rule)
+
+	case http.MethodDelete:
+		if !a.isAdmin(r) {
+			writeProblem(w, problemForbidden, "")
+			return
+		}
+		deleted, err := a.deleteAlertRule(r.Context(), id)
+		if err != nil {
+			logger.Error("Failed to delete alert rule", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		if !deleted {
+			writeProblem(w, problemNotFound, "")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeProblem(w, problemMethodNotAllowed, "")
+	}
+}
+
+// alertEventsHandler lists alert events, newest first. state=firing returns
+// the alerts that are currently firing, state=resolved past ones.
+func (a *app) alertEventsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		writeProblem(w, problemMethodNotAllowed, "")
+		return
+	}
+
+	query := r.URL.Query()
+
+	limit := 50
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	offset := 0
+	if o, err := strconv.Atoi(query.Get("offset")); err == nil && o >= 0 {
+		offset = o
+	}
+
+	var ruleId *int
+	if s := query.Get("rule"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			writeProblem(w, problemInvalidParameter, "", fieldError{"rule", "must be a rule id"})
+			return
+		}
+		ruleId = &id
+	}
+
+	state := query.Get("state")
+	if state != "" && state != alertStateFiring && state != "resolved" {
+		writeProblem(w, problemInvalidParameter, "", fieldError{"state", "must be firing or resolved"})
+		return
+	}
+
+	rows, err := a.db.Query(r.Context(), `
+		SELECT `+alertEventColumns+`
+		FROM alert_events
+		WHERE ($1::TEXT = '' OR ($1 = 'firing') = (resolved_at IS NULL))
+			AND ($2::INT IS NULL OR rule_id = $2)
+			AND ($3::TEXT = '' OR device_id = $3)
+		ORDER BY fired_at DESC, id DESC
+		LIMIT $4 OFFSET $5
+	`, state, ruleId, query.Get("device"), limit, offset)
+	if err != nil {
+		logger.Error("Failed to query alert events", "error", err)
+		writeProblem(w, problemInternal, "")
+		return
+	}
+	events, err := pgx.CollectRows(rows, scanAlertEvent)
+	if err != nil {
+		logger.Error("Failed to scan alert events", "error", err)
+		writeProblem(w, problemInternal, "")
+		return
+	}
+	if events == nil {
+		events = make([]AlertEvent, 0)
+	}
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlertRuleNext(t *testing.T) {
+	rule := AlertRule{Metric: "tempRoom", Comparator: ">", Threshold: 30, Duration: 60, Hysteresis: 2}
+
+	s := alertState{State: alertStateOk}
+	s, tr := rule.next(s, 31, 1000)
+	assert.Equal(t, alertStatePending, s.State)
+	assert.Equal(t, alertNoChange, tr)
+
+	s, tr = rule.next(s, 32, 1030)
+	assert.Equal(t, alertStatePending, s.State)
+	assert.Equal(t, alertNoChange, tr)
+
+	s, tr = rule.next(s, 32, 1060)
+	assert.Equal(t, alertStateFiring, s.State)
+	assert.Equal(t, alertFire, tr)
+
+	// within the hysteresis band the alert keeps firing
+	s, tr = rule.next(s, 29, 1090)
+	assert.Equal(t, alertStateFiring, s.State)
+	assert.Equal(t, alertNoChange, tr)
+
+	s, tr = rule.next(s, 27.5, 1120)
+	assert.Equal(t, alertStateOk, s.State)
+	assert.Equal(t, alertResolve, tr)
+
+	// dropping below the threshold resets the pending timer
+	s, _ = rule.next(s, 31, 1200)
+	s, _ = rule.next(s, 29, 1230)
+	s, tr = rule.next(s, 31, 1270)
+	assert.Equal(t, alertStatePending, s.State)
+	assert.Equal(t, alertNoChange, tr)
+}
+
+func TestAlertRuleNextBelowImmediate(t *testing.T) {
+	rule := AlertRule{Metric: "humidity", Comparator: "<=", Threshold: 20, Hysteresis: 5}
+
+	s, tr := rule.next(alertState{State: alertStateOk}, 20, 1000)
+	assert.Equal(t, alertStateFiring, s.State)
+	assert.Equal(t, alertFire, tr)
+
+	s, tr = rule.next(s, 25, 1010)
+	assert.Equal(t, alertNoChange, tr)
+
+	s, tr = rule.next(s, 25.5, 1020)
+	assert.Equal(t, alertStateOk, s.State)
+	assert.Equal(t, alertResolve, tr)
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	valid := AlertRule{Name: "Hot", Metric: "tempCo", Comparator: ">", Threshold: 80}
+	assert.NoError(t, valid.validate())
+
+	invalid := []AlertRule{
+		{Metric: "tempCo", Comparator: ">"},
+		{Name: "Hot", Metric: "pressure", Comparator: ">"},
+		{Name: "Hot", Metric: "tempCo", Comparator: "=="},
+		{Name: "Hot", Metric: "tempCo", Comparator: ">", Duration: -1},
+		{Name: "Hot", Metric: "tempCo", Comparator: ">", Hysteresis: -1},
+	}
+	for _, r := range invalid {
+		assert.ErrorIs(t, r.validate(), errInvalidAlertRule)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret", hub: newEventHub()}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	sub := app.hub.subscribe(func(e Event) bool { return e.Type == eventAlert })
+	defer app.hub.unsubscribe(sub)
+
+	// creating rules needs the admin key
+	body := `{"name": "Hot room", "metric": "tempRoom", "comparator": ">", "threshold": 30, "duration": 60, "hysteresis": 2}`
+	req := httptest.NewRequest("POST", "/alerts/rules", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+	app.alertRulesHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req = httptest.NewRequest("POST", "/alerts/rules", bytes.NewReader([]byte(`{"name": "Bad", "metric": "pressure", "comparator": ">"}`)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	app.alertRulesHandler(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	req = httptest.NewRequest("POST", "/alerts/rules", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	app.alertRulesHandler(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var rule AlertRule
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&rule))
+	assert.True(t, rule.Enabled)
+	assert.Nil(t, rule.DeviceId)
+
+	insert := func(device string, tempRoom float64, ts int64) {
+		t.Helper()
+		_, err := app.insertReading(context.Background(), TemperatureReadingPayload{DeviceId: device, TempRoom: tempRoom, Timestamp: &ts})
+		require.NoError(t, err)
+	}
+	events := func(query string) []AlertEvent {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/alerts/events"+query, nil)
+		w := httptest.NewRecorder()
+		app.alertEventsHandler(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var events []AlertEvent
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&events))
+		return events
+	}
+
+	insert("esp-a", 31, 1000)
+	insert("esp-b", 35, 1000)
+	insert("esp-a", 32, 1030)
+	assert.Empty(t, events(""))
+
+	// only esp-b has been above the threshold long enough
+	insert("esp-b", 35, 1060)
+	firing := events("?state=firing")
+	require.Len(t, firing, 1)
+	assert.Equal(t, "esp-b", firing[0].DeviceId)
+	assert.Equal(t, alertStateFiring, firing[0].State)
+	assert.Equal(t, "Hot room", firing[0].RuleName)
+
+	e := <-sub.events
+	assert.Equal(t, "esp-b", e.DeviceId)
+
+	// backfilled readings don't move the state back in time
+	insert("esp-b", 20, 900)
+	assert.Len(t, events("?state=firing"), 1)
+
+	insert("esp-b", 27, 1120)
+	assert.Empty(t, events("?state=firing"))
+	resolved := events("?state=resolved&device=esp-b")
+	require.Len(t, resolved, 1)
+	require.NotNil(t, resolved[0].ResolvedAt)
+	assert.Equal(t, int64(1120), *resolved[0].ResolvedAt)
+
+	e = <-sub.events
+	assert.Equal(t, "resolved", e.Data.(AlertEvent).State)
+
+	insert("esp-b", 35, 1130)
+	insert("esp-b", 35, 1190)
+	require.Len(t, events("?state=firing"), 1)
+	<-sub.events
+
+	// disabled rules are not evaluated, and what they were firing resolves
+	body = `{"name": "Hot room", "metric": "tempRoom", "comparator": ">", "threshold": 30, "enabled": false}`
+	req = httptest.NewRequest("PUT", "/alerts/rules/1", bytes.NewReader([]byte(body)))
+	req.SetPathValue("id", "1")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	app.alertRuleHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, events("?state=firing"))
+	e = <-sub.events
+	assert.Equal(t, "resolved", e.Data.(AlertEvent).State)
+	var states int
+	require.NoError(t, db.QueryRow(context.Background(), "SELECT COUNT(*) FROM alert_states WHERE rule_id = 1").Scan(&states))
+	assert.Zero(t, states)
+
+	insert("esp-b", 40, 1200)
+	assert.Empty(t, events("?state=firing"))
+
+	// history outlives the rule
+	req = httptest.NewRequest("DELETE", "/alerts/rules/1", nil)
+	req.SetPathValue("id", "1")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	app.alertRuleHandler(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	req = httptest.NewRequest("GET", "/alerts/rules/1", nil)
+	req.SetPathValue("id", "1")
+	w = httptest.NewRecorder()
+	app.alertRuleHandler(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	history := events("")
+	require.Len(t, history, 2)
+	assert.Nil(t, history[0].RuleId)
+}
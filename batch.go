@@ -0,0 +1,181 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const defaultMaxBatchSize = 500
+
+// BatchItemResult reports the outcome of one reading of a batch, Status uses
+// the code POST /data would have answered with for that reading alone.
+type BatchItemResult struct {
+	Index   int                 `json:"index"`
+	Status  int                 `json:"status"`
+	Error   string              `json:"error,omitempty"`
+	Problem *Problem            `json:"problem,omitempty"`
+	Reading *TemperatureReading `json:"reading,omitempty"`
+}
+
+// fail refuses the reading with p, Error keeps the message of older clients
+func (res *BatchItemResult) fail(msg string, p *Problem) {
+	res.Status = p.Status
+	res.Error = msg
+	res.Problem = p
+}
+
+type BatchResult struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+func (a *app) batchLimit() int {
+	if a.maxBatchSize > 0 {
+		return a.maxBatchSize
+	}
+	return defaultMaxBatchSize
+}
+
+// dataBatchHandler stores buffered readings in one transaction. A bad reading
+// doesn't discard the rest of the batch; the response is 207 if any reading
+// was rejected.
+func (a *app) dataBatchHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		writeProblem(w, problemMethodNotAllowed, "")
+		return
+	}
+
+	if a.rateLimited(w, r, routeDataBatch, limitIP, clientIP(r)) {
+		ingestRejected.WithLabelValues(ingestBatch, reasonRateLimited).Inc()
+		return
+	}
+	// the body can't be much larger than a full batch of readings
+	body, ok := readIngestBody(w, r, ingestBatch, int64(a.batchLimit())*maxReadingSize)
+	if !ok {
+		return
+	}
+	authDeviceId, err := a.authenticateRequest(r, body)
+	if isAuthError(err) {
+		logger.Warn("Rejected ingest request", "error", err)
+		ingestRejected.WithLabelValues(ingestBatch, rejectReason(err)).Inc()
+		writeProblem(w, problemForbidden, "")
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to authenticate device", "error", err)
+		ingestFailed.WithLabelValues(ingestBatch, reasonAuthBackend).Inc()
+		writeProblem(w, problemInternal, "")
+		return
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		logger.Error("failed to decode temperature reading batch", slog.Any("error", err))
+		ingestRejected.WithLabelValues(ingestBatch, reasonBadRequest).Inc()
+		writeProblem(w, problemInvalidJSON, err.Error())
+		return
+	}
+	if len(items) > a.batchLimit() {
+		ingestRejected.WithLabelValues(ingestBatch, reasonBatchTooLarge).Add(float64(len(items)))
+		writeProblem(w, problemBatchTooLarge, fmt.Sprintf("at most %d readings per batch", a.batchLimit()))
+		return
+	}
+
+	result := BatchResult{Results: make([]BatchItemResult, len(items))}
+	payloads := make([]*TemperatureReadingPayload, len(items))
+	for i, item := range items {
+		result.Results[i] = BatchItemResult{Index: i, Status: http.StatusOK}
+		var tri TemperatureReadingPayload
+		if err := json.Unmarshal(item, &tri); err != nil {
+			ingestRejected.WithLabelValues(ingestBatch, reasonBadRequest).Inc()
+			result.Results[i].fail("Bad request", problemInvalidJSON.problem(err.Error()))
+			continue
+		}
+		err := prepareReading(authDeviceId, &tri)
+		if err == nil {
+			err = a.validateReading(r.Context(), &tri)
+		}
+		if err != nil {
+			ingestRejected.WithLabelValues(ingestBatch, rejectReason(err)).Inc()
+			if isAuthError(err) {
+				result.Results[i].fail("Forbidden", problemForbidden.problem(""))
+			} else {
+				result.Results[i].fail(ingestErrorMessage(err), ingestProblem(err))
+			}
+			continue
+		}
+		// every reading counts against its device, shared key batches may
+		// mix devices
+		if p, _ := a.takeToken(r.Context(), routeDataBatch, limitDevice, tri.DeviceId); p != nil {
+			ingestRejected.WithLabelValues(ingestBatch, reasonRateLimited).Inc()
+			result.Results[i].fail("Too many requests", p)
+			continue
+		}
+		payloads[i] = &tri
+	}
+
+	logger.Info("Received temperature reading batch", slog.Int("size", len(items)))
+
+	var (
+		indexes []int
+		valid   []TemperatureReadingPayload
+	)
+	for i, p := range payloads {
+		if p != nil {
+			indexes = append(indexes, i)
+			valid = append(valid, *p)
+		}
+	}
+	start := time.Now()
+	readings, errs, err := a.readings.InsertReadings(r.Context(), valid)
+	observeInsert("batch", start)
+	if err != nil {
+		logger.Error("Failed to insert temperature reading batch", "error", err)
+		ingestFailed.WithLabelValues(ingestBatch, reasonDatabase).Add(float64(len(valid)))
+		writeProblem(w, problemInternal, "")
+		return
+	}
+	for j, i := range indexes {
+		if errs[j] != nil {
+			logger.Error("Failed to insert temperature reading", "error", errs[j], "index", i)
+			ingestFailed.WithLabelValues(ingestBatch, reasonDatabase).Inc()
+			result.Results[i].fail("Internal server error", problemInternal.problem(""))
+			continue
+		}
+		result.Results[i].Reading = &readings[j]
+	}
+
+	var stored []TemperatureReading
+	for _, res := range result.Results {
+		if res.Status == http.StatusOK {
+			observeAccepted(ingestBatch, *res.Reading)
+			stored = append(stored, *res.Reading)
+			result.Accepted++
+		} else {
+			result.Rejected++
+		}
+	}
+	// Buffered readings may arrive out of order, alerts need them in time order
+	slices.SortStableFunc(stored, func(x, y TemperatureReading) int {
+		return cmp.Compare(*x.Timestamp, *y.Timestamp)
+	})
+	for _, tr := range stored {
+		a.readingStored(r.Context(), tr)
+	}
+	if result.Rejected > 0 {
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepareReading(t *testing.T) {
+	p := TemperatureReadingPayload{TempCo: 1}
+	require.NoError(t, prepareReading("", &p))
+	assert.Equal(t, defaultDeviceId, p.DeviceId)
+	assert.NotNil(t, p.Timestamp)
+
+	ts := int64(1761388101)
+	p = TemperatureReadingPayload{DeviceId: "esp-a", Timestamp: &ts}
+	require.NoError(t, prepareReading("esp-a", &p))
+	assert.Equal(t, ts, *p.Timestamp)
+
+	p = TemperatureReadingPayload{DeviceId: "esp-b"}
+	assert.ErrorIs(t, prepareReading("esp-a", &p), errDeviceMismatch)
+
+	p = TemperatureReadingPayload{DeviceId: "esp b"}
+	assert.ErrorIs(t, prepareReading("", &p), errInvalidDeviceId)
+
+	ts = -1
+	p = TemperatureReadingPayload{DeviceId: "esp-a", Timestamp: &ts}
+	var invalid *invalidReadingError
+	require.ErrorAs(t, prepareReading("", &p), &invalid)
+	assert.Equal(t, []fieldError{{"timestamp", "must not be before 1970"}}, invalid.Fields)
+}
+
+func TestDataBatchHandler(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	body := `[
+		{"deviceId": "esp-a", "tempCo": 20.0, "tempRoom": 18.0, "humidity": 50.0, "timestamp": 1761388000},
+		{"deviceId": "esp a", "tempCo": 21.0, "tempRoom": 19.0, "humidity": 51.0},
+		{"deviceId": "esp-a", "tempCo": "hot"},
+		{"deviceId": "esp-a", "tempCo": 22.0, "tempRoom": 20.0, "humidity": 52.0, "timestamp": 1761388060}
+	]`
+	req := httptest.NewRequest("POST", "/data/batch", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+
+	app.dataBatchHandler(w, req)
+
+	require.Equal(t, http.StatusMultiStatus, w.Code)
+	var resp BatchResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, 2, resp.Accepted)
+	assert.Equal(t, 2, resp.Rejected)
+	require.Len(t, resp.Results, 4)
+	assert.Equal(t, http.StatusOK, resp.Results[0].Status)
+	assert.Equal(t, int64(1761388000), *resp.Results[0].Reading.Timestamp)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Results[1].Status)
+	assert.Nil(t, resp.Results[1].Reading)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Results[2].Status)
+	assert.Equal(t, http.StatusOK, resp.Results[3].Status)
+
+	var count int
+	require.NoError(t, db.QueryRow(context.Background(), "SELECT COUNT(*) FROM readings WHERE device_id = 'esp-a'").Scan(&count))
+	assert.Equal(t, 2, count)
+}
+
+func TestDataBatchHandlerAllAccepted(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	body := `[{"tempCo": 20.0, "tempRoom": 18.0, "humidity": 50.0}, {"tempCo": 21.0, "tempRoom": 19.0, "humidity": 51.0}]`
+	req := httptest.NewRequest("POST", "/data/batch", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+
+	app.dataBatchHandler(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp BatchResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, 2, resp.Accepted)
+	assert.Equal(t, 0, resp.Rejected)
+}
+
+func TestDataBatchHandlerRejected(t *testing.T) {
+	app := &app{secretKey: "testsecret", maxBatchSize: 2}
+
+	tests := []struct {
+		name   string
+		key    string
+		body   string
+		expect int
+	}{
+		{"too large", "testsecret", `[{}, {}, {}]`, http.StatusRequestEntityTooLarge},
+		{"not an array", "testsecret", `{"tempCo": 1}`, http.StatusUnprocessableEntity},
+		{"invalid auth", "", `[{}]`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/data/batch", bytes.NewReader([]byte(tt.body)))
+			req.Header.Set("X-Secret-Key", tt.key)
+			w := httptest.NewRecorder()
+
+			app.dataBatchHandler(w, req)
+
+			assert.Equal(t, tt.expect, w.Code)
+		})
+	}
+}
+
+func TestDataBatchHandlerPublishes(t *testing.T) {
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret", hub: newEventHub(), validation: ds18b20Validation()}
+	sub := app.hub.subscribe(nil)
+	defer app.hub.unsubscribe(sub)
+
+	// stored readings go through readingStored in time order, the suspect
+	// one is published too
+	app.validation.mode = validationFlag
+	body := `[
+		{"deviceId": "esp-a", "tempCo": 21, "timestamp": 1761388200},
+		{"deviceId": "esp-a", "tempCo": -127, "timestamp": 1761388100},
+		{"deviceId": "esp a", "tempCo": 22}
+	]`
+	req := httptest.NewRequest("POST", "/data/batch", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	app.dataBatchHandler(w, req)
+	require.Equal(t, http.StatusMultiStatus, w.Code)
+
+	for _, want := range []int64{1761388100, 1761388200} {
+		e := <-sub.events
+		assert.Equal(t, eventReading, e.Type)
+		assert.Equal(t, want, *e.Data.(TemperatureReading).Timestamp)
+	}
+	assert.Empty(t, sub.events)
+}
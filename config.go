@@ -0,0 +1,630 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the server configuration. Each setting is read from, in order of
+// precedence, its flag, its APP_* env variable, the YAML config file and the
+// default.
+type config struct {
+	Server struct {
+		Host            string   `yaml:"host"`
+		Port            int      `yaml:"port"`
+		Timezone        string   `yaml:"timezone"`
+		MaxBatchSize    int      `yaml:"max_batch_size"`
+		ShutdownTimeout duration `yaml:"shutdown_timeout"`
+		ShutdownDelay   duration `yaml:"shutdown_delay"`
+	} `yaml:"server"`
+	TLS struct {
+		Cert         string `yaml:"cert"`
+		Key          string `yaml:"key"`
+		ClientCA     string `yaml:"client_ca"`
+		ClientAuth   string `yaml:"client_auth"`
+		RedirectAddr string `yaml:"redirect_addr"`
+	} `yaml:"tls"`
+	Database struct {
+		Driver   string `yaml:"driver"`
+		Host     string `yaml:"host"`
+		Port     int    `yaml:"port"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+		Name     string `yaml:"name"`
+		Path     string `yaml:"path"`
+	} `yaml:"database"`
+	Auth struct {
+		SecretKey       string   `yaml:"secret_key"`
+		SigningKey      string   `yaml:"signing_key"`
+		RejectSharedKey bool     `yaml:"reject_shared_key"`
+		HmacSkew        duration `yaml:"hmac_skew"`
+	} `yaml:"auth"`
+	CORS struct {
+		AllowedOrigins stringList `yaml:"allowed_origins"`
+	} `yaml:"cors"`
+	MQTT struct {
+		Broker   string `yaml:"broker"`
+		Topic    string `yaml:"topic"`
+		ClientId string `yaml:"client_id"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"mqtt"`
+	RateLimit struct {
+		IP          rateLimit                  `yaml:"ip"`
+		Device      rateLimit                  `yaml:"device"`
+		Routes      map[string]routeRateLimits `yaml:"routes"`
+		MaxKeys     int                        `yaml:"max_keys"`
+		IdleTimeout duration                   `yaml:"idle_timeout"`
+	} `yaml:"rate_limit"`
+	Validation struct {
+		Mode     string       `yaml:"mode"`
+		TempCo   metricLimits `yaml:"temp_co"`
+		TempRoom metricLimits `yaml:"temp_room"`
+		Humidity metricLimits `yaml:"humidity"`
+	} `yaml:"validation"`
+	Retention struct {
+		Keep      retention        `yaml:"keep"`
+		Devices   deviceRetentions `yaml:"devices"`
+		Interval  duration         `yaml:"interval"`
+		BatchSize int              `yaml:"batch_size"`
+		DryRun    bool             `yaml:"dry_run"`
+	} `yaml:"retention"`
+	Alerting struct {
+		WebhookTimeout      duration `yaml:"webhook_timeout"`
+		WebhookMaxAttempts  int      `yaml:"webhook_max_attempts"`
+		WebhookBackoffBase  duration `yaml:"webhook_backoff_base"`
+		WebhookBackoffMax   duration `yaml:"webhook_backoff_max"`
+		WebhookPollInterval duration `yaml:"webhook_poll_interval"`
+		OfflineAfter        duration `yaml:"offline_after"`
+	} `yaml:"alerting"`
+
+	// overrides are the flags set by env, logged once the config is used
+	overrides []envOverride
+}
+
+type envOverride struct {
+	flag, env, value string
+}
+
+func defaultConfig() *config {
+	c := &config{}
+	c.Server.Host = "127.0.0.1"
+	c.Server.Port = 8080
+	c.Server.Timezone = "UTC"
+	c.Server.MaxBatchSize = defaultMaxBatchSize
+	c.Server.ShutdownTimeout = duration(defaultShutdownTimeout)
+	c.TLS.ClientAuth = clientAuthOptional
+	c.Database.Driver = "postgres"
+	c.Database.Host = "localhost"
+	c.Database.Port = 5432
+	c.Database.User = "user"
+	c.Database.Name = "dbname"
+	c.Database.Path = "esp8266-web.db"
+	c.Auth.HmacSkew = duration(defaultSignatureSkew)
+	c.CORS.AllowedOrigins = stringList{"*"}
+	c.MQTT.Topic = "esp/+/readings"
+	c.MQTT.ClientId = "esp8266-web"
+	c.RateLimit.Routes = map[string]routeRateLimits{}
+	c.RateLimit.MaxKeys = defaultRateLimitMaxKeys
+	c.RateLimit.IdleTimeout = duration(defaultRateLimitIdle)
+	v := defaultReadingValidation()
+	c.Validation.Mode = v.mode
+	c.Validation.TempCo = v.tempCo
+	c.Validation.TempRoom = v.tempRoom
+	c.Validation.Humidity = v.humidity
+	c.Retention.Devices = deviceRetentions{}
+	c.Retention.Interval = duration(defaultRetentionInterval)
+	c.Retention.BatchSize = defaultRetentionBatchSize
+	c.Alerting.WebhookTimeout = duration(webhookTimeout)
+	c.Alerting.WebhookMaxAttempts = webhookMaxAttempts
+	c.Alerting.WebhookBackoffBase = duration(webhookBackoffBase)
+	c.Alerting.WebhookBackoffMax = duration(webhookBackoffMax)
+	c.Alerting.WebhookPollInterval = duration(webhookPollInterval)
+	c.Alerting.OfflineAfter = duration(defaultOfflineAfter)
+	return c
+}
+
+// secretFlags are the settings redacted in logs and config print
+var secretFlags = []string{"db-pass", "secret-key", "signing-key", "mqtt-pass"}
+
+// flagSet binds a flag to every setting of c. Flags default to the value
+// already in c, so parsing only overrides the ones given.
+func (c *config) flagSet(path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("esp8266-web", flag.ContinueOnError)
+	fs.StringVar(path, "config", *path, "YAML config file")
+
+	fs.StringVar(&c.Server.Host, "host", c.Server.Host, "Server host")
+	fs.IntVar(&c.Server.Port, "port", c.Server.Port, "Server port")
+	fs.StringVar(&c.Server.Timezone, "timezone", c.Server.Timezone, "Timezone aggregation buckets are aligned to")
+	fs.IntVar(&c.Server.MaxBatchSize, "max-batch-size", c.Server.MaxBatchSize, "Maximum number of readings accepted by POST /data/batch")
+	fs.Var(&c.Server.ShutdownTimeout, "shutdown-timeout", "How long in-flight requests get to finish on shutdown")
+	fs.Var(&c.Server.ShutdownDelay, "shutdown-delay", "How long /health reports draining before the listener closes on shutdown")
+
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "TLS certificate file, serves HTTPS with --tls-key")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "TLS private key file")
+	fs.StringVar(&c.TLS.ClientCA, "tls-client-ca", c.TLS.ClientCA, "CA file for device client certificates, enables mutual TLS")
+	fs.StringVar(&c.TLS.ClientAuth, "tls-client-auth", c.TLS.ClientAuth, "With a client CA, optional or require a client certificate on device requests")
+	fs.StringVar(&c.TLS.RedirectAddr, "tls-redirect-addr", c.TLS.RedirectAddr, "Address of a plain HTTP listener redirecting to HTTPS, e.g. :80 (disabled if empty)")
+
+	fs.StringVar(&c.Database.Driver, "db-driver", c.Database.Driver, "Database driver, postgres, sqlite or memory")
+	fs.StringVar(&c.Database.Host, "db-host", c.Database.Host, "Database host")
+	fs.IntVar(&c.Database.Port, "db-port", c.Database.Port, "Database port")
+	fs.StringVar(&c.Database.User, "db-user", c.Database.User, "Database user")
+	fs.StringVar(&c.Database.Password, "db-pass", c.Database.Password, "Database password")
+	fs.StringVar(&c.Database.Name, "db-name", c.Database.Name, "Database name")
+	fs.StringVar(&c.Database.Path, "db-path", c.Database.Path, "SQLite database file, with --db-driver=sqlite")
+
+	fs.StringVar(&c.Auth.SecretKey, "secret-key", c.Auth.SecretKey, "Shared key for ingest and admin requests, prefer APP_SECRET_KEY or the config file")
+	fs.StringVar(&c.Auth.SigningKey, "signing-key", c.Auth.SigningKey, "Key the signing secrets of device keys are derived with, defaults to the secret key")
+	fs.BoolVar(&c.Auth.RejectSharedKey, "reject-shared-key", c.Auth.RejectSharedKey, "Only accept per-device keys on ingest")
+	fs.Var(&c.Auth.HmacSkew, "hmac-skew", "Maximum clock skew accepted for signed ingest requests")
+
+	fs.Var(&c.CORS.AllowedOrigins, "cors-origins", "Comma separated origins allowed to make cross-origin requests, * allows any")
+
+	fs.StringVar(&c.MQTT.Broker, "mqtt-broker", c.MQTT.Broker, "MQTT broker URL, e.g. tcp://localhost:1883 (disabled if empty)")
+	fs.StringVar(&c.MQTT.Topic, "mqtt-topic", c.MQTT.Topic, "MQTT topic to subscribe to, the + level is the device id")
+	fs.StringVar(&c.MQTT.ClientId, "mqtt-client-id", c.MQTT.ClientId, "MQTT client id")
+	fs.StringVar(&c.MQTT.Username, "mqtt-user", c.MQTT.Username, "MQTT username")
+	fs.StringVar(&c.MQTT.Password, "mqtt-pass", c.MQTT.Password, "MQTT password")
+
+	fs.Var(&c.RateLimit.IP, "rate-limit-ip", "Ingest requests allowed per client IP on each route, e.g. 100/m (0 is no limit)")
+	fs.Var(&c.RateLimit.Device, "rate-limit-device", "Ingest requests allowed per device on each route, e.g. 10/m (0 is no limit)")
+	fs.IntVar(&c.RateLimit.MaxKeys, "rate-limit-max-keys", c.RateLimit.MaxKeys, "Most clients and devices tracked by the rate limiter, the least recent are forgotten")
+	fs.Var(&c.RateLimit.IdleTimeout, "rate-limit-idle-timeout", "How long an idle client or device is tracked by the rate limiter")
+
+	fs.StringVar(&c.Validation.Mode, "validation-mode", c.Validation.Mode, "What to do with readings outside the valid ranges, reject or flag to store them as suspect")
+	for _, m := range []struct {
+		name, desc string
+		limits     *metricLimits
+	}{
+		{"temp-co", "boiler temperature", &c.Validation.TempCo},
+		{"temp-room", "room temperature", &c.Validation.TempRoom},
+		{"humidity", "humidity", &c.Validation.Humidity},
+	} {
+		fs.Float64Var(&m.limits.Min, m.name+"-min", m.limits.Min, "Lowest valid "+m.desc)
+		fs.Float64Var(&m.limits.Max, m.name+"-max", m.limits.Max, "Highest valid "+m.desc)
+		fs.Var(&m.limits.Faults, m.name+"-faults", "Comma separated "+m.desc+" values the sensor reports on a fault")
+	}
+
+	fs.Var(&c.Retention.Keep, "retention", "How long readings are kept, e.g. 90d or 720h (0 keeps them forever)")
+	fs.Var(&c.Retention.Devices, "retention-devices", "Per-device retention overrides, e.g. esp-a=30d,esp-b=0")
+	fs.Var(&c.Retention.Interval, "retention-interval", "How often the retention policy is enforced")
+	fs.IntVar(&c.Retention.BatchSize, "retention-batch-size", c.Retention.BatchSize, "Readings deleted per batch when pruning")
+	fs.BoolVar(&c.Retention.DryRun, "retention-dry-run", c.Retention.DryRun, "Only report what the retention policy would delete")
+
+	fs.Var(&c.Alerting.WebhookTimeout, "webhook-timeout", "Timeout of a webhook delivery")
+	fs.IntVar(&c.Alerting.WebhookMaxAttempts, "webhook-max-attempts", c.Alerting.WebhookMaxAttempts, "Delivery attempts before a webhook delivery is given up")
+	fs.Var(&c.Alerting.WebhookBackoffBase, "webhook-backoff-base", "Delay before the first webhook retry, doubled on each attempt")
+	fs.Var(&c.Alerting.WebhookBackoffMax, "webhook-backoff-max", "Longest delay between webhook retries")
+	fs.Var(&c.Alerting.WebhookPollInterval, "webhook-poll-interval", "How often due webhook deliveries are looked for")
+	fs.Var(&c.Alerting.OfflineAfter, "offline-after", "How long a device may send no reading before device.offline is sent (0 never sends it)")
+	return fs
+}
+
+// envName is the env variable of a flag, e.g. APP_DB_HOST for db-host
+func envName(flagName string) string {
+	return "APP_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig layers defaults, the config file, env variables and flags.
+// Only a malformed command line returns early, every other problem is
+// collected into the returned error along with the validation errors. The
+// remaining arguments are the command to run, if any.
+func loadConfig(args []string, getenv func(string) string) (*config, []string, error) {
+	// the first pass only finds the config file and checks the flags parse
+	var path string
+	first := defaultConfig().flagSet(&path)
+	if err := first.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if path == "" {
+		path = getenv("APP_CONFIG")
+	}
+
+	var errs []error
+	c := defaultConfig()
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: %w", path, err))
+		}
+	}
+
+	fs := c.flagSet(&path)
+	fs.SetOutput(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envName(f.Name)
+		value := getenv(env)
+		if f.Name == "config" || value == "" {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			// a failed Set may have left a zero value behind
+			f.Value.Set(f.DefValue)
+			errs = append(errs, fmt.Errorf("env %s: invalid value %q", env, value))
+			return
+		}
+		if slices.Contains(secretFlags, f.Name) {
+			value = "***"
+		}
+		c.overrides = append(c.overrides, envOverride{flag: f.Name, env: env, value: value})
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	errs = append(errs, c.validate()...)
+	return c, fs.Args(), errors.Join(errs...)
+}
+
+func (c *config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// validate returns every problem with the config, each naming the setting
+// by its config file key
+func (c *config) validate() []error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	validPort := func(port int) bool { return port > 0 && port <= 65535 }
+
+	if c.Server.Host == "" {
+		fail("server.host", "is required")
+	}
+	if !validPort(c.Server.Port) {
+		fail("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if _, err := time.LoadLocation(c.Server.Timezone); err != nil {
+		fail("server.timezone", "unknown timezone %q", c.Server.Timezone)
+	}
+	if c.Server.MaxBatchSize <= 0 {
+		fail("server.max_batch_size", "must be positive")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		fail("server.shutdown_timeout", "must be positive")
+	}
+	if c.Server.ShutdownDelay < 0 {
+		fail("server.shutdown_delay", "must not be negative")
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		fail("tls", "cert and key must be set together")
+	}
+	for _, file := range []struct{ key, path string }{
+		{"tls.cert", c.TLS.Cert},
+		{"tls.key", c.TLS.Key},
+		{"tls.client_ca", c.TLS.ClientCA},
+	} {
+		if _, err := os.Stat(file.path); file.path != "" && err != nil {
+			fail(file.key, "%v", err)
+		}
+	}
+	if c.TLS.Cert == "" && (c.TLS.ClientCA != "" || c.TLS.RedirectAddr != "") {
+		fail("tls", "client_ca and redirect_addr need cert and key")
+	}
+	if c.TLS.ClientAuth != clientAuthOptional && c.TLS.ClientAuth != clientAuthRequire {
+		fail("tls.client_auth", "must be optional or require, got %q", c.TLS.ClientAuth)
+	}
+	if c.TLS.ClientAuth == clientAuthRequire && c.TLS.ClientCA == "" {
+		fail("tls.client_auth", "require needs tls.client_ca")
+	}
+	if c.TLS.RedirectAddr != "" {
+		if _, _, err := net.SplitHostPort(c.TLS.RedirectAddr); err != nil {
+			fail("tls.redirect_addr", "invalid address %q", c.TLS.RedirectAddr)
+		}
+	}
+
+	switch c.Database.Driver {
+	case "postgres":
+		if c.Database.Host == "" {
+			fail("database.host", "is required with the postgres driver")
+		}
+		if !validPort(c.Database.Port) {
+			fail("database.port", "must be between 1 and 65535, got %d", c.Database.Port)
+		}
+		if c.Database.User == "" {
+			fail("database.user", "is required with the postgres driver")
+		}
+		if c.Database.Name == "" {
+			fail("database.name", "is required with the postgres driver")
+		}
+	case "sqlite":
+		if c.Database.Path == "" {
+			fail("database.path", "is required with the sqlite driver")
+		}
+	case "memory":
+	default:
+		fail("database.driver", "must be postgres, sqlite or memory, got %q", c.Database.Driver)
+	}
+
+	if c.Auth.HmacSkew <= 0 {
+		fail("auth.hmac_skew", "must be positive")
+	}
+
+	if len(c.CORS.AllowedOrigins) == 0 {
+		fail("cors.allowed_origins", "must not be empty, use * to allow any origin")
+	}
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			fail("cors.allowed_origins", "invalid origin %q, expected scheme://host[:port]", origin)
+		}
+	}
+
+	if c.MQTT.Broker != "" {
+		if _, err := url.Parse(c.MQTT.Broker); err != nil {
+			fail("mqtt.broker", "invalid URL %q", c.MQTT.Broker)
+		}
+		if !slices.Contains(strings.Split(c.MQTT.Topic, "/"), "+") {
+			fail("mqtt.topic", "must have a + level for the device id, got %q", c.MQTT.Topic)
+		}
+	}
+
+	longest := max(c.RateLimit.IP.period, c.RateLimit.Device.period)
+	for _, route := range slices.Sorted(maps.Keys(c.RateLimit.Routes)) {
+		if !slices.Contains(rateLimitedRoutes, route) {
+			fail("rate_limit.routes", "unknown route %q, expected one of %s", route, strings.Join(rateLimitedRoutes, ", "))
+		}
+		for _, l := range []*rateLimit{c.RateLimit.Routes[route].IP, c.RateLimit.Routes[route].Device} {
+			if l != nil {
+				longest = max(longest, l.period)
+			}
+		}
+	}
+	if c.RateLimit.MaxKeys <= 0 {
+		fail("rate_limit.max_keys", "must be positive")
+	}
+	// an evicted bucket starts over full
+	if time.Duration(c.RateLimit.IdleTimeout) < longest {
+		fail("rate_limit.idle_timeout", "must be at least the longest limit period, %s", longest)
+	}
+
+	if c.Validation.Mode != validationReject && c.Validation.Mode != validationFlag {
+		fail("validation.mode", "must be reject or flag, got %q", c.Validation.Mode)
+	}
+	for _, m := range []struct {
+		key    string
+		limits metricLimits
+	}{
+		{"validation.temp_co", c.Validation.TempCo},
+		{"validation.temp_room", c.Validation.TempRoom},
+		{"validation.humidity", c.Validation.Humidity},
+	} {
+		if !(m.limits.Min < m.limits.Max) {
+			fail(m.key, "min must be less than max, got %g and %g", m.limits.Min, m.limits.Max)
+		}
+	}
+
+	for _, device := range slices.Sorted(maps.Keys(c.Retention.Devices)) {
+		if !validDeviceId(device) {
+			fail("retention.devices", "invalid device id %q", device)
+		}
+	}
+	if c.Retention.Interval <= 0 {
+		fail("retention.interval", "must be positive")
+	}
+	if c.Retention.BatchSize <= 0 {
+		fail("retention.batch_size", "must be positive")
+	}
+
+	if c.Alerting.WebhookTimeout <= 0 {
+		fail("alerting.webhook_timeout", "must be positive")
+	}
+	if c.Alerting.WebhookMaxAttempts <= 0 {
+		fail("alerting.webhook_max_attempts", "must be positive")
+	}
+	if c.Alerting.WebhookBackoffBase <= 0 {
+		fail("alerting.webhook_backoff_base", "must be positive")
+	}
+	if c.Alerting.WebhookBackoffMax < c.Alerting.WebhookBackoffBase {
+		fail("alerting.webhook_backoff_max", "must not be less than webhook_backoff_base")
+	}
+	if c.Alerting.WebhookPollInterval <= 0 {
+		fail("alerting.webhook_poll_interval", "must be positive")
+	}
+	if c.Alerting.OfflineAfter < 0 {
+		fail("alerting.offline_after", "must not be negative")
+	}
+	return errs
+}
+
+func (c *config) logOverrides(logger *slog.Logger) {
+	for _, o := range c.overrides {
+		logger.Debug(fmt.Sprintf("flag %s overridden by env %s", o.flag, o.env), "value", o.value)
+	}
+}
+
+// redacted is a copy of c safe to print
+func (c *config) redacted() *config {
+	r := *c
+	for _, secret := range []*string{&r.Database.Password, &r.Auth.SecretKey, &r.Auth.SigningKey, &r.MQTT.Password} {
+		if *secret != "" {
+			*secret = "***"
+		}
+	}
+	return &r
+}
+
+func (c *config) retentionPolicy() retentionPolicy {
+	return retentionPolicy{
+		Default:   time.Duration(c.Retention.Keep),
+		Devices:   c.Retention.Devices.durations(),
+		Interval:  time.Duration(c.Retention.Interval),
+		BatchSize: c.Retention.BatchSize,
+		DryRun:    c.Retention.DryRun,
+	}
+}
+
+func (c *config) readingValidation() *readingValidation {
+	return &readingValidation{
+		mode:     c.Validation.Mode,
+		tempCo:   c.Validation.TempCo,
+		tempRoom: c.Validation.TempRoom,
+		humidity: c.Validation.Humidity,
+	}
+}
+
+// rateLimits is nil when nothing is limited
+func (c *config) rateLimits() *rateLimits {
+	enabled := c.RateLimit.IP.enabled() || c.RateLimit.Device.enabled()
+	for _, route := range c.RateLimit.Routes {
+		enabled = enabled || (route.IP != nil && route.IP.enabled()) || (route.Device != nil && route.Device.enabled())
+	}
+	if !enabled {
+		return nil
+	}
+	return &rateLimits{
+		ip:      c.RateLimit.IP,
+		device:  c.RateLimit.Device,
+		routes:  c.RateLimit.Routes,
+		buckets: newBucketStore(c.RateLimit.MaxKeys, time.Duration(c.RateLimit.IdleTimeout)),
+	}
+}
+
+func (c *config) webhookSettings() webhookSettings {
+	return webhookSettings{
+		timeout:      time.Duration(c.Alerting.WebhookTimeout),
+		maxAttempts:  c.Alerting.WebhookMaxAttempts,
+		backoffBase:  time.Duration(c.Alerting.WebhookBackoffBase),
+		backoffMax:   time.Duration(c.Alerting.WebhookBackoffMax),
+		pollInterval: time.Duration(c.Alerting.WebhookPollInterval),
+		// 0 in the config turns offline detection off
+		offlineAfter: cmp.Or(time.Duration(c.Alerting.OfflineAfter), -1),
+	}
+}
+
+// configCommand prints the effective config as YAML with secrets redacted,
+// followed by anything invalid about it
+func configCommand(c *config, invalid error, args []string, w io.Writer) error {
+	if len(args) != 1 || args[0] != "print" {
+		return fmt.Errorf("usage: config print")
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.redacted()); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return invalid
+}
+
+// duration is a time.Duration written like 30s in the config file
+type duration time.Duration
+
+func (d duration) String() string { return time.Duration(d).String() }
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalYAML() (any, error) { return d.String(), nil }
+
+func (d *duration) UnmarshalYAML(n *yaml.Node) error { return d.Set(n.Value) }
+
+// retention is a duration that may also be given in days, like 90d
+type retention time.Duration
+
+func (r retention) String() string {
+	d := time.Duration(r)
+	if d == 0 {
+		return "0"
+	}
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+func (r *retention) Set(s string) error {
+	d, err := parseRetention(s)
+	if err != nil {
+		return err
+	}
+	*r = retention(d)
+	return nil
+}
+
+func (r retention) MarshalYAML() (any, error) { return r.String(), nil }
+
+func (r *retention) UnmarshalYAML(n *yaml.Node) error { return r.Set(n.Value) }
+
+// deviceRetentions are per-device retention overrides, a map in the config
+// file and device=retention pairs separated by commas as a flag
+type deviceRetentions map[string]retention
+
+func (m deviceRetentions) String() string {
+	pairs := make([]string, 0, len(m))
+	for _, device := range slices.Sorted(maps.Keys(m)) {
+		pairs = append(pairs, device+"="+m[device].String())
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *deviceRetentions) Set(s string) error {
+	devices, err := parseDeviceRetention(s)
+	if err != nil {
+		return err
+	}
+	*m = deviceRetentions{}
+	for device, d := range devices {
+		(*m)[device] = retention(d)
+	}
+	return nil
+}
+
+func (m deviceRetentions) durations() map[string]time.Duration {
+	devices := make(map[string]time.Duration, len(m))
+	for device, r := range m {
+		devices[device] = time.Duration(r)
+	}
+	return devices
+}
+
+// stringList is a list in the config file and comma separated as a flag
+type stringList []string
+
+func (l stringList) String() string { return strings.Join(l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func envMap(env map[string]string) func(string) string {
+	return func(k string) string { return env[k] }
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  host: 0.0.0.0
+  port: 9090
+database:
+  user: file-user
+retention:
+  keep: 90d
+  devices:
+    esp-a: 30d
+`)
+	env := envMap(map[string]string{
+		"APP_CONFIG":    path,
+		"APP_PORT":      "7070",
+		"APP_DB_USER":   "env-user",
+		"APP_DB_PASS":   "hunter2",
+		"APP_HMAC_SKEW": "1m",
+	})
+	cfg, args, err := loadConfig([]string{"--port", "6060", "migrate", "up"}, env)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"migrate", "up"}, args)
+
+	assert.Equal(t, 6060, cfg.Server.Port)         // flag
+	assert.Equal(t, "env-user", cfg.Database.User) // env
+	assert.Equal(t, "0.0.0.0", cfg.Server.Host)    // file
+	assert.Equal(t, "dbname", cfg.Database.Name)   // default
+	assert.Equal(t, time.Minute, time.Duration(cfg.Auth.HmacSkew))
+	policy := cfg.retentionPolicy()
+	assert.Equal(t, 90*24*time.Hour, policy.Default)
+	assert.Equal(t, map[string]time.Duration{"esp-a": 30 * 24 * time.Hour}, policy.Devices)
+
+	// env overrides are kept to be logged, secrets redacted
+	assert.Contains(t, cfg.overrides, envOverride{flag: "db-pass", env: "APP_DB_PASS", value: "***"})
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: 70000
+database:
+  driver: mysql
+cors:
+  allowed_origins: [https://dash.example.com/app]
+mqtt:
+  broker: tcp://localhost:1883
+  topic: esp/readings
+rate_limit:
+  idle_timeout: 1m
+  routes:
+    /nope:
+      ip: 10/h
+validation:
+  mode: drop
+  humidity:
+    min: 100
+    max: 0
+`)
+	env := envMap(map[string]string{"APP_RETENTION_BATCH_SIZE": "many"})
+	cfg, _, err := loadConfig([]string{"--config", path, "--timezone", "Mars/Olympus", "--tls-cert", "missing.crt", "--tls-client-auth", "require"}, env)
+	require.NotNil(t, cfg)
+	require.Error(t, err)
+
+	// every problem is reported at once
+	for _, want := range []string{
+		`env APP_RETENTION_BATCH_SIZE: invalid value "many"`,
+		"server.port: must be between 1 and 65535, got 70000",
+		`server.timezone: unknown timezone "Mars/Olympus"`,
+		`database.driver: must be postgres, sqlite or memory, got "mysql"`,
+		`cors.allowed_origins: invalid origin "https://dash.example.com/app"`,
+		`mqtt.topic: must have a + level for the device id, got "esp/readings"`,
+		`rate_limit.routes: unknown route "/nope"`,
+		"rate_limit.idle_timeout: must be at least the longest limit period, 1h0m0s",
+		`validation.mode: must be reject or flag, got "drop"`,
+		"validation.humidity: min must be less than max, got 100 and 0",
+		"tls: cert and key must be set together",
+		"tls.cert: stat missing.crt",
+		"tls.client_auth: require needs tls.client_ca",
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+	// a bad env value leaves the lower layer in place
+	assert.Equal(t, defaultRetentionBatchSize, cfg.Retention.BatchSize)
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	path := writeConfigFile(t, "server:\n  hots: 0.0.0.0\n")
+	_, _, err := loadConfig([]string{"--config", path}, envMap(nil))
+	assert.ErrorContains(t, err, "field hots not found")
+
+	_, _, err = loadConfig([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}, envMap(nil))
+	assert.ErrorContains(t, err, "missing.yaml")
+
+	_, _, err = loadConfig([]string{"--no-such-flag"}, envMap(nil))
+	assert.ErrorContains(t, err, "no-such-flag")
+}
+
+func TestConfigCommand(t *testing.T) {
+	env := envMap(map[string]string{"APP_SECRET_KEY": "s3cret", "APP_MQTT_PASS": "mqttpass"})
+	cfg, _, err := loadConfig([]string{"--retention", "720h", "--retention-devices", "esp-b=0,esp-a=7d"}, env)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, configCommand(cfg, nil, []string{"print"}, &out))
+	assert.NotContains(t, out.String(), "s3cret")
+	assert.NotContains(t, out.String(), "mqttpass")
+
+	// the output is a valid config file
+	printed := defaultConfig()
+	require.NoError(t, yaml.Unmarshal(out.Bytes(), printed))
+	assert.Equal(t, "***", printed.Auth.SecretKey)
+	assert.Equal(t, "", printed.Database.Password)
+	assert.Equal(t, "30d", printed.Retention.Keep.String())
+	assert.Equal(t, "esp-a=7d,esp-b=0", printed.Retention.Devices.String())
+	assert.Equal(t, cfg.Retention.Interval, printed.Retention.Interval)
+
+	assert.Error(t, configCommand(cfg, nil, nil, &out))
+}
+
+func TestCorsMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		origins []string
+		origin  string
+		want    string
+	}{
+		{[]string{"*"}, "https://a.example.com", "*"},
+		{[]string{"https://a.example.com"}, "https://a.example.com", "https://a.example.com"},
+		{[]string{"https://a.example.com"}, "https://b.example.com", ""},
+		{[]string{"https://a.example.com"}, "", ""},
+	}
+	for _, tt := range tests {
+		app := &app{corsOrigins: tt.origins}
+		req := httptest.NewRequest("GET", "/data", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		app.corsMiddleware(next).ServeHTTP(w, req)
+		assert.Equal(t, tt.want, w.Header().Get("Access-Control-Allow-Origin"), tt)
+		assert.Equal(t, tt.origin == "" || tt.want != "", app.originAllowed(req), tt)
+	}
+}
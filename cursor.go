@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Cursor directions, from the page the cursor was issued with
+const (
+	cursorNext = "n" // older readings
+	cursorPrev = "p" // newer readings
+)
+
+// pageCursor is the position a GET /data page continues from. Clients get it
+// as an opaque token and hand it back in ?cursor.
+type pageCursor struct {
+	dir string
+	key readingKey
+}
+
+func (c pageCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%s:%d:%d", c.dir, c.key.Timestamp, c.key.Id))
+}
+
+func parsePageCursor(s string) (pageCursor, error) {
+	invalid := fmt.Errorf("invalid cursor %q", s)
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, invalid
+	}
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 3 || (parts[0] != cursorNext && parts[0] != cursorPrev) {
+		return pageCursor{}, invalid
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return pageCursor{}, invalid
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return pageCursor{}, invalid
+	}
+	return pageCursor{dir: parts[0], key: readingKey{Timestamp: ts, Id: id}}, nil
+}
+
+// query moves q to the page c points at, one reading beyond limit tells
+// whether there is a page after it
+func (c pageCursor) query(q ReadingQuery, limit int) ReadingQuery {
+	q.Limit = limit + 1
+	if c.dir == cursorPrev {
+		// the readings just newer than the key, reversed by the caller
+		q.After = &c.key
+		q.Order = orderOldestFirst
+	} else {
+		q.Before = &c.key
+	}
+	return q
+}
+
+// setPageLinks adds the cursors of the pages around readings, newest first,
+// as a Link header and as X-Next-Cursor and X-Prev-Cursor. The links keep
+// the request's filters and limit.
+func setPageLinks(w http.ResponseWriter, r *http.Request, readings []TemperatureReading, hasNext, hasPrev bool) {
+	if len(readings) == 0 {
+		return
+	}
+	var links []string
+	link := func(c pageCursor, rel, header string) {
+		query := r.URL.Query()
+		query.Del("offset")
+		query.Set("cursor", c.String())
+		u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel))
+		w.Header().Set(header, c.String())
+	}
+	if hasNext {
+		link(pageCursor{dir: cursorNext, key: keyOf(readings[len(readings)-1])}, "next", "X-Next-Cursor")
+	}
+	if hasPrev {
+		link(pageCursor{dir: cursorPrev, key: keyOf(readings[0])}, "prev", "X-Prev-Cursor")
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
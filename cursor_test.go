@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageCursor(t *testing.T) {
+	c := pageCursor{dir: cursorPrev, key: readingKey{Timestamp: 1761388101, Id: 42}}
+	parsed, err := parsePageCursor(c.String())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	for _, s := range []string{"", "!!", "eDoxOjI", c.String() + "x"} {
+		_, err := parsePageCursor(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// testDataHandlerCursor pages through GET /data with cursors while readings
+// keep arriving
+func testDataHandlerCursor(t *testing.T, app *app) {
+	ctx := context.Background()
+	insert := func(ts int64) {
+		_, err := app.readings.InsertReading(ctx, TemperatureReadingPayload{DeviceId: "esp-a", TempCo: float64(ts), Timestamp: &ts})
+		require.NoError(t, err)
+	}
+	// two readings share each timestamp, the id orders them
+	for _, ts := range []int64{100, 100, 200, 200, 300, 300, 400} {
+		insert(ts)
+	}
+
+	type page struct {
+		ids        []int
+		next, prev string
+	}
+	get := func(query string) page {
+		t.Helper()
+		w := httptest.NewRecorder()
+		app.dataHandler(w, httptest.NewRequest("GET", "/data?device=esp-a&limit=3"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code, query)
+		var readings []TemperatureReading
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&readings))
+		p := page{next: w.Header().Get("X-Next-Cursor"), prev: w.Header().Get("X-Prev-Cursor")}
+		for _, tr := range readings {
+			p.ids = append(p.ids, tr.Id)
+		}
+		return p
+	}
+
+	first := get("")
+	assert.Empty(t, first.prev)
+	require.NotEmpty(t, first.next)
+
+	// a new reading doesn't shift the pages after the first
+	insert(500)
+	second := get("&cursor=" + first.next)
+	third := get("&cursor=" + second.next)
+	assert.Empty(t, third.next)
+	assert.Len(t, third.ids, 1)
+
+	all, err := app.readings.QueryReadings(ctx, ReadingQuery{Device: "esp-a", Order: orderNewestFirst})
+	require.NoError(t, err)
+	var want []int
+	for _, tr := range all[1:] {
+		want = append(want, tr.Id)
+	}
+	assert.Equal(t, want, append(append(first.ids, second.ids...), third.ids...))
+
+	// going back returns the same pages, the new reading showing up first
+	back := get("&cursor=" + third.prev)
+	assert.Equal(t, second, back)
+	back = get("&cursor=" + back.prev)
+	assert.Equal(t, first.ids, back.ids)
+	require.NotEmpty(t, back.prev)
+	newest := get("&cursor=" + back.prev)
+	assert.Equal(t, []int{all[0].Id}, newest.ids)
+	assert.Empty(t, newest.prev)
+
+	// offset pages get cursors too
+	offset := get("&offset=3")
+	assert.Equal(t, first.ids[2:], offset.ids[:1])
+	assert.NotEmpty(t, offset.prev)
+	assert.NotEmpty(t, offset.next)
+
+	for _, query := range []string{"&cursor=nope", "&offset=3&cursor=" + first.next} {
+		w := httptest.NewRecorder()
+		app.dataHandler(w, httptest.NewRequest("GET", "/data?"+query, nil))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, query)
+		assert.Equal(t, problemTypeBase+"invalid-parameter", decodeProblem(t, w).Type, query)
+	}
+}
+
+func TestDataHandlerCursorMemory(t *testing.T) {
+	testDataHandlerCursor(t, &app{readings: newMemoryReadingStore()})
+}
+
+func TestDataHandlerCursorSQLite(t *testing.T) {
+	testDataHandlerCursor(t, setupTestSQLiteApp(t))
+}
+
+func TestDataHandlerLinkHeader(t *testing.T) {
+	app := &app{readings: newMemoryReadingStore()}
+	for ts := range int64(4) {
+		_, err := app.readings.InsertReading(context.Background(), TemperatureReadingPayload{DeviceId: "esp-a", Timestamp: &ts})
+		require.NoError(t, err)
+	}
+	w := httptest.NewRecorder()
+	app.dataHandler(w, httptest.NewRequest("GET", "/data?device=esp-a&limit=2&offset=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	next, prev := w.Header().Get("X-Next-Cursor"), w.Header().Get("X-Prev-Cursor")
+	assert.Equal(t, `</data?cursor=`+next+`&device=esp-a&limit=2>; rel="next", </data?cursor=`+prev+`&device=esp-a&limit=2>; rel="prev"`, w.Header().Get("Link"))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const defaultDeviceId = "default"
+
+var deviceIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var errInvalidDeviceId = errors.New("invalid device id")
+
+type Device struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Location   string `json:"location"`
+	CreatedAt  int64  `json:"createdAt"`
+	LastSeenAt *int64 `json:"lastSeenAt"`
+}
+
+type DevicePayload struct {
+	Id       string  `json:"id"`
+	Name     *string `json:"name"`
+	Location *string `json:"location"`
+}
+
+// deviceIdRule describes a valid device id to clients
+const deviceIdRule = "must be 1 to 64 letters, digits, _ or -"
+
+func validDeviceId(id string) bool {
+	return deviceIdPattern.MatchString(id)
+}
+
+// isAdmin reports whether the request carries the server secret key
+func (a *app) isAdmin(r *http.Request) bool {
+	key := r.Header.Get("X-Secret-Key")
+	return key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(a.secretKey)) == 1
+}
+
+func (a *app) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(r.Context(), `
+			SELECT id, name, location, created_at, last_seen_at
+			FROM devices
+			ORDER BY id`)
+		if err != nil {
+			logger.Error("Failed to query devices", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		devices, err := pgx.CollectRows(rows, scanDevice)
+		if err != nil {
+			logger.Error("Failed to scan devices", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		if devices == nil {
+			devices = make([]Device, 0)
+		}
+		json.NewEncoder(w).Encode(devices)
+
+	case http.MethodPost:
+		if !a.isAdmin(r) {
+			writeProblem(w, problemForbidden, "")
+			return
+		}
+		var dp DevicePayload
+		if err := json.NewDecoder(r.Body).Decode(&dp); err != nil {
+			logger.Error("failed to decode device", slog.Any("error", err))
+			writeProblem(w, problemInvalidJSON, err.Error())
+			return
+		}
+		if !validDeviceId(dp.Id) {
+			writeProblem(w, problemInvalidDeviceId, "", fieldError{"id", deviceIdRule})
+			return
+		}
+		var name, location string
+		if dp.Name != nil {
+			name = *dp.Name
+		}
+		if dp.Location != nil {
+			location = *dp.Location
+		}
+		rows, err := a.db.Query(r.Context(), `
+			INSERT INTO devices (id, name, location, created_at)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, name, location, created_at, last_seen_at
+		`, dp.Id, name, location, time.Now().UTC().Unix())
+		if err != nil {
+			logger.Error("Failed to insert device", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		d, err := pgx.CollectExactlyOneRow(rows, scanDevice)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+				writeProblem(w, problemDeviceExists, "")
+				return
+			}
+			logger.Error("Failed to insert device", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(d)
+
+	default:
+		writeProblem(w, problemMethodNotAllowed, "")
+	}
+}
+
+func (a *app) deviceHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(r.Context(), `
+			SELECT id, name, location, created_at, last_seen_at
+			FROM devices
+			WHERE id = $1`, id)
+		if err != nil {
+			logger.Error("Failed to query device", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		d, err := pgx.CollectExactlyOneRow(rows, scanDevice)
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeProblem(w, problemNotFound, "")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to scan device", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		json.NewEncoder(w).Encode(d)
+
+	case http.MethodPatch:
+		if !a.isAdmin(r) {
+			writeProblem(w, problemForbidden, "")
+			return
+		}
+		var dp DevicePayload
+		if err := json.NewDecoder(r.Body).Decode(&dp); err != nil {
+			logger.Error("failed to decode device", slog.Any("error", err))
+			writeProblem(w, problemInvalidJSON, err.Error())
+			return
+		}
+		rows, err := a.db.Query(r.Context(), `
+			UPDATE devices
+			SET name = COALESCE($2, name), location = COALESCE($3, location)
+			WHERE id = $1
+			RETURNING id, name, location, created_at, last_seen_at
+		`, id, dp.Name, dp.Location)
+		if err != nil {
+			logger.Error("Failed to update device", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		d, err := pgx.CollectExactlyOneRow(rows, scanDevice)
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeProblem(w, problemNotFound, "")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to update device", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		json.NewEncoder(w).Encode(d)
+
+	case http.MethodDelete:
+		if !a.isAdmin(r) {
+			writeProblem(w, problemForbidden, "")
+			return
+		}
+		if id == defaultDeviceId {
+			writeProblem(w, problemDefaultDevice, "")
+			return
+		}
+		tag, err := a.db.Exec(r.Context(), `DELETE FROM devices WHERE id = $1`, id)
+		if err != nil {
+			// Devices that still own readings are kept so history is never orphaned
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+				writeProblem(w, problemDeviceHasReadings, "delete or prune its readings first")
+				return
+			}
+			logger.Error("Failed to delete device", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeProblem(w, problemNotFound, "")
+			return
+		}
+		forgetDeviceMetrics(id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeProblem(w, problemMethodNotAllowed, "")
+	}
+}
+
+func scanDevice(row pgx.CollectableRow) (Device, error) {
+	var d Device
+	err := row.Scan(&d.Id, &d.Name, &d.Location, &d.CreatedAt, &d.LastSeenAt)
+	return d, err
+}
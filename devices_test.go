@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidDeviceId(t *testing.T) {
+	assert.True(t, validDeviceId("default"))
+	assert.True(t, validDeviceId("esp-kitchen_01"))
+	assert.False(t, validDeviceId(""))
+	assert.False(t, validDeviceId("esp/kitchen"))
+	assert.False(t, validDeviceId("has space"))
+}
+
+func TestApplyMigrationsDefaultDevice(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "dummy"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	var deviceId string
+	_, err := db.Exec(context.Background(), "INSERT INTO readings (temp_co, temp_room, humidity, timestamp) VALUES (1, 2, 3, 4)")
+	require.NoError(t, err)
+	err = db.QueryRow(context.Background(), "SELECT device_id FROM readings").Scan(&deviceId)
+	require.NoError(t, err)
+	assert.Equal(t, defaultDeviceId, deviceId)
+
+	// running again must be a no-op
+	assert.NoError(t, app.applyMigrations(context.Background()))
+}
+
+func TestDataHandlerPOSTWithDevice(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	body := `{"deviceId": "esp-kitchen", "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0, "timestamp": 1761388101}`
+	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+
+	app.dataHandler(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "esp-kitchen", resp.DeviceId)
+
+	var lastSeen *int64
+	err := db.QueryRow(context.Background(), "SELECT last_seen_at FROM devices WHERE id = 'esp-kitchen'").Scan(&lastSeen)
+	require.NoError(t, err)
+	assert.NotNil(t, lastSeen)
+}
+
+func TestDataHandlerPOSTInvalidDevice(t *testing.T) {
+	app := &app{secretKey: "testsecret"}
+
+	body := `{"deviceId": "esp/kitchen", "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`
+	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+
+	app.dataHandler(w, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestDataHandlerGETWithDeviceFilter(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "dummy"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	_, err := db.Exec(context.Background(), "INSERT INTO devices (id, name) VALUES ('esp-a', 'A'), ('esp-b', 'B')")
+	require.NoError(t, err)
+	_, err = db.Exec(context.Background(), `
+		INSERT INTO readings (device_id, temp_co, temp_room, humidity, timestamp)
+		VALUES ('esp-a', 1, 1, 1, 1), ('esp-a', 2, 2, 2, 2), ('esp-b', 3, 3, 3, 3)`)
+	require.NoError(t, err)
+
+	tests := []struct {
+		queryURL  string
+		expectLen int
+	}{
+		{"/data", 3},
+		{"/data?device=esp-a", 2},
+		{"/data?device=esp-b", 1},
+		{"/data?device=unknown", 0},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.queryURL, nil)
+		w := httptest.NewRecorder()
+
+		app.dataHandler(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp []TemperatureReading
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, tt.expectLen, len(resp), "unexpected response length for query: %s", tt.queryURL)
+	}
+}
+
+func TestDevicesHandler(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	// create
+	req := httptest.NewRequest("POST", "/devices", bytes.NewReader([]byte(`{"id": "esp-attic", "name": "Attic"}`)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	app.devicesHandler(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	// duplicate
+	req = httptest.NewRequest("POST", "/devices", bytes.NewReader([]byte(`{"id": "esp-attic"}`)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	app.devicesHandler(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// list
+	req = httptest.NewRequest("GET", "/devices", nil)
+	w = httptest.NewRecorder()
+	app.devicesHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var devices []Device
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&devices))
+	require.Len(t, devices, 2)
+	assert.Equal(t, defaultDeviceId, devices[0].Id)
+	assert.Equal(t, "esp-attic", devices[1].Id)
+
+	// rename
+	req = httptest.NewRequest("PATCH", "/devices/esp-attic", bytes.NewReader([]byte(`{"name": "Loft", "location": "2nd floor"}`)))
+	req.SetPathValue("id", "esp-attic")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	app.deviceHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var d Device
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&d))
+	assert.Equal(t, "Loft", d.Name)
+	assert.Equal(t, "2nd floor", d.Location)
+
+	// get
+	req = httptest.NewRequest("GET", "/devices/esp-attic", nil)
+	req.SetPathValue("id", "esp-attic")
+	w = httptest.NewRecorder()
+	app.deviceHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// delete
+	req = httptest.NewRequest("DELETE", "/devices/esp-attic", nil)
+	req.SetPathValue("id", "esp-attic")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	app.deviceHandler(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	req = httptest.NewRequest("GET", "/devices/esp-attic", nil)
+	req.SetPathValue("id", "esp-attic")
+	w = httptest.NewRecorder()
+	app.deviceHandler(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDeviceHandlerDeleteWithReadings(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	_, err := db.Exec(context.Background(), "INSERT INTO devices (id) VALUES ('esp-a')")
+	require.NoError(t, err)
+	_, err = db.Exec(context.Background(), "INSERT INTO readings (device_id, temp_co, temp_room, humidity, timestamp) VALUES ('esp-a', 1, 1, 1, 1)")
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("DELETE", "/devices/esp-a", nil)
+	req.SetPathValue("id", "esp-a")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	app.deviceHandler(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestDevicesHandlerForbidden(t *testing.T) {
+	app := &app{secretKey: "testsecret"}
+
+	req := httptest.NewRequest("POST", "/devices", bytes.NewReader([]byte(`{"id": "esp-attic"}`)))
+	req.Header.Set("X-Secret-Key", "wrongkey")
+	w := httptest.NewRecorder()
+	app.devicesHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req = httptest.NewRequest("PATCH", "/devices/default", bytes.NewReader([]byte(`{"name": "x"}`)))
+	req.SetPathValue("id", "default")
+	w = httptest.NewRecorder()
+	app.deviceHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,104 @@
+package main
+
+import "sync"
+
+const (
+	eventReading = "reading"
+
+	subscriptionBuffer = 64
+)
+
+// Event is something that happened in the app that clients can subscribe
+// to. For readings Id is the reading id and Data the TemperatureReading.
+type Event struct {
+	Type     string
+	Id       int64
+	DeviceId string
+	Data     any
+}
+
+type subscription struct {
+	events chan Event
+	filter func(Event) bool
+}
+
+// eventHub fans events out to subscribers without ever blocking the
+// publisher, a subscriber that falls behind is dropped and its channel
+// closed so the client can reconnect and resume.
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[*subscription]struct{}
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*subscription]struct{})}
+}
+
+func (h *eventHub) subscribe(filter func(Event) bool) *subscription {
+	s := &subscription{events: make(chan Event, subscriptionBuffer), filter: filter}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(s.events)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+func (h *eventHub) unsubscribe(s *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.events)
+	}
+}
+
+// publish returns the number of subscribers the event was delivered to. It
+// is safe to call on a nil hub so apps without subscribers don't need one.
+func (h *eventHub) publish(e Event) int {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return 0
+	}
+	delivered := 0
+	for s := range h.subs {
+		if s.filter != nil && !s.filter(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+			delivered++
+		default:
+			delete(h.subs, s)
+			close(s.events)
+		}
+	}
+	return delivered
+}
+
+// close ends every subscription, and any made later, so streaming clients
+// disconnect on shutdown. Events published afterwards are dropped.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		delete(h.subs, s)
+		close(s.events)
+	}
+}
+
+// isClosed tells a subscriber whose channel closed whether it was dropped or
+// the hub shut down
+func (h *eventHub) isClosed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closed
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventHubFilter(t *testing.T) {
+	hub := newEventHub()
+	sub := hub.subscribe(func(e Event) bool { return e.DeviceId == "esp-a" })
+	defer hub.unsubscribe(sub)
+
+	hub.publish(Event{Type: eventReading, Id: 1, DeviceId: "esp-b"})
+	hub.publish(Event{Type: eventReading, Id: 2, DeviceId: "esp-a"})
+
+	e := <-sub.events
+	assert.Equal(t, int64(2), e.Id)
+	assert.Len(t, sub.events, 0)
+}
+
+func TestEventHubDropsSlowSubscriber(t *testing.T) {
+	hub := newEventHub()
+	slow := hub.subscribe(nil)
+	fast := hub.subscribe(nil)
+
+	for i := 0; i <= subscriptionBuffer; i++ {
+		hub.publish(Event{Type: eventReading, Id: int64(i)})
+		<-fast.events
+	}
+
+	// the slow subscriber got a full buffer and was then dropped
+	received := 0
+	for range slow.events {
+		received++
+	}
+	assert.Equal(t, subscriptionBuffer, received)
+
+	// unsubscribing a dropped subscriber is a no-op
+	hub.unsubscribe(slow)
+	hub.unsubscribe(fast)
+	_, ok := <-fast.events
+	assert.False(t, ok)
+}
+
+func TestEventHubPublishNil(t *testing.T) {
+	var hub *eventHub
+	assert.NotPanics(t, func() { hub.publish(Event{Type: eventReading}) })
+}
+
+func TestEventHubClose(t *testing.T) {
+	hub := newEventHub()
+	sub := hub.subscribe(nil)
+	hub.close()
+
+	_, ok := <-sub.events
+	assert.False(t, ok)
+	assert.True(t, hub.isClosed())
+
+	// later subscriptions are closed straight away and publishing is a no-op
+	late := hub.subscribe(nil)
+	assert.Equal(t, 0, hub.publish(Event{Type: eventReading}))
+	_, ok = <-late.events
+	assert.False(t, ok)
+	hub.unsubscribe(late)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// exportFlushRows is how many rows are written between flushes
+const exportFlushRows = 500
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// exportFilename names the download after the device and the time range, e.g.
+// readings-esp-a-20240101-20240131.csv
+func exportFilename(device string, from, to *int64) string {
+	parts := []string{"readings"}
+	if device != "" {
+		parts = append(parts, device)
+	}
+	if from != nil {
+		parts = append(parts, time.Unix(*from, 0).UTC().Format("20060102"))
+	}
+	if to != nil {
+		parts = append(parts, time.Unix(*to, 0).UTC().Format("20060102"))
+	}
+	return strings.Join(parts, "-") + ".csv"
+}
+
+// dataExportHandler streams every matching reading as CSV, oldest first.
+// Unlike GET /data there is no row limit, rows are written as they are read
+// from the database.
+func (a *app) dataExportHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		writeProblem(w, problemMethodNotAllowed, "")
+		return
+	}
+
+	query := r.URL.Query()
+
+	var from *int64
+	if s := query.Get("from"); s != "" {
+		f, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || f < 0 {
+			writeProblem(w, problemInvalidParameter, "", fieldError{"from", "must be a unix timestamp"})
+			return
+		}
+		from = &f
+	}
+	var to *int64
+	if s := query.Get("to"); s != "" {
+		t, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || t < 0 {
+			writeProblem(w, problemInvalidParameter, "", fieldError{"to", "must be a unix timestamp"})
+			return
+		}
+		to = &t
+	}
+	device := query.Get("device")
+
+	formatTimestamp := func(ts int64) string {
+		return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+	}
+	switch query.Get("time") {
+	case "", "rfc3339":
+	case "unix":
+		formatTimestamp = func(ts int64) string { return strconv.FormatInt(ts, 10) }
+	default:
+		writeProblem(w, problemInvalidParameter, "", fieldError{"time", "must be rfc3339 or unix"})
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// Large exports outlive the server write timeout
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename(device, from, to)))
+
+	// the CSV writer flushes on its own once its buffer fills, sent tells
+	// whether the response is already under way
+	sent := &countingWriter{w: w}
+	cw := csv.NewWriter(sent)
+	cw.Write([]string{"id", "device_id", "timestamp", "temp_co", "temp_room", "humidity", "quality"})
+
+	n := 0
+	err := a.readings.EachReading(r.Context(), ReadingQuery{Device: device, From: from, To: to, Order: orderOldestFirst}, func(tr TemperatureReading) error {
+		cw.Write([]string{
+			strconv.Itoa(tr.Id),
+			tr.DeviceId,
+			formatTimestamp(*tr.Timestamp),
+			strconv.FormatFloat(tr.TempCo, 'f', -1, 64),
+			strconv.FormatFloat(tr.TempRoom, 'f', -1, 64),
+			strconv.FormatFloat(tr.Humidity, 'f', -1, 64),
+			tr.Quality,
+		})
+		n++
+		if n%exportFlushRows == 0 {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			rc.Flush()
+		}
+		return nil
+	})
+	if err != nil && sent.n == 0 {
+		// Nothing has been sent yet
+		logger.Error("Failed to query temperature readings", "error", err)
+		w.Header().Del("Content-Disposition")
+		writeProblem(w, problemInternal, "")
+		return
+	}
+	if err != nil {
+		// The response is already partly sent, so a truncated file is all we
+		// can do
+		logger.Error("Failed to export temperature readings", "error", err)
+		return
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		logger.Error("Failed to write export", "error", err)
+		return
+	}
+	logger.Info("Exported temperature readings", slog.Int("rows", n))
+}
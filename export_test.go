@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportFilename(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	to := time.Date(2024, 1, 31, 23, 59, 59, 0, time.UTC).Unix()
+
+	assert.Equal(t, "readings.csv", exportFilename("", nil, nil))
+	assert.Equal(t, "readings-esp-a-20240101-20240131.csv", exportFilename("esp-a", &from, &to))
+	assert.Equal(t, "readings-20240101.csv", exportFilename("", &from, nil))
+}
+
+func TestDataExportHandlerInvalid(t *testing.T) {
+	app := &app{}
+
+	for _, query := range []string{"from=abc", "to=-1", "time=iso"} {
+		req := httptest.NewRequest("GET", "/data/export.csv?"+query, nil)
+		w := httptest.NewRecorder()
+		app.dataExportHandler(w, req)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, query)
+	}
+}
+
+func TestDataExportHandler(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "dummy"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	// more rows than GET /data would ever return
+	baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	_, err := db.Exec(context.Background(), `
+		INSERT INTO readings (temp_co, temp_room, humidity, timestamp)
+		SELECT 20.5, 18, 50, $1 + i * 60 FROM generate_series(0, 1199) AS i
+	`, baseTime)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/data/export.csv", nil)
+	w := httptest.NewRecorder()
+	app.dataExportHandler(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="readings.csv"`, w.Header().Get("Content-Disposition"))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 1201)
+	assert.Equal(t, []string{"id", "device_id", "timestamp", "temp_co", "temp_room", "humidity", "quality"}, records[0])
+	assert.Equal(t, "default", records[1][1])
+	assert.Equal(t, "2024-01-01T00:00:00Z", records[1][2])
+	assert.Equal(t, "20.5", records[1][3])
+	assert.Equal(t, qualityGood, records[1][6])
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/data/export.csv?from=%d&to=%d&time=unix&device=default", baseTime+60, baseTime+120), nil)
+	w = httptest.NewRecorder()
+	app.dataExportHandler(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	records, err = csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, fmt.Sprint(baseTime+60), records[1][2])
+}
+
+func TestDataExportHandlerQuality(t *testing.T) {
+	store := newMemoryReadingStore()
+	for i, quality := range []string{qualityGood, qualitySuspect} {
+		ts := int64(1761388101 + i)
+		_, err := store.InsertReading(context.Background(), TemperatureReadingPayload{DeviceId: "esp-a", TempCo: 85, Timestamp: &ts, Quality: quality})
+		require.NoError(t, err)
+	}
+
+	// suspect readings are exported too, marked so they can be told apart
+	app := &app{readings: store}
+	w := httptest.NewRecorder()
+	app.dataExportHandler(w, httptest.NewRequest("GET", "/data/export.csv", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, "quality", records[0][6])
+	assert.Equal(t, qualityGood, records[1][6])
+	assert.Equal(t, qualitySuspect, records[2][6])
+}
+
+// failingEachStore fails EachReading after after readings
+type failingEachStore struct {
+	*memoryReadingStore
+	after int
+}
+
+func (s failingEachStore) EachReading(ctx context.Context, q ReadingQuery, fn func(TemperatureReading) error) error {
+	n := 0
+	return s.memoryReadingStore.EachReading(ctx, q, func(tr TemperatureReading) error {
+		if n == s.after {
+			return errors.New("connection lost")
+		}
+		n++
+		return fn(tr)
+	})
+}
+
+func TestDataExportHandlerFails(t *testing.T) {
+	store := newMemoryReadingStore()
+	for ts := range int64(200) {
+		_, err := store.InsertReading(context.Background(), TemperatureReadingPayload{DeviceId: "esp-a", Timestamp: &ts})
+		require.NoError(t, err)
+	}
+
+	// failing before anything is sent is answered with a problem
+	app := &app{readings: failingEachStore{store, 10}}
+	w := httptest.NewRecorder()
+	app.dataExportHandler(w, httptest.NewRequest("GET", "/data/export.csv", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, problemTypeBase+"internal-error", decodeProblem(t, w).Type)
+
+	// once the CSV writer has flushed on its own the file is only truncated,
+	// well before exportFlushRows
+	app.readings = failingEachStore{store, 150}
+	w = httptest.NewRecorder()
+	app.dataExportHandler(w, httptest.NewRequest("GET", "/data/export.csv", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.True(t, strings.HasPrefix(body, "id,device_id,timestamp"))
+	assert.NotContains(t, body, "problem")
+	assert.Less(t, strings.Count(body, "\n"), 151)
+}
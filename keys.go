@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const deviceKeyPrefix = "esp_"
+
+var (
+	errInvalidKey     = errors.New("invalid key")
+	errDeviceMismatch = errors.New("key was not issued for this device")
+	errDeviceNotFound = errors.New("device not found")
+)
+
+type DeviceKey struct {
+	Id        int    `json:"id"`
+	DeviceId  string `json:"deviceId"`
+	Prefix    string `json:"prefix"`
+	CreatedAt int64  `json:"createdAt"`
+	RevokedAt *int64 `json:"revokedAt"`
+}
+
+// IssuedDeviceKey is returned only once, when the key is created. The plain
+// key is never stored, only its hash. SigningSecret signs requests made with
+// the key, see deviceSigningSecret.
+type IssuedDeviceKey struct {
+	DeviceKey
+	Key           string `json:"key"`
+	SigningSecret string `json:"signingSecret,omitempty"`
+}
+
+func generateDeviceKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return deviceKeyPrefix + hex.EncodeToString(b), nil
+}
+
+func hashDeviceKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *app) issueDeviceKey(ctx context.Context, deviceId string) (IssuedDeviceKey, error) {
+	var k IssuedDeviceKey
+	key, err := generateDeviceKey()
+	if err != nil {
+		return k, err
+	}
+	var exists bool
+	if err := a.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM devices WHERE id = $1)`, deviceId).Scan(&exists); err != nil {
+		return k, err
+	}
+	if !exists {
+		return k, errDeviceNotFound
+	}
+	err = a.db.QueryRow(ctx, `
+		INSERT INTO device_keys (device_id, key_hash, prefix, created_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, device_id, prefix, created_at, revoked_at
+	`, deviceId, hashDeviceKey(key), key[:len(deviceKeyPrefix)+8], time.Now().UTC().Unix()).Scan(&k.Id, &k.DeviceId, &k.Prefix, &k.CreatedAt, &k.RevokedAt)
+	k.Key = key
+	k.SigningSecret = a.deviceSigningSecret(hashDeviceKey(key))
+	return k, err
+}
+
+func (a *app) listDeviceKeys(ctx context.Context, deviceId string) ([]DeviceKey, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT id, device_id, prefix, created_at, revoked_at
+		FROM device_keys
+		WHERE device_id = $1
+		ORDER BY id`, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DeviceKey, error) {
+		var k DeviceKey
+		err := row.Scan(&k.Id, &k.DeviceId, &k.Prefix, &k.CreatedAt, &k.RevokedAt)
+		return k, err
+	})
+	if keys == nil {
+		keys = make([]DeviceKey, 0)
+	}
+	return keys, err
+}
+
+// hasDeviceKeys reports whether any device key is still active
+func (a *app) hasDeviceKeys(ctx context.Context) (bool, error) {
+	var exists bool
+	err := a.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM device_keys WHERE revoked_at IS NULL)`).Scan(&exists)
+	return exists, err
+}
+
+// revokeDeviceKey reports false if the device has no such active key
+func (a *app) revokeDeviceKey(ctx context.Context, deviceId string, keyId int) (bool, error) {
+	tag, err := a.db.Exec(ctx, `
+		UPDATE device_keys SET revoked_at = $3
+		WHERE id = $1 AND device_id = $2 AND revoked_at IS NULL
+	`, keyId, deviceId, time.Now().UTC().Unix())
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// authenticateDevice resolves an ingest key to the device it was issued for.
+// Unless rejectSharedKey is set the server secret key is accepted too; it
+// resolves to an empty device id and the caller takes the device from the
+// payload. Any other key must hash to an unrevoked key in device_keys.
+func (a *app) authenticateDevice(ctx context.Context, key string) (string, error) {
+	if key == "" {
+		return "", errInvalidKey
+	}
+	if !a.rejectSharedKey && subtle.ConstantTimeCompare([]byte(key), []byte(a.secretKey)) == 1 {
+		return "", nil
+	}
+	// per-device keys are only kept in Postgres
+	if a.db == nil {
+		return "", errInvalidKey
+	}
+	var deviceId string
+	err := a.db.QueryRow(ctx, `
+		SELECT device_id FROM device_keys
+		WHERE key_hash = $1 AND revoked_at IS NULL
+	`, hashDeviceKey(key)).Scan(&deviceId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errInvalidKey
+	}
+	return deviceId, err
+}
+
+// resolveDevice combines the authenticated device with the one claimed in a
+// payload, falling back to the default device for the shared key.
+func resolveDevice(authenticated, claimed string) (string, error) {
+	if authenticated == "" {
+		if claimed == "" {
+			return defaultDeviceId, nil
+		}
+		return claimed, nil
+	}
+	if claimed != "" && claimed != authenticated {
+		return "", errDeviceMismatch
+	}
+	return authenticated, nil
+}
+
+func (a *app) deviceKeysHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !a.isAdmin(r) {
+		writeProblem(w, problemForbidden, "")
+		return
+	}
+
+	deviceId := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := a.listDeviceKeys(r.Context(), deviceId)
+		if err != nil {
+			logger.Error("Failed to list device keys", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		json.NewEncoder(w).Encode(keys)
+
+	case http.MethodPost:
+		k, err := a.issueDeviceKey(r.Context(), deviceId)
+		if errors.Is(err, errDeviceNotFound) {
+			writeProblem(w, problemNotFound, "")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to issue device key", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		logger.Info("Issued device key", "device_id", k.DeviceId, "key_id", k.Id, "prefix", k.Prefix)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(k)
+
+	default:
+		writeProblem(w, problemMethodNotAllowed, "")
+	}
+}
+
+func (a *app) deviceKeyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !a.isAdmin(r) {
+		writeProblem(w, problemForbidden, "")
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		writeProblem(w, problemMethodNotAllowed, "")
+		return
+	}
+
+	keyId, err := strconv.Atoi(r.PathValue("keyId"))
+	if err != nil {
+		writeProblem(w, problemNotFound, "")
+		return
+	}
+	ok, err := a.revokeDeviceKey(r.Context(), r.PathValue("id"), keyId)
+	if err != nil {
+		logger.Error("Failed to revoke device key", "error", err)
+		writeProblem(w, problemInternal, "")
+		return
+	}
+	if !ok {
+		writeProblem(w, problemNotFound, "")
+		return
+	}
+	logger.Info("Revoked device key", "device_id", r.PathValue("id"), "key_id", keyId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keysCommand implements the `keys` subcommand:
+//
+//	keys list <device>
+//	keys issue <device>
+//	keys revoke <device> <key-id>
+func (a *app) keysCommand(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: keys list|issue|revoke <device> [key-id]")
+	}
+	if a.db == nil {
+		return fmt.Errorf("device keys need the postgres driver")
+	}
+	deviceId := args[1]
+	switch args[0] {
+	case "list":
+		keys, err := a.listDeviceKeys(ctx, deviceId)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			status := "active"
+			if k.RevokedAt != nil {
+				status = "revoked " + time.Unix(*k.RevokedAt, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\n", k.Id, k.Prefix, time.Unix(k.CreatedAt, 0).UTC().Format(time.RFC3339), status)
+		}
+		return nil
+	case "issue":
+		k, err := a.issueDeviceKey(ctx, deviceId)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("key id: %d\nkey: %s\nsigning secret: %s\n", k.Id, k.Key, k.SigningSecret)
+		return nil
+	case "revoke":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: keys revoke <device> <key-id>")
+		}
+		keyId, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid key id %q", args[2])
+		}
+		ok, err := a.revokeDeviceKey(ctx, deviceId, keyId)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("device %s has no active key %d", deviceId, keyId)
+		}
+		fmt.Printf("revoked key %d\n", keyId)
+		return nil
+	default:
+		return fmt.Errorf("unknown keys command %q", args[0])
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateDeviceKey(t *testing.T) {
+	k1, err := generateDeviceKey()
+	require.NoError(t, err)
+	k2, err := generateDeviceKey()
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(k1, deviceKeyPrefix))
+	assert.NotEqual(t, k1, k2)
+	assert.NotEqual(t, k1, hashDeviceKey(k1))
+	assert.Equal(t, hashDeviceKey(k1), hashDeviceKey(k1))
+}
+
+func TestResolveDevice(t *testing.T) {
+	tests := []struct {
+		authenticated string
+		claimed       string
+		expect        string
+		expectErr     error
+	}{
+		{"", "", defaultDeviceId, nil},
+		{"", "esp-a", "esp-a", nil},
+		{"esp-a", "", "esp-a", nil},
+		{"esp-a", "esp-a", "esp-a", nil},
+		{"esp-a", "esp-b", "", errDeviceMismatch},
+	}
+
+	for _, tt := range tests {
+		got, err := resolveDevice(tt.authenticated, tt.claimed)
+		assert.Equal(t, tt.expectErr, err)
+		assert.Equal(t, tt.expect, got)
+	}
+}
+
+func TestAuthenticateDeviceSharedKey(t *testing.T) {
+	app := &app{secretKey: "testsecret"}
+	deviceId, err := app.authenticateDevice(context.Background(), "testsecret")
+	assert.NoError(t, err)
+	assert.Equal(t, "", deviceId)
+
+	_, err = app.authenticateDevice(context.Background(), "")
+	assert.ErrorIs(t, err, errInvalidKey)
+}
+
+func TestDeviceKeysLifecycle(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	_, err := db.Exec(context.Background(), "INSERT INTO devices (id) VALUES ('esp-a'), ('esp-b')")
+	require.NoError(t, err)
+
+	// issue
+	req := httptest.NewRequest("POST", "/devices/esp-a/keys", nil)
+	req.SetPathValue("id", "esp-a")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	app.deviceKeysHandler(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var issued IssuedDeviceKey
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&issued))
+	assert.Equal(t, "esp-a", issued.DeviceId)
+	assert.True(t, strings.HasPrefix(issued.Key, issued.Prefix))
+
+	var stored string
+	require.NoError(t, db.QueryRow(context.Background(), "SELECT key_hash FROM device_keys WHERE id = $1", issued.Id).Scan(&stored))
+	assert.NotEqual(t, issued.Key, stored)
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+		req.Header.Set("X-Secret-Key", key)
+		w := httptest.NewRecorder()
+		app.dataHandler(w, req)
+		return w
+	}
+
+	// the key resolves to its device
+	w = post(issued.Key, `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var tr TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tr))
+	assert.Equal(t, "esp-a", tr.DeviceId)
+
+	// and cannot be used to write as another device
+	w = post(issued.Key, `{"deviceId": "esp-b", "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// list
+	req = httptest.NewRequest("GET", "/devices/esp-a/keys", nil)
+	req.SetPathValue("id", "esp-a")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	app.deviceKeysHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var keys []DeviceKey
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&keys))
+	require.Len(t, keys, 1)
+	assert.Nil(t, keys[0].RevokedAt)
+
+	// revoke
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/devices/esp-a/keys/%d", issued.Id), nil)
+	req.SetPathValue("id", "esp-a")
+	req.SetPathValue("keyId", fmt.Sprint(issued.Id))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	app.deviceKeyHandler(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = post(issued.Key, `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// revoking twice is not found
+	w = httptest.NewRecorder()
+	app.deviceKeyHandler(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDeviceKeysHandlerUnknownDevice(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	req := httptest.NewRequest("POST", "/devices/nope/keys", nil)
+	req.SetPathValue("id", "nope")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	app.deviceKeysHandler(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDataHandlerPOSTRejectSharedKey(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret", rejectSharedKey: true}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	body := `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`
+	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+
+	app.dataHandler(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestDeviceKeysHandlerForbidden(t *testing.T) {
+	app := &app{secretKey: "testsecret"}
+
+	req := httptest.NewRequest("POST", "/devices/default/keys", nil)
+	req.SetPathValue("id", "default")
+	w := httptest.NewRecorder()
+	app.deviceKeysHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -1,18 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"cmp"
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -38,30 +49,72 @@ func init() {
 }
 
 type TemperatureReadingPayload struct {
+	DeviceId  string  `json:"deviceId"`
 	TempCo    float64 `json:"tempCo"`
 	TempRoom  float64 `json:"tempRoom"`
 	Humidity  float64 `json:"humidity"`
 	Timestamp *int64  `json:"timestamp"`
+	// Quality is set by validation, devices can't claim it
+	Quality string `json:"-"`
 }
 
 type TemperatureReading struct {
 	Id        int     `json:"id"`
+	DeviceId  string  `json:"deviceId"`
 	TempCo    float64 `json:"tempCo"`
 	TempRoom  float64 `json:"tempRoom"`
 	Humidity  float64 `json:"humidity"`
 	Timestamp *int64  `json:"timestamp"`
+	Quality   string  `json:"quality"`
 }
 
 type app struct {
-	db        *pgxpool.Pool
-	secretKey string
+	db              *pgxpool.Pool
+	readings        ReadingStore
+	secretKey       string
+	signingKey      string
+	rejectSharedKey bool
+	// device requests must come with a client certificate
+	requireClientCert bool
+	hmacSkew          time.Duration
+	maxBatchSize      int
+	location          *time.Location
+	hub               *eventHub
+	retention         retentionPolicy
+	webhooks          webhookSettings
+	rateLimits        *rateLimits
+	validation        *readingValidation
+	// corsOrigins may make cross-origin requests, "*" allows any
+	corsOrigins []string
+	// draining is set on shutdown, /health then reports not ready
+	draining atomic.Bool
+	// nonces of signed requests without Postgres
+	nonces nonceCache
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
+// corsOrigin is the Access-Control-Allow-Origin of a request from origin,
+// "" if it isn't allowed
+func (a *app) corsOrigin(origin string) string {
+	if slices.Contains(a.corsOrigins, "*") {
+		return "*"
+	}
+	if origin != "" && slices.Contains(a.corsOrigins, origin) {
+		return origin
+	}
+	return ""
+}
+
+func (a *app) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Secret-Key")
+		if allow := a.corsOrigin(r.Header.Get("Origin")); allow != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allow)
+			if allow != "*" {
+				w.Header().Add("Vary", "Origin")
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Secret-Key, X-Device-Id, X-Timestamp, X-Nonce, X-Signature")
+		w.Header().Set("Access-Control-Expose-Headers", "Link, X-Next-Cursor, X-Prev-Cursor, X-Request-ID")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -77,90 +130,126 @@ func main() {
 	logger := slog.New(h)
 	slog.SetDefault(logger)
 
-	host := flag.String("host", "127.0.0.1", "Server host")
-	port := flag.Int("port", 8080, "Server port")
-	dbHost := flag.String("db-host", "localhost", "Database host")
-	dbPort := flag.Int("db-port", 5432, "Database port")
-	dbUser := flag.String("db-user", "user", "Database user")
-	dbPass := flag.String("db-pass", "", "Database password")
-	dbName := flag.String("db-name", "dbname", "Database name")
-	flag.Parse()
-
-	// env variables take precedence, prefix APP_
-	if env := os.Getenv("APP_HOST"); env != "" {
-		*host = env
-		logger.Debug("flag host overridden by env APP_HOST", "value", env)
-	}
-	if env := os.Getenv("APP_PORT"); env != "" {
-		if p, err := strconv.Atoi(env); err == nil {
-			*port = p
-			logger.Debug("flag port overridden by env APP_PORT", "value", p)
+	cfg, args, err := loadConfig(os.Args[1:], os.Getenv)
+	if cfg == nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
 		}
+		os.Exit(2)
 	}
-	if env := os.Getenv("APP_DB_HOST"); env != "" {
-		*dbHost = env
-		logger.Debug("flag db-host overridden by env APP_DB_HOST", "value", env)
-	}
-	if env := os.Getenv("APP_DB_PORT"); env != "" {
-		if p, err := strconv.Atoi(env); err == nil {
-			*dbPort = p
-			logger.Debug("flag db-port overridden by env APP_DB_PORT", "value", p)
+	// config print works on an invalid config, to see where a value came from
+	if len(args) > 0 && args[0] == "config" {
+		if err := configCommand(cfg, err, args[1:], os.Stdout); err != nil {
+			logger.Error("Command failed", "error", err)
+			os.Exit(1)
 		}
+		return
 	}
-	if env := os.Getenv("APP_DB_USER"); env != "" {
-		*dbUser = env
-		logger.Debug("flag db-user overridden by env APP_DB_USER", "value", env)
-	}
-	if env := os.Getenv("APP_DB_PASS"); env != "" {
-		*dbPass = env
-		logger.Debug("flag db-pass overridden by env APP_DB_PASS", "value", "***")
-	}
-	if env := os.Getenv("APP_DB_NAME"); env != "" {
-		*dbName = env
-		logger.Debug("flag db-name overridden by env APP_DB_NAME", "value", env)
+	cfg.logOverrides(logger)
+	// commands don't need the key
+	if len(args) == 0 && cfg.Auth.SecretKey == "" {
+		err = errors.Join(err, errors.New("auth.secret_key: is required, set APP_SECRET_KEY"))
 	}
-
-	secretKey := os.Getenv("APP_SECRET_KEY")
-	if secretKey == "" {
-		logger.Error("APP_SECRET_KEY environment variable is required")
+	if err != nil {
+		logger.Error("Invalid config", "error", err)
 		os.Exit(1)
 	}
 
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?application_name=esp8266-web",
-		*dbUser, *dbPass, *dbHost, *dbPort, *dbName)
+	location, _ := time.LoadLocation(cfg.Server.Timezone)
 	ctx := context.Background()
-	config, err := pgxpool.ParseConfig(connStr)
-	if err != nil {
-		logger.Error("Failed to parse database config", "error", err)
-		os.Exit(1)
+	app := &app{
+		signingKey:        cmp.Or(cfg.Auth.SigningKey, cfg.Auth.SecretKey),
+		rejectSharedKey:   cfg.Auth.RejectSharedKey,
+		requireClientCert: cfg.TLS.ClientAuth == clientAuthRequire,
+		hmacSkew:          time.Duration(cfg.Auth.HmacSkew),
+		maxBatchSize:      cfg.Server.MaxBatchSize,
+		location:          location,
+		hub:               newEventHub(),
+		retention:         cfg.retentionPolicy(),
+		webhooks:          cfg.webhookSettings(),
+		rateLimits:        cfg.rateLimits(),
+		validation:        cfg.readingValidation(),
+		corsOrigins:       cfg.CORS.AllowedOrigins,
 	}
-	pool, err := pgxpool.NewWithConfig(ctx, config)
+	// closeDB is deferred for commands, the server closes it once everything
+	// using it has stopped
+	closeDB, err := app.openDatabase(ctx, cfg)
 	if err != nil {
-		logger.Error("Failed to create database pool", "error", err)
+		logger.Error("Failed to open database", "driver", cfg.Database.Driver, "error", err)
 		os.Exit(1)
 	}
-	defer pool.Close()
+	closeDB = sync.OnceFunc(closeDB)
+	defer closeDB()
+
+	// migrate manages the schema by hand
+	if len(args) == 0 || args[0] != "migrate" {
+		if err := app.applyMigrations(ctx); err != nil {
+			logger.Error("Failed to apply migrations", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	if err := pool.Ping(ctx); err != nil {
-		logger.Error("Failed to ping database", "error", err)
-		os.Exit(1)
+	if len(args) > 0 {
+		if err := app.runCommand(ctx, args); err != nil {
+			logger.Error("Command failed", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	app := &app{db: pool, secretKey: secretKey}
+	app.secretKey = cfg.Auth.SecretKey
 
-	if err := app.applyMigrations(ctx); err != nil {
-		logger.Error("Failed to apply migrations", "error", err)
-		os.Exit(1)
+	// signing secrets derived from the secret key break when it is rotated
+	if app.db != nil && cfg.Auth.SigningKey == "" {
+		if hasKeys, err := app.hasDeviceKeys(ctx); err != nil {
+			logger.Error("Failed to check for device keys", "error", err)
+		} else if hasKeys {
+			logger.Warn("Device signing secrets are derived from the secret key, rotating it invalidates them; set APP_SIGNING_KEY")
+		}
 	}
 
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.Handle("/health", panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(loggingMiddleware(http.HandlerFunc(app.healthHandler)))))
+	disconnectMQTT := func() {}
+	if cfg.MQTT.Broker != "" {
+		mqttClient := app.startMQTT(mqttConfig{
+			broker:   cfg.MQTT.Broker,
+			topic:    cfg.MQTT.Topic,
+			clientId: cfg.MQTT.ClientId,
+			username: cfg.MQTT.Username,
+			password: cfg.MQTT.Password,
+		}, logger)
+		disconnectMQTT = func() { mqttClient.Disconnect(250) }
+	}
 
-	mux.Handle("/", panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(loggingMiddleware(http.HandlerFunc(app.homeHandler)))))
-	mux.Handle("/data", corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(loggingMiddleware(http.HandlerFunc(app.dataHandler))))))
+	// background jobs stop after the requests have drained, they may still
+	// be handed events until then
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	var jobs sync.WaitGroup
+	if app.db != nil {
+		jobs.Go(func() { newWebhookDispatcher(app, logger).run(jobsCtx) })
+	}
+	if app.retention.enabled() {
+		jobs.Go(func() { newRetentionPruner(app, logger).run(jobsCtx) })
+	}
 
-	addr := fmt.Sprintf("%s:%d", *host, *port)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/health", panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(app.healthHandler))))))
+
+	mux.Handle("/", panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(app.homeHandler))))))
+	mux.Handle("/data", app.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(app.dataHandler)))))))
+	mux.Handle("/data/latest", app.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(app.dataLatestHandler)))))))
+	mux.Handle("/data/export.csv", app.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(app.dataExportHandler)))))))
+	mux.Handle("/data/aggregate", app.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(app.dataAggregateHandler)))))))
+	mux.Handle("/ws", panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(app.wsHandler))))))
+	mux.Handle("/data/stream", app.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(app.dataStreamHandler)))))))
+	mux.Handle("/data/batch", app.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(app.dataBatchHandler)))))))
+	// commands only go to connected WebSocket clients and need no table, so
+	// unlike the other /devices routes they work on every driver
+	mux.Handle("/devices/{id}/commands", app.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(app.deviceCommandsHandler)))))))
+	// device keys, alerts and webhooks are only kept in Postgres
+	app.handlePostgresRoutes(mux, logger)
+
+	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
 	server := &http.Server{
 		Addr:         addr,
 		Handler:      mux,
@@ -169,26 +258,181 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
-	logger.Info(fmt.Sprintf("starting server at http://%s", addr), slog.String("addr", addr))
-	if err := server.ListenAndServe(); err != nil {
+	signals, stopSignals := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	servers := []*http.Server{server}
+	serverErr := make(chan error, 2)
+	if cfg.TLS.Cert != "" {
+		certs, err := newCertReloader(cfg.TLS.Cert, cfg.TLS.Key, logger)
+		if err != nil {
+			logger.Error("Failed to load TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig, err = newTLSConfig(certs, cfg.TLS.ClientCA)
+		if err != nil {
+			logger.Error("Failed to load TLS client CA", "error", err)
+			os.Exit(1)
+		}
+		jobs.Go(func() { certs.run(jobsCtx) })
+
+		logger.Info(fmt.Sprintf("starting server at https://%s", addr), slog.String("addr", addr))
+		go func() { serverErr <- server.ListenAndServeTLS("", "") }()
+
+		if cfg.TLS.RedirectAddr != "" {
+			redirect := &http.Server{
+				Addr:         cfg.TLS.RedirectAddr,
+				Handler:      redirectHandler(cfg.Server.Port),
+				ReadTimeout:  15 * time.Second,
+				WriteTimeout: 15 * time.Second,
+				IdleTimeout:  60 * time.Second,
+			}
+			servers = append(servers, redirect)
+			logger.Info("starting HTTPS redirect", slog.String("addr", cfg.TLS.RedirectAddr))
+			go func() { serverErr <- redirect.ListenAndServe() }()
+		}
+	} else {
+		logger.Info(fmt.Sprintf("starting server at http://%s", addr), slog.String("addr", addr))
+		go func() { serverErr <- server.ListenAndServe() }()
+	}
+
+	failed := false
+	select {
+	case err := <-serverErr:
 		logger.Error("server failed", "error", err)
+		failed = true
+		// the other listener, if any, still needs closing
+		for _, s := range servers {
+			s.Close()
+		}
+	case <-signals.Done():
+		// a second signal kills the process
+		stopSignals()
+		shutdownTimeout := time.Duration(cfg.Server.ShutdownTimeout)
+		logger.Info("Shutting down", "timeout", shutdownTimeout)
+		app.drain(servers, time.Duration(cfg.Server.ShutdownDelay), shutdownTimeout, logger)
+	}
+
+	stopJobs()
+	disconnectMQTT()
+	jobs.Wait()
+	closeDB()
+	if failed {
 		os.Exit(1)
 	}
+	logger.Info("Shutdown complete")
+}
+
+// handlePostgresRoutes registers the routes backed by Postgres tables. The
+// other drivers answer them with a problem instead of the dashboard.
+func (a *app) handlePostgresRoutes(mux *http.ServeMux, logger *slog.Logger) {
+	if a.db == nil {
+		for _, pattern := range []string{
+			"/alerts/rules", "/alerts/rules/{id}", "/alerts/events",
+			"/webhooks", "/webhooks/{id}", "/webhooks/{id}/deliveries",
+			"/devices", "/devices/{id}", "/devices/{id}/keys", "/devices/{id}/keys/{keyId}",
+		} {
+			mux.Handle(pattern, a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(needsPostgresHandler)))))))
+		}
+		return
+	}
+	mux.Handle("/alerts/rules", a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(a.alertRulesHandler)))))))
+	mux.Handle("/alerts/rules/{id}", a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(a.alertRuleHandler)))))))
+	mux.Handle("/alerts/events", a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(a.alertEventsHandler)))))))
+	mux.Handle("/webhooks", a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(a.webhooksHandler)))))))
+	mux.Handle("/webhooks/{id}", a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(a.webhookHandler)))))))
+	mux.Handle("/webhooks/{id}/deliveries", a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(a.webhookDeliveriesHandler)))))))
+	mux.Handle("/devices", a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(a.devicesHandler)))))))
+	mux.Handle("/devices/{id}", a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(a.deviceHandler)))))))
+	mux.Handle("/devices/{id}/keys", a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(a.deviceKeysHandler)))))))
+	mux.Handle("/devices/{id}/keys/{keyId}", a.corsMiddleware(panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(metricsMiddleware(loggingMiddleware(http.HandlerFunc(a.deviceKeyHandler)))))))
+}
+
+func needsPostgresHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, problemNeedsPostgres, "devices, keys, alerts and webhooks need the postgres database driver")
+}
+
+// openDatabase connects the reading store for cfg's driver and returns the
+// function closing it
+func (a *app) openDatabase(ctx context.Context, cfg *config) (func(), error) {
+	switch cfg.Database.Driver {
+	case "postgres":
+		connStr := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?application_name=esp8266-web",
+			cfg.Database.User, cfg.Database.Password, cfg.Database.Host, cfg.Database.Port, cfg.Database.Name)
+		config, err := pgxpool.ParseConfig(connStr)
+		if err != nil {
+			return nil, fmt.Errorf("parse database config: %w", err)
+		}
+		pool, err := pgxpool.NewWithConfig(ctx, config)
+		if err != nil {
+			return nil, fmt.Errorf("create database pool: %w", err)
+		}
+		if err := pool.Ping(ctx); err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("ping database: %w", err)
+		}
+		a.db = pool
+		a.readings = newPgReadingStore(pool)
+		return pool.Close, nil
+	case "sqlite":
+		db, err := openSQLite(ctx, cfg.Database.Path)
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", cfg.Database.Path, err)
+		}
+		a.readings = newSQLiteReadingStore(db)
+		return func() { db.Close() }, nil
+	case "memory":
+		// readings are lost on restart, for trying the server out and tests
+		a.readings = newMemoryReadingStore()
+		return func() {}, nil
+	default:
+		return nil, fmt.Errorf("unknown driver %q", cfg.Database.Driver)
+	}
+}
+
+// runCommand runs a CLI subcommand instead of starting the server
+func (a *app) runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "keys":
+		return a.keysCommand(ctx, args[1:])
+	case "migrate":
+		return a.migrateCommand(ctx, args[1:])
+	case "prune":
+		return a.pruneCommand(ctx, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
 }
 
 func (a *app) healthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeProblem(w, problemMethodNotAllowed, "")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `{"status": "ok"}`)
+	if a.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"status": "draining"}`)
+		return
+	}
+	if a.migrator() == nil {
+		fmt.Fprint(w, `{"status": "ok"}`)
+		return
+	}
+	version, err := a.schemaVersion(r.Context())
+	if err != nil {
+		slogctx.FromCtx(r.Context()).Error("Failed to query schema version", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"status": "unavailable"}`)
+		return
+	}
+	fmt.Fprintf(w, `{"status": "ok", "schemaVersion": %d}`, version)
 }
 
 func (a *app) homeHandler(w http.ResponseWriter, r *http.Request) {
 	fsys, err := fs.Sub(static, "static")
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeProblem(w, problemInternal, "")
 		return
 	}
 
@@ -213,38 +457,64 @@ func (a *app) dataHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case http.MethodPost:
-		headerSecretKey := r.Header.Get("X-Secret-Key")
-		logger.Debug("X-Secret-Key header value", slog.String("value", headerSecretKey))
-		if headerSecretKey != a.secretKey {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		if a.rateLimited(w, r, routeData, limitIP, clientIP(r)) {
+			ingestRejected.WithLabelValues(ingestHTTP, reasonRateLimited).Inc()
+			return
+		}
+		body, ok := readIngestBody(w, r, ingestHTTP, maxReadingSize)
+		if !ok {
+			return
+		}
+		authDeviceId, err := a.authenticateRequest(r, body)
+		if isAuthError(err) {
+			logger.Warn("Rejected ingest request", "error", err)
+			ingestRejected.WithLabelValues(ingestHTTP, rejectReason(err)).Inc()
+			writeProblem(w, problemForbidden, "")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to authenticate device", "error", err)
+			ingestFailed.WithLabelValues(ingestHTTP, reasonAuthBackend).Inc()
+			writeProblem(w, problemInternal, "")
 			return
 		}
 		var tri TemperatureReadingPayload
-		if err := json.NewDecoder(r.Body).Decode(&tri); err != nil {
+		if err := json.Unmarshal(body, &tri); err != nil {
 			logger.Error("failed to decode temperature reading",
 				slog.Any("error", err),
 			)
-			http.Error(w, "Bad request", http.StatusUnprocessableEntity)
+			ingestRejected.WithLabelValues(ingestHTTP, reasonBadRequest).Inc()
+			writeProblem(w, problemInvalidJSON, err.Error())
 			return
 		}
 		logger.Info("Received temperature reading",
 			slog.Any("data", tri),
 		)
-		if tri.Timestamp == nil {
-			now := time.Now().UTC().Unix()
-			tri.Timestamp = &now
-		}
-		var tr TemperatureReading
-		err := a.db.QueryRow(r.Context(), `
-			INSERT INTO readings (temp_co, temp_room, humidity, timestamp)
-			VALUES ($1, $2, $3, $4)
-			RETURNING id, temp_co, temp_room, humidity, timestamp
-		`, tri.TempCo, tri.TempRoom, tri.Humidity, *tri.Timestamp).Scan(&tr.Id, &tr.TempCo, &tr.TempRoom, &tr.Humidity, &tr.Timestamp)
+		err = prepareReading(authDeviceId, &tri)
+		if err == nil {
+			err = a.validateReading(r.Context(), &tri)
+		}
+		if err != nil {
+			ingestRejected.WithLabelValues(ingestHTTP, rejectReason(err)).Inc()
+			if isAuthError(err) {
+				writeProblem(w, problemForbidden, "")
+				return
+			}
+			ingestProblem(err).write(w)
+			return
+		}
+		if a.rateLimited(w, r, routeData, limitDevice, tri.DeviceId) {
+			ingestRejected.WithLabelValues(ingestHTTP, reasonRateLimited).Inc()
+			return
+		}
+		tr, err := a.insertReading(r.Context(), tri)
 		if err != nil {
 			logger.Error("Failed to insert temperature reading", "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			ingestFailed.WithLabelValues(ingestHTTP, reasonDatabase).Inc()
+			writeProblem(w, problemInternal, "")
 			return
 		}
+		observeAccepted(ingestHTTP, tr)
 		json.NewEncoder(w).Encode(tr)
 
 	case http.MethodGet:
@@ -280,93 +550,147 @@ func (a *app) dataHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		query := `
-			SELECT id, temp_co, temp_room, humidity, timestamp
-			FROM readings
-			WHERE 1=1`
-		args := []interface{}{}
-		argIndex := 1
+		device := r.URL.Query().Get("device")
 
-		if from != nil {
-			query += fmt.Sprintf(" AND timestamp >= $%d", argIndex)
-			args = append(args, *from)
-			argIndex++
+		q := ReadingQuery{
+			Device: device,
+			From:   from,
+			To:     to,
+			Limit:  limit + 1,
+			Offset: offset,
 		}
-		if to != nil {
-			query += fmt.Sprintf(" AND timestamp <= $%d", argIndex)
-			args = append(args, *to)
-			argIndex++
+		// a cursor pages by (timestamp, id) instead of the offset
+		var cursor *pageCursor
+		if s := r.URL.Query().Get("cursor"); s != "" {
+			c, err := parsePageCursor(s)
+			if err != nil {
+				writeProblem(w, problemInvalidParameter, "", fieldError{"cursor", "must be a cursor returned by GET /data"})
+				return
+			}
+			if offset > 0 {
+				writeProblem(w, problemInvalidParameter, "", fieldError{"offset", "can't be combined with cursor"})
+				return
+			}
+			cursor = &c
+			q = c.query(q, limit)
 		}
 
-		query += fmt.Sprintf(` ORDER BY timestamp DESC LIMIT $%d OFFSET $%d`, argIndex, argIndex+1)
-		args = append(args, limit, offset)
-
-		rows, err := a.db.Query(r.Context(), query, args...)
+		readings, err := a.readings.QueryReadings(r.Context(), q)
 		if err != nil {
 			logger.Error("Failed to query temperature readings", "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			writeProblem(w, problemInternal, "")
 			return
 		}
-		defer rows.Close()
-
-		readings := make([]TemperatureReading, 0)
-		for rows.Next() {
-			var tr TemperatureReading
-			if err := rows.Scan(&tr.Id, &tr.TempCo, &tr.TempRoom, &tr.Humidity, &tr.Timestamp); err != nil {
-				logger.Error("Failed to scan row", "error", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			readings = append(readings, tr)
-		}
-		if err := rows.Err(); err != nil {
-			logger.Error("Rows error", "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+		more := len(readings) > limit
+		readings = readings[:min(len(readings), limit)]
+		hasNext, hasPrev := more, cursor != nil || offset > 0
+		if cursor != nil && cursor.dir == cursorPrev {
+			// pages going back are read oldest first
+			slices.Reverse(readings)
+			hasNext, hasPrev = true, more
 		}
+		setPageLinks(w, r, readings, hasNext, hasPrev)
 		json.NewEncoder(w).Encode(readings)
 
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeProblem(w, problemMethodNotAllowed, "")
 	}
 
 }
 
-func (a *app) applyMigrations(ctx context.Context) error {
-	slog.Debug("Applying migrations")
-	_, err := a.db.Exec(ctx, `
-		CREATE TABLE IF NOT EXISTS readings (
-			id SERIAL PRIMARY KEY,
-			temp_co DOUBLE PRECISION,
-			temp_room DOUBLE PRECISION,
-			timestamp BIGINT,
-			created_at TIMESTAMP DEFAULT NOW()
-		)
-	`)
-	if err != nil {
-		return err
+// maxReadingSize is the largest POST /data body accepted, readings are well
+// under it
+const maxReadingSize = 4 << 10
+
+// readIngestBody reads the body of an ingest request of at most limit bytes.
+// If it can't, the request has been answered and false is returned.
+func readIngestBody(w http.ResponseWriter, r *http.Request, source string, limit int64) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		ingestRejected.WithLabelValues(source, reasonBodyTooLarge).Inc()
+		writeProblem(w, problemBodyTooLarge, fmt.Sprintf("at most %d bytes", limit))
+		return nil, false
 	}
-	_, err = a.db.Exec(ctx, `
-		ALTER TABLE readings ADD COLUMN IF NOT EXISTS humidity DOUBLE PRECISION NOT NULL DEFAULT 0.0
-	`)
 	if err != nil {
-		return err
+		slogctx.FromCtx(r.Context()).Error("failed to read request body", slog.Any("error", err))
+		ingestRejected.WithLabelValues(source, reasonBadRequest).Inc()
+		writeProblem(w, problemMalformedRequest, err.Error())
+		return nil, false
 	}
-	_, err = a.db.Exec(ctx, `
-		ALTER TABLE readings ALTER COLUMN temp_co SET DEFAULT 0.0;
-		ALTER TABLE readings ALTER COLUMN temp_co SET NOT NULL;
-		ALTER TABLE readings ALTER COLUMN temp_room SET DEFAULT 0.0;
-		ALTER TABLE readings ALTER COLUMN temp_room SET NOT NULL;
-		ALTER TABLE readings ALTER COLUMN timestamp SET DEFAULT 0;
-		ALTER TABLE readings ALTER COLUMN timestamp SET NOT NULL
-	`)
+	return body, true
+}
+
+// prepareReading applies the device resolution, validation and timestamp
+// defaulting shared by every ingest path. Timestamps before 1970 are refused,
+// the hourly and daily rollups only bucket positive ones.
+func prepareReading(authDeviceId string, p *TemperatureReadingPayload) error {
+	deviceId, err := resolveDevice(authDeviceId, p.DeviceId)
 	if err != nil {
 		return err
 	}
-	slog.Debug("Migrations applied successfully")
+	if !validDeviceId(deviceId) {
+		return errInvalidDeviceId
+	}
+	p.DeviceId = deviceId
+	if p.Timestamp == nil {
+		now := time.Now().UTC().Unix()
+		p.Timestamp = &now
+	}
+	if *p.Timestamp < 0 {
+		return &invalidReadingError{Fields: []fieldError{{"timestamp", "must not be before 1970"}}}
+	}
 	return nil
 }
 
+// dataLatestHandler returns the newest reading, of one device if given
+func (a *app) dataLatestHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		writeProblem(w, problemMethodNotAllowed, "")
+		return
+	}
+
+	tr, err := a.readings.LatestReading(r.Context(), r.URL.Query().Get("device"))
+	if errors.Is(err, errNoReadings) {
+		writeProblem(w, problemNotFound, "")
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to query latest temperature reading", "error", err)
+		writeProblem(w, problemInternal, "")
+		return
+	}
+	json.NewEncoder(w).Encode(tr)
+}
+
+// insertReading stores a reading, publishes it and runs it through the alert
+// rules, see readingStored.
+func (a *app) insertReading(ctx context.Context, p TemperatureReadingPayload) (TemperatureReading, error) {
+	start := time.Now()
+	tr, err := a.readings.InsertReading(ctx, p)
+	observeInsert("single", start)
+	if err == nil {
+		a.readingStored(ctx, tr)
+	}
+	return tr, err
+}
+
+// readingStored publishes a stored reading. Only good readings update the
+// gauges and are run through the alert rules, a suspect one is likely a
+// sensor fault.
+func (a *app) readingStored(ctx context.Context, tr TemperatureReading) {
+	a.hub.publish(readingEvent(tr))
+	if tr.Quality != qualityGood {
+		return
+	}
+	observeReading(tr)
+	a.evaluateAlertsAfterInsert(ctx, tr)
+}
+
 func requestIdMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -392,7 +716,7 @@ func panicRecoveryMiddleware(logger *slog.Logger) func(http.Handler) http.Handle
 						reqLogger = logger
 					}
 					reqLogger.Error("panic recovered", slog.Any("panic", err))
-					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					writeProblem(w, problemInternal, "")
 				}
 			}()
 			next.ServeHTTP(w, r)
@@ -426,6 +750,40 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// metricsMiddleware records request counts, durations and in-flight requests.
+// Routes are labelled by the mux pattern that matched, not the path, so every
+// page served by the "/" fallback counts as one route.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		method := metricMethod(r.Method)
+
+		inFlight := httpRequestsInFlight.WithLabelValues(route)
+		inFlight.Inc()
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		defer func() {
+			inFlight.Dec()
+			status := rw.statusCode
+			p := recover()
+			if p != nil {
+				// panicRecoveryMiddleware answers with a 500
+				status = http.StatusInternalServerError
+			}
+			code := strconv.Itoa(status)
+			httpRequests.WithLabelValues(route, method, code).Inc()
+			httpRequestDuration.WithLabelValues(route, method, code).Observe(time.Since(start).Seconds())
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -435,3 +793,15 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Hijack lets WebSocket connections take over the underlying connection
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rw.statusCode = http.StatusSwitchingProtocols
+	return http.NewResponseController(rw.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush streamed responses.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
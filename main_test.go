@@ -65,7 +65,7 @@ func setupTestDB(t *testing.T) *pgxpool.Pool {
 
 func TestApplyMigrations(t *testing.T) {
 	db := setupTestDB(t)
-	app := &app{db: db, secretKey: "dummy"}
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "dummy"}
 	err := app.applyMigrations(context.Background())
 	assert.NoError(t, err)
 	var exists bool
@@ -74,113 +74,172 @@ func TestApplyMigrations(t *testing.T) {
 	assert.True(t, exists)
 }
 
-func TestDataHandlerPOST(t *testing.T) {
-	db := setupTestDB(t)
-	app := &app{db: db, secretKey: "testsecret"}
+func TestOpenDatabaseMemory(t *testing.T) {
+	cfg, _, err := loadConfig([]string{"--db-driver=memory"}, envMap(nil))
+	require.NoError(t, err)
+	app := &app{secretKey: "testsecret", hub: newEventHub()}
+	closeDB, err := app.openDatabase(context.Background(), cfg)
+	require.NoError(t, err)
+	defer closeDB()
+	assert.IsType(t, &memoryReadingStore{}, app.readings)
+	assert.Nil(t, app.db)
+
+	// there is no schema to migrate
 	require.NoError(t, app.applyMigrations(context.Background()))
+	assert.EqualError(t, app.runCommand(context.Background(), []string{"migrate", "status"}), "no database to migrate")
 
-	body := `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0, "timestamp": 1761388101}`
-	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
-	req.Header.Set("Content-Type", "application/json")
+	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(`{"deviceId": "esp-a", "tempCo": 25.5, "timestamp": 1761388101}`)))
 	req.Header.Set("X-Secret-Key", "testsecret")
 	w := httptest.NewRecorder()
-
 	app.dataHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	app.dataHandler(w, httptest.NewRequest("GET", "/data?device=esp-a", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var readings []TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&readings))
+	require.Len(t, readings, 1)
+	assert.Equal(t, 25.5, readings[0].TempCo)
+}
 
-	assert.Equal(t, http.StatusOK, w.Code)
-	var resp TemperatureReading
-	err := json.NewDecoder(w.Body).Decode(&resp)
+// readingDrivers builds a migrated app on each ReadingStore, the handler tests
+// run against all of them
+var readingDrivers = []struct {
+	name  string
+	setup func(t *testing.T) *app
+}{
+	{"postgres", func(t *testing.T) *app {
+		db := setupTestDB(t)
+		app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret"}
+		require.NoError(t, app.applyMigrations(context.Background()))
+		return app
+	}},
+	{"sqlite", setupTestSQLiteApp},
+	{"memory", func(t *testing.T) *app {
+		return &app{readings: newMemoryReadingStore(), secretKey: "testsecret"}
+	}},
+}
 
-	assert.NoError(t, err)
-	assert.NotNil(t, resp.Id)
-	assert.Equal(t, 25.5, resp.TempCo)
-	assert.Equal(t, 22.0, resp.TempRoom)
-	assert.Equal(t, 60.0, resp.Humidity)
-	assert.Equal(t, int64(1761388101), *resp.Timestamp)
+func insertTestReading(t *testing.T, app *app, device string, tempCo float64, ts int64) {
+	t.Helper()
+	_, err := app.readings.InsertReading(context.Background(), TemperatureReadingPayload{
+		DeviceId: device, TempCo: tempCo, TempRoom: 18, Humidity: 50, Timestamp: &ts,
+	})
+	require.NoError(t, err)
 }
 
-func TestDataHandlerPOSTNilTimestamp(t *testing.T) {
-	db := setupTestDB(t)
-	app := &app{db: db, secretKey: "testsecret"}
-	require.NoError(t, app.applyMigrations(context.Background()))
+func TestDataHandlerPOST(t *testing.T) {
+	for _, driver := range readingDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			app := driver.setup(t)
+
+			body := `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0, "timestamp": 1761388101}`
+			req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Secret-Key", "testsecret")
+			w := httptest.NewRecorder()
 
-	body := `{"tempCo": 26.0, "tempRoom": 23.0, "humidity": 55.0}`
-	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Secret-Key", "testsecret")
-	w := httptest.NewRecorder()
+			app.dataHandler(w, req)
 
-	app.dataHandler(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			var resp TemperatureReading
+			err := json.NewDecoder(w.Body).Decode(&resp)
 
-	assert.Equal(t, http.StatusOK, w.Code)
-	var resp TemperatureReading
-	err := json.NewDecoder(w.Body).Decode(&resp)
+			assert.NoError(t, err)
+			assert.NotNil(t, resp.Id)
+			assert.Equal(t, defaultDeviceId, resp.DeviceId)
+			assert.Equal(t, 25.5, resp.TempCo)
+			assert.Equal(t, 22.0, resp.TempRoom)
+			assert.Equal(t, 60.0, resp.Humidity)
+			assert.Equal(t, int64(1761388101), *resp.Timestamp)
+		})
+	}
+}
 
-	assert.NoError(t, err)
-	assert.NotNil(t, resp.Id)
-	assert.Equal(t, 26.0, resp.TempCo)
-	assert.Equal(t, 23.0, resp.TempRoom)
-	assert.Equal(t, 55.0, resp.Humidity)
-	assert.NotNil(t, resp.Timestamp)
+func TestDataHandlerPOSTNilTimestamp(t *testing.T) {
+	for _, driver := range readingDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			app := driver.setup(t)
+
+			body := `{"tempCo": 26.0, "tempRoom": 23.0, "humidity": 55.0}`
+			req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Secret-Key", "testsecret")
+			w := httptest.NewRecorder()
+
+			app.dataHandler(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			var resp TemperatureReading
+			err := json.NewDecoder(w.Body).Decode(&resp)
+
+			assert.NoError(t, err)
+			assert.NotNil(t, resp.Id)
+			assert.Equal(t, 26.0, resp.TempCo)
+			assert.Equal(t, 23.0, resp.TempRoom)
+			assert.Equal(t, 55.0, resp.Humidity)
+			assert.NotNil(t, resp.Timestamp)
+		})
+	}
 }
 
 func TestDataHandlerGET(t *testing.T) {
-	db := setupTestDB(t)
-	app := &app{db: db, secretKey: "dummy"}
-	require.NoError(t, app.applyMigrations(context.Background()))
-
-	now := time.Now().UTC().Unix()
-	_, err := db.Exec(context.Background(), "INSERT INTO readings (temp_co, temp_room, humidity, timestamp) VALUES ($1, $2, $3, $4)", 27.0, 24.0, 50.0, now)
-	require.NoError(t, err)
+	for _, driver := range readingDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			app := driver.setup(t)
+			insertTestReading(t, app, defaultDeviceId, 27.0, time.Now().UTC().Unix())
 
-	req := httptest.NewRequest("GET", "/data", nil)
-	w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/data", nil)
+			w := httptest.NewRecorder()
 
-	app.dataHandler(w, req)
+			app.dataHandler(w, req)
 
-	assert.Equal(t, http.StatusOK, w.Code)
-	var resp []TemperatureReading
-	err = json.NewDecoder(w.Body).Decode(&resp)
+			assert.Equal(t, http.StatusOK, w.Code)
+			var resp []TemperatureReading
+			err := json.NewDecoder(w.Body).Decode(&resp)
 
-	assert.NoError(t, err)
-	assert.Greater(t, len(resp), 0)
+			assert.NoError(t, err)
+			assert.Greater(t, len(resp), 0)
+		})
+	}
 }
 
 func TestDataHandlerGETEmpty(t *testing.T) {
-	db := setupTestDB(t)
-	app := &app{db: db, secretKey: "dummy"}
-	require.NoError(t, app.applyMigrations(context.Background()))
-
-	_, err := db.Exec(context.Background(), "DELETE FROM readings")
-	require.NoError(t, err)
+	for _, driver := range readingDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			app := driver.setup(t)
 
-	req := httptest.NewRequest("GET", "/data", nil)
-	w := httptest.NewRecorder()
-
-	app.dataHandler(w, req)
+			req := httptest.NewRequest("GET", "/data", nil)
+			w := httptest.NewRecorder()
 
-	assert.Equal(t, http.StatusOK, w.Code)
-	var resp []TemperatureReading
-	err = json.NewDecoder(w.Body).Decode(&resp)
+			app.dataHandler(w, req)
 
-	assert.NoError(t, err)
-	assert.Equal(t, 0, len(resp))
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, `[]`, w.Body.String())
+		})
+	}
 }
 
 func TestDataHandlerPOSTInvalidAuth(t *testing.T) {
-	db := setupTestDB(t)
-	app := &app{db: db, secretKey: "testsecret"}
-	require.NoError(t, app.applyMigrations(context.Background()))
-
-	body := `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`
-	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Secret-Key", "wrongkey")
-	w := httptest.NewRecorder()
-
-	app.dataHandler(w, req)
-
-	assert.Equal(t, http.StatusForbidden, w.Code)
+	for _, driver := range readingDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			app := driver.setup(t)
+
+			// an unknown device key is refused like a wrong shared key
+			for _, key := range []string{"wrongkey", "esp_0123456789abcdef"} {
+				body := `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`
+				req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("X-Secret-Key", key)
+				w := httptest.NewRecorder()
+
+				app.dataHandler(w, req)
+
+				assert.Equal(t, http.StatusForbidden, w.Code, key)
+			}
+		})
+	}
 }
 
 func TestDataHandlerInvalidMethod(t *testing.T) {
@@ -216,29 +275,16 @@ func TestHomeHandler(t *testing.T) {
 }
 
 func TestDataHandlerGETWithTimestampFilter(t *testing.T) {
-	db := setupTestDB(t)
-	app := &app{db: db, secretKey: "dummy"}
-	require.NoError(t, app.applyMigrations(context.Background()))
-
 	// Insert test data with specific timestamps
 	baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
 	readings := []struct {
 		tempCo    float64
-		tempRoom  float64
-		humidity  float64
 		timestamp int64
 	}{
-		{20.0, 18.0, 50.0, baseTime - 1000},
-		{21.0, 19.0, 55.0, baseTime},
-		{22.0, 20.0, 60.0, baseTime + 1000},
-		{23.0, 21.0, 65.0, baseTime + 2000},
-	}
-
-	for _, r := range readings {
-		_, err := db.Exec(context.Background(),
-			"INSERT INTO readings (temp_co, temp_room, humidity, timestamp) VALUES ($1, $2, $3, $4)",
-			r.tempCo, r.tempRoom, r.humidity, r.timestamp)
-		require.NoError(t, err)
+		{20.0, baseTime - 1000},
+		{21.0, baseTime},
+		{22.0, baseTime + 1000},
+		{23.0, baseTime + 2000},
 	}
 
 	tests := []struct {
@@ -283,48 +329,69 @@ func TestDataHandlerGETWithTimestampFilter(t *testing.T) {
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest("GET", tt.queryURL, nil)
-			w := httptest.NewRecorder()
+	for _, driver := range readingDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			app := driver.setup(t)
+			for _, r := range readings {
+				insertTestReading(t, app, defaultDeviceId, r.tempCo, r.timestamp)
+			}
 
-			app.dataHandler(w, req)
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					req := httptest.NewRequest("GET", tt.queryURL, nil)
+					w := httptest.NewRecorder()
 
-			assert.Equal(t, http.StatusOK, w.Code)
-			var resp []TemperatureReading
-			err := json.NewDecoder(w.Body).Decode(&resp)
+					app.dataHandler(w, req)
 
-			assert.NoError(t, err)
-			assert.Equal(t, tt.expectLen, len(resp), "unexpected response length for query: %s", tt.queryURL)
+					assert.Equal(t, http.StatusOK, w.Code)
+					var resp []TemperatureReading
+					err := json.NewDecoder(w.Body).Decode(&resp)
+
+					assert.NoError(t, err)
+					assert.Equal(t, tt.expectLen, len(resp), "unexpected response length for query: %s", tt.queryURL)
+				})
+			}
 		})
 	}
 }
 
 func TestDataHandlerGETWithTimestampFilterAndPagination(t *testing.T) {
-	db := setupTestDB(t)
-	app := &app{db: db, secretKey: "dummy"}
-	require.NoError(t, app.applyMigrations(context.Background()))
-
-	// Insert test data with specific timestamps
 	baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
-	for i := 0; i < 10; i++ {
-		ts := baseTime + int64(i*1000)
-		_, err := db.Exec(context.Background(),
-			"INSERT INTO readings (temp_co, temp_room, humidity, timestamp) VALUES ($1, $2, $3, $4)",
-			20.0+float64(i), 18.0, 50.0, ts)
-		require.NoError(t, err)
+	tests := []struct {
+		queryURL string
+		tempCos  []float64
+	}{
+		{"/data?limit=2", []float64{29, 28}},
+		{fmt.Sprintf("/data?from=%d&to=%d", baseTime+1000, baseTime+3000), []float64{23, 22, 21}},
+		{fmt.Sprintf("/data?from=%d&limit=3&offset=1", baseTime), []float64{28, 27, 26}},
+		{"/data?device=esp-b&offset=3", []float64{23, 21}},
+		{"/data?from=invalid&limit=1", []float64{29}},
 	}
 
-	// Test filter + limit + offset
-	req := httptest.NewRequest("GET", fmt.Sprintf("/data?from=%d&limit=3&offset=1", baseTime), nil)
-	w := httptest.NewRecorder()
-
-	app.dataHandler(w, req)
-
-	assert.Equal(t, http.StatusOK, w.Code)
-	var resp []TemperatureReading
-	err := json.NewDecoder(w.Body).Decode(&resp)
-
-	assert.NoError(t, err)
-	assert.Equal(t, 3, len(resp))
+	for _, driver := range readingDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			app := driver.setup(t)
+			for i := range 10 {
+				device := "esp-a"
+				if i%2 == 1 {
+					device = "esp-b"
+				}
+				insertTestReading(t, app, device, 20.0+float64(i), baseTime+int64(i*1000))
+			}
+
+			for _, tt := range tests {
+				req := httptest.NewRequest("GET", tt.queryURL, nil)
+				w := httptest.NewRecorder()
+				app.dataHandler(w, req)
+				require.Equal(t, http.StatusOK, w.Code, tt.queryURL)
+				var resp []TemperatureReading
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				var tempCos []float64
+				for _, tr := range resp {
+					tempCos = append(tempCos, tr.TempCo)
+				}
+				assert.Equal(t, tt.tempCos, tempCos, tt.queryURL)
+			}
+		})
+	}
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Ingest sources, the source label of the ingest counters
+const (
+	ingestHTTP      = "http"
+	ingestBatch     = "batch"
+	ingestMQTT      = "mqtt"
+	ingestWebSocket = "websocket"
+)
+
+// Ingest failure reasons that aren't an error of the reading itself
+const (
+	reasonBadRequest    = "bad_request"
+	reasonBatchTooLarge = "batch_too_large"
+	reasonBodyTooLarge  = "body_too_large"
+	reasonAuthBackend   = "auth_backend"
+	reasonDatabase      = "database"
+	reasonRateLimited   = "rate_limited"
+)
+
+var (
+	lastTempCo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esp8266_temp_co_celsius",
+		Help: "Latest boiler (CO) temperature reported by a device.",
+	}, []string{"device"})
+	lastTempRoom = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esp8266_temp_room_celsius",
+		Help: "Latest room temperature reported by a device.",
+	}, []string{"device"})
+	lastHumidity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esp8266_humidity_percent",
+		Help: "Latest relative humidity reported by a device.",
+	}, []string{"device"})
+	lastReadingTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esp8266_last_reading_timestamp_seconds",
+		Help: "Unix timestamp of the latest reading of a device.",
+	}, []string{"device"})
+
+	ingestAccepted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_ingest_accepted_total",
+		Help: "Readings stored, by source.",
+	}, []string{"source"})
+	ingestRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_ingest_rejected_total",
+		Help: "Readings refused because of the request, by source and reason.",
+	}, []string{"source", "reason"})
+	ingestSuspect = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_ingest_suspect_total",
+		Help: "Readings stored flagged as suspect by validation, by source.",
+	}, []string{"source"})
+	ingestFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_ingest_failed_total",
+		Help: "Readings that couldn't be stored because of a server error, by source and reason.",
+	}, []string{"source", "reason"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_http_requests_total",
+		Help: "HTTP requests, by route pattern, method and status code.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "esp8266_http_request_duration_seconds",
+		Help:    "HTTP request duration, by route pattern, method and status code. Streams count until they close.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	httpRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esp8266_http_requests_in_flight",
+		Help: "HTTP requests being served, including open streams, by route pattern.",
+	}, []string{"route"})
+
+	dbInsertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "esp8266_db_insert_duration_seconds",
+		Help:    "Time taken to insert readings, by operation (single or batch).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+// latestTimestamps is the timestamp behind each device's gauges, so a
+// backfilled reading doesn't replace a newer value
+var latestTimestamps = struct {
+	sync.Mutex
+	devices map[string]int64
+}{devices: map[string]int64{}}
+
+// observeReading sets the gauges of the reading's device if it is the newest
+// seen
+func observeReading(tr TemperatureReading) {
+	latestTimestamps.Lock()
+	defer latestTimestamps.Unlock()
+	if latest, ok := latestTimestamps.devices[tr.DeviceId]; ok && *tr.Timestamp < latest {
+		return
+	}
+	latestTimestamps.devices[tr.DeviceId] = *tr.Timestamp
+	lastTempCo.WithLabelValues(tr.DeviceId).Set(tr.TempCo)
+	lastTempRoom.WithLabelValues(tr.DeviceId).Set(tr.TempRoom)
+	lastHumidity.WithLabelValues(tr.DeviceId).Set(tr.Humidity)
+	lastReadingTimestamp.WithLabelValues(tr.DeviceId).Set(float64(*tr.Timestamp))
+}
+
+// forgetDeviceMetrics drops the gauges of a deleted device
+func forgetDeviceMetrics(device string) {
+	latestTimestamps.Lock()
+	defer latestTimestamps.Unlock()
+	delete(latestTimestamps.devices, device)
+	for _, g := range []*prometheus.GaugeVec{lastTempCo, lastTempRoom, lastHumidity, lastReadingTimestamp} {
+		g.DeleteLabelValues(device)
+	}
+}
+
+// rejectReason is the reason label of a reading refused with err
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, errInvalidKey):
+		return "invalid_key"
+	case errors.Is(err, errDeviceMismatch):
+		return "device_mismatch"
+	case errors.Is(err, errInvalidSignature):
+		return "invalid_signature"
+	case errors.Is(err, errStaleRequest):
+		return "stale_request"
+	case errors.Is(err, errReplayedNonce):
+		return "replayed_nonce"
+	case errors.Is(err, errClientCertRequired):
+		return "client_cert_required"
+	case errors.Is(err, errInvalidDeviceId):
+		return "invalid_device"
+	case errors.Is(err, errInvalidReading):
+		return "invalid_reading"
+	default:
+		return reasonBadRequest
+	}
+}
+
+// observeAccepted counts a stored reading, and whether it was flagged suspect
+func observeAccepted(source string, tr TemperatureReading) {
+	ingestAccepted.WithLabelValues(source).Inc()
+	if tr.Quality == qualitySuspect {
+		ingestSuspect.WithLabelValues(source).Inc()
+	}
+}
+
+func observeInsert(operation string, start time.Time) {
+	dbInsertDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// metricMethod bounds the method label to the standard methods
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserveReading(t *testing.T) {
+	t.Cleanup(func() { forgetDeviceMetrics("esp-metrics") })
+	ts, older := int64(1761388101), int64(1761388000)
+
+	observeReading(TemperatureReading{DeviceId: "esp-metrics", TempCo: 60, TempRoom: 21, Humidity: 40, Timestamp: &ts})
+	// a backfilled reading doesn't replace the newer one
+	observeReading(TemperatureReading{DeviceId: "esp-metrics", TempCo: 55, TempRoom: 20, Humidity: 45, Timestamp: &older})
+
+	assert.Equal(t, 60.0, testutil.ToFloat64(lastTempCo.WithLabelValues("esp-metrics")))
+	assert.Equal(t, 21.0, testutil.ToFloat64(lastTempRoom.WithLabelValues("esp-metrics")))
+	assert.Equal(t, 40.0, testutil.ToFloat64(lastHumidity.WithLabelValues("esp-metrics")))
+	assert.Equal(t, float64(ts), testutil.ToFloat64(lastReadingTimestamp.WithLabelValues("esp-metrics")))
+
+	forgetDeviceMetrics("esp-metrics")
+	assert.False(t, lastTempCo.DeleteLabelValues("esp-metrics"), "gauge already deleted")
+}
+
+func TestDataHandlerIngestMetrics(t *testing.T) {
+	t.Cleanup(func() { forgetDeviceMetrics("esp-ingest") })
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret"}
+	accepted := testutil.ToFloat64(ingestAccepted.WithLabelValues(ingestHTTP))
+	invalidKey := testutil.ToFloat64(ingestRejected.WithLabelValues(ingestHTTP, "invalid_key"))
+	badRequest := testutil.ToFloat64(ingestRejected.WithLabelValues(ingestHTTP, reasonBadRequest))
+
+	for _, tc := range []struct {
+		key  string
+		body string
+		code int
+	}{
+		{"testsecret", `{"deviceId": "esp-ingest", "tempCo": 61.5, "tempRoom": 22.0, "humidity": 60.0, "timestamp": 1761388101}`, http.StatusOK},
+		{"wrongkey", `{"deviceId": "esp-ingest", "tempCo": 61.5}`, http.StatusForbidden},
+		{"testsecret", `{"tempCo": "hot"}`, http.StatusUnprocessableEntity},
+	} {
+		req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(tc.body)))
+		req.Header.Set("X-Secret-Key", tc.key)
+		w := httptest.NewRecorder()
+		app.dataHandler(w, req)
+		assert.Equal(t, tc.code, w.Code, tc.body)
+	}
+
+	assert.Equal(t, accepted+1, testutil.ToFloat64(ingestAccepted.WithLabelValues(ingestHTTP)))
+	assert.Equal(t, invalidKey+1, testutil.ToFloat64(ingestRejected.WithLabelValues(ingestHTTP, "invalid_key")))
+	assert.Equal(t, badRequest+1, testutil.ToFloat64(ingestRejected.WithLabelValues(ingestHTTP, reasonBadRequest)))
+	assert.Equal(t, 61.5, testutil.ToFloat64(lastTempCo.WithLabelValues("esp-ingest")))
+	assert.Positive(t, testutil.CollectAndCount(dbInsertDuration))
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/items/{id}", metricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 1.0, testutil.ToFloat64(httpRequestsInFlight.WithLabelValues("/items/{id}")))
+		http.Error(w, "Not found", http.StatusNotFound)
+	})))
+	mux.Handle("/", metricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	mux.Handle("/boom", panicRecoveryMiddleware(slog.Default())(metricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))))
+
+	notFound := testutil.ToFloat64(httpRequests.WithLabelValues("/items/{id}", "GET", "404"))
+	fallback := testutil.ToFloat64(httpRequests.WithLabelValues("/", "GET", "200"))
+	other := testutil.ToFloat64(httpRequests.WithLabelValues("/", "OTHER", "200"))
+	panicked := testutil.ToFloat64(httpRequests.WithLabelValues("/boom", "POST", "500"))
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/items/1", nil),
+		httptest.NewRequest("GET", "/items/2", nil),
+		httptest.NewRequest("GET", "/some/spa/page", nil),
+		httptest.NewRequest("GET", "/another", nil),
+		httptest.NewRequest("BREW", "/pot", nil),
+		httptest.NewRequest("POST", "/boom", nil),
+	} {
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, notFound+2, testutil.ToFloat64(httpRequests.WithLabelValues("/items/{id}", "GET", "404")))
+	assert.Equal(t, fallback+2, testutil.ToFloat64(httpRequests.WithLabelValues("/", "GET", "200")))
+	assert.Equal(t, other+1, testutil.ToFloat64(httpRequests.WithLabelValues("/", "OTHER", "200")))
+	assert.Equal(t, panicked+1, testutil.ToFloat64(httpRequests.WithLabelValues("/boom", "POST", "500")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(httpRequestsInFlight.WithLabelValues("/items/{id}")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(httpRequestsInFlight.WithLabelValues("/boom")))
+}
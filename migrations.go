@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migrations are numbered NNNN_name.up.sql with a matching NNNN_name.down.sql,
+// migrations/ for Postgres and migrations/sqlite/ for SQLite. Both keep the
+// same numbering so a schema version means the same on either.
+//
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the advisory lock held while migrating, so replicas
+// starting together apply each migration once
+const migrationLockKey int64 = 8266
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+type appliedMigration struct {
+	version   int
+	name      string
+	appliedAt int64
+}
+
+// migrator applies migrations to one kind of database
+type migrator interface {
+	// dir holds the migrations in migrationFiles
+	dir() string
+	// lock keeps other processes from migrating until unlock is called, and
+	// creates schema_migrations if needed
+	lock(ctx context.Context) (unlock func(), err error)
+	applied(ctx context.Context) ([]appliedMigration, error)
+	// apply runs the up or down SQL of m in a transaction, recording it in
+	// schema_migrations
+	apply(ctx context.Context, m migration, up bool) error
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, file := range files {
+		base := path.Base(file)
+		stem, direction, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: name must end in .up.sql or .down.sql", base)
+		}
+		num, name, _ := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(num)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version", base)
+		}
+		sql, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, m.name, name)
+		}
+		if direction == "up" {
+			m.up = string(sql)
+		} else {
+			m.down = string(sql)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+type pgMigrator struct {
+	db   *pgxpool.Pool
+	conn *pgxpool.Conn
+}
+
+func (m *pgMigrator) dir() string { return "migrations" }
+
+// lock takes the advisory lock on a connection kept until unlock, the lock
+// belongs to the session
+func (m *pgMigrator) lock(ctx context.Context) (func(), error) {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		conn.Release()
+		return nil, err
+	}
+	unlock := func() {
+		conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+		conn.Release()
+		m.conn = nil
+	}
+	_, err = conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at BIGINT NOT NULL
+		)
+	`)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	m.conn = conn
+	return unlock, nil
+}
+
+func (m *pgMigrator) applied(ctx context.Context) ([]appliedMigration, error) {
+	rows, err := m.conn.Query(ctx, `SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (appliedMigration, error) {
+		var a appliedMigration
+		err := row.Scan(&a.version, &a.name, &a.appliedAt)
+		return a, err
+	})
+}
+
+func (m *pgMigrator) apply(ctx context.Context, mig migration, up bool) error {
+	return pgx.BeginFunc(ctx, m.conn, func(tx pgx.Tx) error {
+		if !up {
+			if _, err := tx.Exec(ctx, mig.down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, mig.version)
+			return err
+		}
+		if _, err := tx.Exec(ctx, mig.up); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+			mig.version, mig.name, time.Now().UTC().Unix())
+		return err
+	})
+}
+
+// migrator returns the migrator of the database readings are kept in, nil
+// without one
+func (a *app) migrator() migrator {
+	if s, ok := a.readings.(*sqliteReadingStore); ok {
+		return &sqliteMigrator{db: s.db}
+	}
+	if a.db != nil {
+		return &pgMigrator{db: a.db}
+	}
+	return nil
+}
+
+// migrationState loads the migrations and the current schema version with the
+// migration lock held, the caller must call unlock.
+func (a *app) migrationState(ctx context.Context) (migrator, []migration, []appliedMigration, func(), error) {
+	m := a.migrator()
+	if m == nil {
+		return nil, nil, nil, nil, fmt.Errorf("no database to migrate")
+	}
+	migrations, err := loadMigrations(migrationFiles, m.dir())
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		unlock()
+		return nil, nil, nil, nil, err
+	}
+	if len(applied) > len(migrations) {
+		unlock()
+		return nil, nil, nil, nil, fmt.Errorf("database is at schema version %d, newer than this binary knows (%d)", len(applied), len(migrations))
+	}
+	// the schema version is the number of applied migrations, which only
+	// holds while they are the first ones of this binary
+	for i, am := range applied {
+		if mig := migrations[i]; am.version != mig.version || am.name != mig.name {
+			unlock()
+			return nil, nil, nil, nil, fmt.Errorf("database has migration %04d_%s applied where this binary has %04d_%s, refusing to migrate", am.version, am.name, mig.version, mig.name)
+		}
+	}
+	return m, migrations, applied, unlock, nil
+}
+
+// migrateUp applies every pending migration up to target, all of them if
+// target is 0. Each migration runs in its own transaction.
+func (a *app) migrateUp(ctx context.Context, target int) error {
+	m, migrations, applied, unlock, err := a.migrationState(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if target == 0 {
+		target = len(migrations)
+	}
+	if target > len(migrations) {
+		return fmt.Errorf("no migration %d, the latest is %d", target, len(migrations))
+	}
+	for _, mig := range migrations[min(len(applied), target):target] {
+		slog.Info("Applying migration", "version", mig.version, "name", mig.name)
+		if err := m.apply(ctx, mig, true); err != nil {
+			return fmt.Errorf("migration %d_%s: %w", mig.version, mig.name, err)
+		}
+	}
+	return nil
+}
+
+// migrateDown rolls back the latest steps migrations
+func (a *app) migrateDown(ctx context.Context, steps int) error {
+	m, migrations, applied, unlock, err := a.migrationState(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for current := len(applied); steps > 0 && current > 0; steps, current = steps-1, current-1 {
+		mig := migrations[current-1]
+		if mig.down == "" {
+			return fmt.Errorf("migration %d_%s can't be rolled back", mig.version, mig.name)
+		}
+		slog.Info("Rolling back migration", "version", mig.version, "name", mig.name)
+		if err := m.apply(ctx, mig, false); err != nil {
+			return fmt.Errorf("migration %d_%s: %w", mig.version, mig.name, err)
+		}
+	}
+	return nil
+}
+
+func (a *app) applyMigrations(ctx context.Context) error {
+	// the memory store has no schema
+	if a.migrator() == nil {
+		return nil
+	}
+	slog.Debug("Applying migrations")
+	if err := a.migrateUp(ctx, 0); err != nil {
+		return err
+	}
+	slog.Debug("Migrations applied successfully")
+	return nil
+}
+
+// schemaVersion is the latest migration applied to the database, 0 if none
+func (a *app) schemaVersion(ctx context.Context) (int, error) {
+	var version int
+	var err error
+	switch m := a.migrator().(type) {
+	case *sqliteMigrator:
+		err = m.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	case *pgMigrator:
+		err = m.db.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	default:
+		err = fmt.Errorf("no database")
+	}
+	return version, err
+}
+
+func (a *app) migrateCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: migrate status|up|down [n]")
+	}
+	n := 0
+	if len(args) > 1 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 0 {
+			return fmt.Errorf("invalid number %q", args[1])
+		}
+	}
+	switch args[0] {
+	case "status":
+		_, migrations, applied, unlock, err := a.migrationState(ctx)
+		if err != nil {
+			return err
+		}
+		unlock()
+		appliedAt := map[int]int64{}
+		for _, m := range applied {
+			appliedAt[m.version] = m.appliedAt
+		}
+		for _, m := range migrations {
+			status := "pending"
+			if ts, ok := appliedAt[m.version]; ok {
+				status = "applied " + time.Unix(ts, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d\t%s\t%s\n", m.version, m.name, status)
+		}
+		return nil
+	case "up":
+		return a.migrateUp(ctx, n)
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		return a.migrateDown(ctx, n)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,15 @@
+-- IF NOT EXISTS lets databases created before versioned migrations adopt them
+CREATE TABLE IF NOT EXISTS readings (
+	id SERIAL PRIMARY KEY,
+	temp_co DOUBLE PRECISION,
+	temp_room DOUBLE PRECISION,
+	timestamp BIGINT,
+	created_at TIMESTAMP DEFAULT NOW()
+);
+ALTER TABLE readings ADD COLUMN IF NOT EXISTS humidity DOUBLE PRECISION NOT NULL DEFAULT 0.0;
+ALTER TABLE readings ALTER COLUMN temp_co SET DEFAULT 0.0;
+ALTER TABLE readings ALTER COLUMN temp_co SET NOT NULL;
+ALTER TABLE readings ALTER COLUMN temp_room SET DEFAULT 0.0;
+ALTER TABLE readings ALTER COLUMN temp_room SET NOT NULL;
+ALTER TABLE readings ALTER COLUMN timestamp SET DEFAULT 0;
+ALTER TABLE readings ALTER COLUMN timestamp SET NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE readings DROP COLUMN device_id;
+DROP TABLE devices;
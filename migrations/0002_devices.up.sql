@@ -0,0 +1,13 @@
+-- Readings stored before devices existed are attributed to the default device
+CREATE TABLE IF NOT EXISTS devices (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL DEFAULT '',
+	location TEXT NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL DEFAULT 0,
+	last_seen_at BIGINT
+);
+INSERT INTO devices (id, name, created_at, last_seen_at)
+VALUES ('default', 'Default device', EXTRACT(EPOCH FROM NOW())::BIGINT, (SELECT MAX(timestamp) FROM readings))
+ON CONFLICT (id) DO NOTHING;
+ALTER TABLE readings ADD COLUMN IF NOT EXISTS device_id TEXT NOT NULL DEFAULT 'default' REFERENCES devices (id);
+CREATE INDEX IF NOT EXISTS readings_device_id_timestamp_idx ON readings (device_id, timestamp DESC);
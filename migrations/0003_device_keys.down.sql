@@ -0,0 +1,2 @@
+DROP TABLE ingest_nonces;
+DROP TABLE device_keys;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS device_keys (
+	id SERIAL PRIMARY KEY,
+	device_id TEXT NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+	key_hash TEXT NOT NULL UNIQUE,
+	prefix TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	revoked_at BIGINT
+);
+CREATE TABLE IF NOT EXISTS ingest_nonces (
+	device_id TEXT NOT NULL,
+	nonce TEXT NOT NULL,
+	seen_at BIGINT NOT NULL,
+	PRIMARY KEY (device_id, nonce)
+);
+CREATE INDEX IF NOT EXISTS ingest_nonces_seen_at_idx ON ingest_nonces (seen_at);
@@ -0,0 +1 @@
+DROP INDEX readings_timestamp_idx;
@@ -0,0 +1,2 @@
+-- Queries by time across every device
+CREATE INDEX IF NOT EXISTS readings_timestamp_idx ON readings (timestamp);
@@ -0,0 +1,3 @@
+DROP TABLE alert_states;
+DROP TABLE alert_events;
+DROP TABLE alert_rules;
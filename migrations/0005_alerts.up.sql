@@ -0,0 +1,36 @@
+-- Alert events keep a copy of their rule so history survives deleting it
+CREATE TABLE IF NOT EXISTS alert_rules (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	device_id TEXT REFERENCES devices (id) ON DELETE CASCADE,
+	metric TEXT NOT NULL,
+	comparator TEXT NOT NULL,
+	threshold DOUBLE PRECISION NOT NULL,
+	duration BIGINT NOT NULL DEFAULT 0,
+	hysteresis DOUBLE PRECISION NOT NULL DEFAULT 0,
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS alert_events (
+	id SERIAL PRIMARY KEY,
+	rule_id INTEGER REFERENCES alert_rules (id) ON DELETE SET NULL,
+	rule_name TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	metric TEXT NOT NULL,
+	comparator TEXT NOT NULL,
+	threshold DOUBLE PRECISION NOT NULL,
+	value DOUBLE PRECISION NOT NULL,
+	fired_at BIGINT NOT NULL,
+	resolved_at BIGINT,
+	resolved_value DOUBLE PRECISION
+);
+CREATE INDEX IF NOT EXISTS alert_events_fired_at_idx ON alert_events (fired_at DESC);
+CREATE TABLE IF NOT EXISTS alert_states (
+	rule_id INTEGER NOT NULL REFERENCES alert_rules (id) ON DELETE CASCADE,
+	device_id TEXT NOT NULL,
+	state TEXT NOT NULL,
+	pending_since BIGINT,
+	event_id INTEGER REFERENCES alert_events (id) ON DELETE SET NULL,
+	last_timestamp BIGINT NOT NULL,
+	PRIMARY KEY (rule_id, device_id)
+);
@@ -0,0 +1,4 @@
+DROP TRIGGER readings_rollup ON readings;
+DROP FUNCTION readings_rollup();
+DROP TABLE readings_daily;
+DROP TABLE readings_hourly;
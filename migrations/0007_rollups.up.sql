@@ -0,0 +1,92 @@
+-- Rollups keep sums rather than averages so a late reading can be folded
+-- into its bucket. Rows are bucketed by UTC hour and day, and are kept when
+-- retention prunes the readings they summarise.
+CREATE TABLE readings_hourly (
+	device_id TEXT NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+	bucket_start BIGINT NOT NULL,
+	count BIGINT NOT NULL,
+	temp_co_sum DOUBLE PRECISION NOT NULL,
+	temp_co_min DOUBLE PRECISION NOT NULL,
+	temp_co_max DOUBLE PRECISION NOT NULL,
+	temp_room_sum DOUBLE PRECISION NOT NULL,
+	temp_room_min DOUBLE PRECISION NOT NULL,
+	temp_room_max DOUBLE PRECISION NOT NULL,
+	humidity_sum DOUBLE PRECISION NOT NULL,
+	humidity_min DOUBLE PRECISION NOT NULL,
+	humidity_max DOUBLE PRECISION NOT NULL,
+	PRIMARY KEY (device_id, bucket_start)
+);
+CREATE TABLE readings_daily (
+	device_id TEXT NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+	bucket_start BIGINT NOT NULL,
+	count BIGINT NOT NULL,
+	temp_co_sum DOUBLE PRECISION NOT NULL,
+	temp_co_min DOUBLE PRECISION NOT NULL,
+	temp_co_max DOUBLE PRECISION NOT NULL,
+	temp_room_sum DOUBLE PRECISION NOT NULL,
+	temp_room_min DOUBLE PRECISION NOT NULL,
+	temp_room_max DOUBLE PRECISION NOT NULL,
+	humidity_sum DOUBLE PRECISION NOT NULL,
+	humidity_min DOUBLE PRECISION NOT NULL,
+	humidity_max DOUBLE PRECISION NOT NULL,
+	PRIMARY KEY (device_id, bucket_start)
+);
+CREATE INDEX readings_hourly_bucket_start_idx ON readings_hourly (bucket_start);
+CREATE INDEX readings_daily_bucket_start_idx ON readings_daily (bucket_start);
+
+INSERT INTO readings_hourly (device_id, bucket_start, count, temp_co_sum, temp_co_min, temp_co_max, temp_room_sum, temp_room_min, temp_room_max, humidity_sum, humidity_min, humidity_max)
+SELECT device_id, timestamp - timestamp % 3600, COUNT(*),
+	SUM(temp_co), MIN(temp_co), MAX(temp_co),
+	SUM(temp_room), MIN(temp_room), MAX(temp_room),
+	SUM(humidity), MIN(humidity), MAX(humidity)
+FROM readings
+GROUP BY 1, 2;
+
+INSERT INTO readings_daily (device_id, bucket_start, count, temp_co_sum, temp_co_min, temp_co_max, temp_room_sum, temp_room_min, temp_room_max, humidity_sum, humidity_min, humidity_max)
+SELECT device_id, timestamp - timestamp % 86400, COUNT(*),
+	SUM(temp_co), MIN(temp_co), MAX(temp_co),
+	SUM(temp_room), MIN(temp_room), MAX(temp_room),
+	SUM(humidity), MIN(humidity), MAX(humidity)
+FROM readings
+GROUP BY 1, 2;
+
+CREATE FUNCTION readings_rollup() RETURNS TRIGGER AS $$
+BEGIN
+	INSERT INTO readings_hourly AS r (device_id, bucket_start, count, temp_co_sum, temp_co_min, temp_co_max, temp_room_sum, temp_room_min, temp_room_max, humidity_sum, humidity_min, humidity_max)
+	VALUES (NEW.device_id, NEW.timestamp - NEW.timestamp % 3600, 1,
+		NEW.temp_co, NEW.temp_co, NEW.temp_co,
+		NEW.temp_room, NEW.temp_room, NEW.temp_room,
+		NEW.humidity, NEW.humidity, NEW.humidity)
+	ON CONFLICT (device_id, bucket_start) DO UPDATE SET
+		count = r.count + 1,
+		temp_co_sum = r.temp_co_sum + EXCLUDED.temp_co_sum,
+		temp_co_min = LEAST(r.temp_co_min, EXCLUDED.temp_co_min),
+		temp_co_max = GREATEST(r.temp_co_max, EXCLUDED.temp_co_max),
+		temp_room_sum = r.temp_room_sum + EXCLUDED.temp_room_sum,
+		temp_room_min = LEAST(r.temp_room_min, EXCLUDED.temp_room_min),
+		temp_room_max = GREATEST(r.temp_room_max, EXCLUDED.temp_room_max),
+		humidity_sum = r.humidity_sum + EXCLUDED.humidity_sum,
+		humidity_min = LEAST(r.humidity_min, EXCLUDED.humidity_min),
+		humidity_max = GREATEST(r.humidity_max, EXCLUDED.humidity_max);
+	INSERT INTO readings_daily AS r (device_id, bucket_start, count, temp_co_sum, temp_co_min, temp_co_max, temp_room_sum, temp_room_min, temp_room_max, humidity_sum, humidity_min, humidity_max)
+	VALUES (NEW.device_id, NEW.timestamp - NEW.timestamp % 86400, 1,
+		NEW.temp_co, NEW.temp_co, NEW.temp_co,
+		NEW.temp_room, NEW.temp_room, NEW.temp_room,
+		NEW.humidity, NEW.humidity, NEW.humidity)
+	ON CONFLICT (device_id, bucket_start) DO UPDATE SET
+		count = r.count + 1,
+		temp_co_sum = r.temp_co_sum + EXCLUDED.temp_co_sum,
+		temp_co_min = LEAST(r.temp_co_min, EXCLUDED.temp_co_min),
+		temp_co_max = GREATEST(r.temp_co_max, EXCLUDED.temp_co_max),
+		temp_room_sum = r.temp_room_sum + EXCLUDED.temp_room_sum,
+		temp_room_min = LEAST(r.temp_room_min, EXCLUDED.temp_room_min),
+		temp_room_max = GREATEST(r.temp_room_max, EXCLUDED.temp_room_max),
+		humidity_sum = r.humidity_sum + EXCLUDED.humidity_sum,
+		humidity_min = LEAST(r.humidity_min, EXCLUDED.humidity_min),
+		humidity_max = GREATEST(r.humidity_max, EXCLUDED.humidity_max);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER readings_rollup AFTER INSERT ON readings
+FOR EACH ROW EXECUTE FUNCTION readings_rollup();
@@ -0,0 +1,5 @@
+DROP TRIGGER readings_rollup ON readings;
+CREATE TRIGGER readings_rollup AFTER INSERT ON readings
+FOR EACH ROW EXECUTE FUNCTION readings_rollup();
+
+ALTER TABLE readings DROP COLUMN quality;
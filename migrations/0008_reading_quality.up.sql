@@ -0,0 +1,7 @@
+-- Readings outside the configured valid ranges may be stored as suspect
+-- rather than rejected. Suspect readings are left out of the rollups.
+ALTER TABLE readings ADD COLUMN quality TEXT NOT NULL DEFAULT 'good';
+
+DROP TRIGGER readings_rollup ON readings;
+CREATE TRIGGER readings_rollup AFTER INSERT ON readings
+FOR EACH ROW WHEN (NEW.quality = 'good') EXECUTE FUNCTION readings_rollup();
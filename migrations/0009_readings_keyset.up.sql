@@ -0,0 +1,5 @@
+-- GET /data pages by (timestamp, id), the id breaks timestamp ties
+DROP INDEX readings_timestamp_idx;
+CREATE INDEX readings_timestamp_id_idx ON readings (timestamp, id);
+DROP INDEX readings_device_id_timestamp_idx;
+CREATE INDEX readings_device_id_timestamp_id_idx ON readings (device_id, timestamp DESC, id DESC);
@@ -0,0 +1,8 @@
+CREATE TABLE readings (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	temp_co DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+	temp_room DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+	timestamp BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	humidity DOUBLE PRECISION NOT NULL DEFAULT 0.0
+);
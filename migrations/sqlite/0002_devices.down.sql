@@ -0,0 +1,13 @@
+CREATE TABLE readings_old (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	temp_co DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+	temp_room DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+	timestamp BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	humidity DOUBLE PRECISION NOT NULL DEFAULT 0.0
+);
+INSERT INTO readings_old (id, temp_co, temp_room, timestamp, created_at, humidity)
+SELECT id, temp_co, temp_room, timestamp, created_at, humidity FROM readings;
+DROP TABLE readings;
+ALTER TABLE readings_old RENAME TO readings;
+DROP TABLE devices;
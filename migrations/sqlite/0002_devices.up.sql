@@ -0,0 +1,26 @@
+-- Readings stored before devices existed are attributed to the default device
+CREATE TABLE devices (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL DEFAULT '',
+	location TEXT NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL DEFAULT 0,
+	last_seen_at BIGINT
+);
+INSERT INTO devices (id, name, created_at, last_seen_at)
+VALUES ('default', 'Default device', CAST(strftime('%s', 'now') AS INTEGER), (SELECT MAX(timestamp) FROM readings));
+-- SQLite can't add a column with both a foreign key and a default, so the
+-- table is rebuilt
+CREATE TABLE readings_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	temp_co DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+	temp_room DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+	timestamp BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	humidity DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+	device_id TEXT NOT NULL DEFAULT 'default' REFERENCES devices (id)
+);
+INSERT INTO readings_new (id, temp_co, temp_room, timestamp, created_at, humidity)
+SELECT id, temp_co, temp_room, timestamp, created_at, humidity FROM readings;
+DROP TABLE readings;
+ALTER TABLE readings_new RENAME TO readings;
+CREATE INDEX readings_device_id_timestamp_idx ON readings (device_id, timestamp DESC);
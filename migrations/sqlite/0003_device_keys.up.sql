@@ -0,0 +1,2 @@
+-- Device keys and signed request nonces need Postgres, the SQLite driver
+-- only accepts the shared secret key. Kept so versions match migrations/.
@@ -0,0 +1,2 @@
+-- Queries by time across every device
+CREATE INDEX readings_timestamp_idx ON readings (timestamp);
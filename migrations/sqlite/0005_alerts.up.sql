@@ -0,0 +1 @@
+-- Alerts need Postgres. Kept so versions match migrations/.
@@ -0,0 +1 @@
+-- Webhooks need Postgres. Kept so versions match migrations/.
@@ -0,0 +1,3 @@
+DROP TRIGGER readings_rollup;
+DROP TABLE readings_daily;
+DROP TABLE readings_hourly;
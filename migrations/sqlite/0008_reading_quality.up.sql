@@ -0,0 +1,41 @@
+-- Readings outside the configured valid ranges may be stored as suspect
+-- rather than rejected. Suspect readings are left out of the rollups.
+ALTER TABLE readings ADD COLUMN quality TEXT NOT NULL DEFAULT 'good';
+
+DROP TRIGGER readings_rollup;
+CREATE TRIGGER readings_rollup AFTER INSERT ON readings
+WHEN NEW.quality = 'good'
+BEGIN
+	INSERT INTO readings_hourly (device_id, bucket_start, count, temp_co_sum, temp_co_min, temp_co_max, temp_room_sum, temp_room_min, temp_room_max, humidity_sum, humidity_min, humidity_max)
+	VALUES (NEW.device_id, NEW.timestamp - NEW.timestamp % 3600, 1,
+		NEW.temp_co, NEW.temp_co, NEW.temp_co,
+		NEW.temp_room, NEW.temp_room, NEW.temp_room,
+		NEW.humidity, NEW.humidity, NEW.humidity)
+	ON CONFLICT (device_id, bucket_start) DO UPDATE SET
+		count = count + 1,
+		temp_co_sum = temp_co_sum + EXCLUDED.temp_co_sum,
+		temp_co_min = MIN(temp_co_min, EXCLUDED.temp_co_min),
+		temp_co_max = MAX(temp_co_max, EXCLUDED.temp_co_max),
+		temp_room_sum = temp_room_sum + EXCLUDED.temp_room_sum,
+		temp_room_min = MIN(temp_room_min, EXCLUDED.temp_room_min),
+		temp_room_max = MAX(temp_room_max, EXCLUDED.temp_room_max),
+		humidity_sum = humidity_sum + EXCLUDED.humidity_sum,
+		humidity_min = MIN(humidity_min, EXCLUDED.humidity_min),
+		humidity_max = MAX(humidity_max, EXCLUDED.humidity_max);
+	INSERT INTO readings_daily (device_id, bucket_start, count, temp_co_sum, temp_co_min, temp_co_max, temp_room_sum, temp_room_min, temp_room_max, humidity_sum, humidity_min, humidity_max)
+	VALUES (NEW.device_id, NEW.timestamp - NEW.timestamp % 86400, 1,
+		NEW.temp_co, NEW.temp_co, NEW.temp_co,
+		NEW.temp_room, NEW.temp_room, NEW.temp_room,
+		NEW.humidity, NEW.humidity, NEW.humidity)
+	ON CONFLICT (device_id, bucket_start) DO UPDATE SET
+		count = count + 1,
+		temp_co_sum = temp_co_sum + EXCLUDED.temp_co_sum,
+		temp_co_min = MIN(temp_co_min, EXCLUDED.temp_co_min),
+		temp_co_max = MAX(temp_co_max, EXCLUDED.temp_co_max),
+		temp_room_sum = temp_room_sum + EXCLUDED.temp_room_sum,
+		temp_room_min = MIN(temp_room_min, EXCLUDED.temp_room_min),
+		temp_room_max = MAX(temp_room_max, EXCLUDED.temp_room_max),
+		humidity_sum = humidity_sum + EXCLUDED.humidity_sum,
+		humidity_min = MIN(humidity_min, EXCLUDED.humidity_min),
+		humidity_max = MAX(humidity_max, EXCLUDED.humidity_max);
+END;
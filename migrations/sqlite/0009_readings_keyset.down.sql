@@ -0,0 +1,4 @@
+DROP INDEX readings_device_id_timestamp_id_idx;
+CREATE INDEX readings_device_id_timestamp_idx ON readings (device_id, timestamp DESC);
+DROP INDEX readings_timestamp_id_idx;
+CREATE INDEX readings_timestamp_idx ON readings (timestamp);
@@ -0,0 +1,2 @@
+-- Set once a device is reported offline, cleared by its next reading
+ALTER TABLE devices ADD COLUMN offline_at BIGINT;
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version)
+		assert.NotEmpty(t, m.up, m.name)
+		assert.NotEmpty(t, m.down, m.name)
+	}
+
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/0001_a.up.sql": {Data: []byte("SELECT 1")},
+		"migrations/0003_c.up.sql": {Data: []byte("SELECT 1")},
+	}, "migrations")
+	assert.ErrorContains(t, err, "migration 2 is missing")
+
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/0001_a.sql": {Data: []byte("SELECT 1")},
+	}, "migrations")
+	assert.Error(t, err)
+
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/0001_a.down.sql": {Data: []byte("SELECT 1")},
+	}, "migrations")
+	assert.ErrorContains(t, err, "no up file")
+}
+
+func TestMigrateDownUp(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db}
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	require.NoError(t, err)
+
+	// replicas starting together
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Go(func() { errs[i] = app.applyMigrations(context.Background()) })
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	version, err := app.schemaVersion(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	require.NoError(t, app.migrateDown(context.Background(), len(migrations)))
+	version, err = app.schemaVersion(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+	var exists bool
+	err = db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'readings')").Scan(&exists)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, app.migrateUp(context.Background(), 2))
+	version, err = app.schemaVersion(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, version)
+
+	require.NoError(t, app.migrateCommand(context.Background(), []string{"up"}))
+	version, err = app.schemaVersion(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+}
+
+// Databases created before versioned migrations already have the tables
+func TestMigrateLegacyDatabase(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db}
+
+	_, err := db.Exec(context.Background(), `
+		CREATE TABLE readings (
+			id SERIAL PRIMARY KEY,
+			temp_co DOUBLE PRECISION,
+			temp_room DOUBLE PRECISION,
+			timestamp BIGINT,
+			created_at TIMESTAMP DEFAULT NOW()
+		);
+		INSERT INTO readings (temp_co, temp_room, timestamp) VALUES (25.5, 22.0, 1761388101)
+	`)
+	require.NoError(t, err)
+
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	var deviceId string
+	require.NoError(t, db.QueryRow(context.Background(), "SELECT device_id FROM readings").Scan(&deviceId))
+	assert.Equal(t, defaultDeviceId, deviceId)
+}
+
+func TestHealthHandlerSchemaVersion(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db}
+	require.NoError(t, app.applyMigrations(context.Background()))
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+
+	app.healthHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok", "schemaVersion": `+strconv.Itoa(len(migrations))+`}`, w.Body.String())
+}
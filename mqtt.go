@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttInsertTimeout = 10 * time.Second
+
+type mqttConfig struct {
+	broker   string
+	topic    string
+	clientId string
+	username string
+	password string
+}
+
+// deviceFromTopic returns the topic level matched by the first single level
+// wildcard of pattern, e.g. "esp-a" for pattern "esp/+/readings" and topic
+// "esp/esp-a/readings". It returns "" if the pattern has no "+".
+func deviceFromTopic(pattern, topic string) string {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range patternLevels {
+		if level == "+" && i < len(topicLevels) {
+			return topicLevels[i]
+		}
+	}
+	return ""
+}
+
+// handleMQTTMessage stores a reading published on topic. The device in the
+// topic takes the place of an authenticated key, so a payload naming another
+// device is rejected just like on POST /data. Without a device in the topic
+// nothing vouches for the payload's, and the message is rejected.
+func (a *app) handleMQTTMessage(ctx context.Context, pattern, topic string, payload []byte) (TemperatureReading, error) {
+	deviceId := deviceFromTopic(pattern, topic)
+	if deviceId == "" {
+		ingestRejected.WithLabelValues(ingestMQTT, rejectReason(errInvalidDeviceId)).Inc()
+		return TemperatureReading{}, fmt.Errorf("no device in topic %q: %w", topic, errInvalidDeviceId)
+	}
+	var tri TemperatureReadingPayload
+	if err := json.Unmarshal(payload, &tri); err != nil {
+		ingestRejected.WithLabelValues(ingestMQTT, reasonBadRequest).Inc()
+		return TemperatureReading{}, fmt.Errorf("decode payload: %w", err)
+	}
+	err := prepareReading(deviceId, &tri)
+	if err == nil {
+		err = a.validateReading(ctx, &tri)
+	}
+	if err != nil {
+		ingestRejected.WithLabelValues(ingestMQTT, rejectReason(err)).Inc()
+		return TemperatureReading{}, err
+	}
+	tr, err := a.insertReading(ctx, tri)
+	if err != nil {
+		ingestFailed.WithLabelValues(ingestMQTT, reasonDatabase).Inc()
+		return tr, err
+	}
+	observeAccepted(ingestMQTT, tr)
+	return tr, nil
+}
+
+// startMQTT connects to the broker in the background and keeps the
+// subscription alive across reconnects.
+func (a *app) startMQTT(cfg mqttConfig, logger *slog.Logger) mqtt.Client {
+	logger = logger.With("component", "mqtt", "broker", cfg.broker)
+
+	onMessage := func(_ mqtt.Client, msg mqtt.Message) {
+		ctx, cancel := context.WithTimeout(context.Background(), mqttInsertTimeout)
+		defer cancel()
+		tr, err := a.handleMQTTMessage(ctx, cfg.topic, msg.Topic(), msg.Payload())
+		if err != nil {
+			logger.Error("Failed to ingest MQTT message", "topic", msg.Topic(), "error", err)
+			return
+		}
+		logger.Info("Received temperature reading", "topic", msg.Topic(), slog.Any("data", tr))
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.broker).
+		SetClientID(cfg.clientId).
+		SetUsername(cfg.username).
+		SetPassword(cfg.password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			logger.Info("Connected to MQTT broker")
+			// Subscriptions don't survive a clean session reconnect
+			token := c.Subscribe(cfg.topic, 1, onMessage)
+			go func() {
+				if token.Wait(); token.Error() != nil {
+					logger.Error("Failed to subscribe", "topic", cfg.topic, "error", token.Error())
+					return
+				}
+				logger.Info("Subscribed", "topic", cfg.topic)
+			}()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Warn("Lost connection to MQTT broker", "error", err)
+		}).
+		SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+			logger.Info("Reconnecting to MQTT broker")
+		})
+
+	client := mqtt.NewClient(opts)
+	client.Connect()
+	return client
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	mqttserver "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startBroker runs an in-process broker standing in for mosquitto, address
+// may be "127.0.0.1:0" to pick a free port. The returned func stops it early.
+func startBroker(t *testing.T, address string) (*mqttserver.Server, string, func() error) {
+	t.Helper()
+	server := mqttserver.New(&mqttserver.Options{InlineClient: true, Logger: slog.New(slog.DiscardHandler)})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: address})
+	require.NoError(t, server.AddListener(tcp))
+	require.NoError(t, server.Serve())
+	stop := sync.OnceValue(server.Close)
+	t.Cleanup(func() { stop() })
+	return server, tcp.Address(), stop
+}
+
+func hasSubscriber(server *mqttserver.Server, topic string) bool {
+	return len(server.Topics.Subscribers(topic).Subscriptions) > 0
+}
+
+func TestDeviceFromTopic(t *testing.T) {
+	assert.Equal(t, "esp-a", deviceFromTopic("esp/+/readings", "esp/esp-a/readings"))
+	assert.Equal(t, "esp-a", deviceFromTopic("+/readings", "esp-a/readings"))
+	assert.Equal(t, "", deviceFromTopic("esp/readings", "esp/readings"))
+	assert.Equal(t, "", deviceFromTopic("esp/#", "esp/esp-a/readings"))
+}
+
+func TestHandleMQTTMessageRejected(t *testing.T) {
+	app := &app{}
+
+	_, err := app.handleMQTTMessage(context.Background(), "esp/+/readings", "esp/esp-a/readings", []byte(`not json`))
+	assert.Error(t, err)
+
+	_, err = app.handleMQTTMessage(context.Background(), "esp/+/readings", "esp/esp-a/readings", []byte(`{"deviceId": "esp-b"}`))
+	assert.ErrorIs(t, err, errDeviceMismatch)
+
+	_, err = app.handleMQTTMessage(context.Background(), "esp/+/readings", "esp/esp a/readings", []byte(`{}`))
+	assert.ErrorIs(t, err, errInvalidDeviceId)
+
+	// the payload can't name the device when the topic doesn't
+	_, err = app.handleMQTTMessage(context.Background(), "esp/readings", "esp/readings", []byte(`{"deviceId": "esp-a"}`))
+	assert.ErrorIs(t, err, errInvalidDeviceId)
+	_, err = app.handleMQTTMessage(context.Background(), "esp/+/readings", "esp//readings", []byte(`{"deviceId": "esp-a"}`))
+	assert.ErrorIs(t, err, errInvalidDeviceId)
+}
+
+func TestStartMQTTResubscribesAfterReconnect(t *testing.T) {
+	server, addr, stop := startBroker(t, "127.0.0.1:0")
+
+	app := &app{}
+	client := app.startMQTT(mqttConfig{broker: "tcp://" + addr, topic: "esp/+/readings", clientId: "test"}, slog.Default())
+	defer client.Disconnect(0)
+
+	require.Eventually(t, func() bool { return hasSubscriber(server, "esp/esp-a/readings") }, 5*time.Second, 10*time.Millisecond)
+
+	// the broker restarts with no memory of the subscription
+	require.NoError(t, stop())
+	server, _, _ = startBroker(t, addr)
+
+	require.Eventually(t, func() bool { return hasSubscriber(server, "esp/esp-a/readings") }, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestMQTTIngest(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "dummy"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	server, addr, _ := startBroker(t, "127.0.0.1:0")
+	client := app.startMQTT(mqttConfig{broker: "tcp://" + addr, topic: "esp/+/readings", clientId: "test"}, slog.Default())
+	defer client.Disconnect(0)
+	require.Eventually(t, func() bool { return hasSubscriber(server, "esp/esp-a/readings") }, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, server.Publish("esp/esp-a/readings", []byte(`{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0, "timestamp": 1761388101}`), false, 1))
+	require.NoError(t, server.Publish("esp/esp-a/readings", []byte(`{"deviceId": "esp-b", "tempCo": 1}`), false, 1))
+
+	require.Eventually(t, func() bool {
+		var count int
+		err := db.QueryRow(context.Background(), "SELECT COUNT(*) FROM readings WHERE device_id = 'esp-a' AND timestamp = 1761388101").Scan(&count)
+		return err == nil && count == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var count int
+	require.NoError(t, db.QueryRow(context.Background(), "SELECT COUNT(*) FROM readings").Scan(&count))
+	assert.Equal(t, 1, count)
+}
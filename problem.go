@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// problemTypeBase prefixes every problem type, like
+// urn:esp8266-web:problem:not-found
+const problemTypeBase = "urn:esp8266-web:problem:"
+
+// problemType is a kind of error response. Its name is part of the API,
+// clients branch on it, so it must never change once released.
+type problemType struct {
+	name   string
+	title  string
+	status int
+}
+
+var (
+	problemMalformedRequest  = problemType{"malformed-request", "Bad request", http.StatusBadRequest}
+	problemInvalidJSON       = problemType{"invalid-json", "Invalid JSON body", http.StatusUnprocessableEntity}
+	problemInvalidParameter  = problemType{"invalid-parameter", "Invalid query parameter", http.StatusUnprocessableEntity}
+	problemInvalidReading    = problemType{"invalid-reading", "Invalid reading", http.StatusUnprocessableEntity}
+	problemInvalidDeviceId   = problemType{"invalid-device-id", "Invalid device id", http.StatusUnprocessableEntity}
+	problemInvalidAlertRule  = problemType{"invalid-alert-rule", "Invalid alert rule", http.StatusUnprocessableEntity}
+	problemInvalidWebhook    = problemType{"invalid-webhook", "Invalid webhook", http.StatusUnprocessableEntity}
+	problemForbidden         = problemType{"forbidden", "Forbidden", http.StatusForbidden}
+	problemNotFound          = problemType{"not-found", "Not found", http.StatusNotFound}
+	problemMethodNotAllowed  = problemType{"method-not-allowed", "Method not allowed", http.StatusMethodNotAllowed}
+	problemDeviceExists      = problemType{"device-exists", "Device already exists", http.StatusConflict}
+	problemDeviceHasReadings = problemType{"device-has-readings", "Device has readings", http.StatusConflict}
+	problemDefaultDevice     = problemType{"default-device", "Default device cannot be deleted", http.StatusConflict}
+	problemDeviceOffline     = problemType{"device-not-connected", "Device not connected", http.StatusConflict}
+	// the status of a failed handshake depends on what is wrong with it
+	problemWebSocketHandshake = problemType{"websocket-handshake", "WebSocket handshake failed", http.StatusBadRequest}
+	problemBatchTooLarge      = problemType{"batch-too-large", "Batch too large", http.StatusRequestEntityTooLarge}
+	problemBodyTooLarge       = problemType{"body-too-large", "Request body too large", http.StatusRequestEntityTooLarge}
+	problemRateLimited        = problemType{"rate-limited", "Too many requests", http.StatusTooManyRequests}
+	problemInternal           = problemType{"internal-error", "Internal server error", http.StatusInternalServerError}
+	problemNeedsPostgres      = problemType{"needs-postgres", "Not available with this database driver", http.StatusNotImplemented}
+)
+
+func (t problemType) uri() string { return problemTypeBase + t.name }
+
+// Problem is an RFC 7807 problem details document, the body of every error
+// response
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	RequestId string       `json:"requestId,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+}
+
+func (t problemType) problem(detail string, fields ...fieldError) *Problem {
+	return &Problem{Type: t.uri(), Title: t.title, Status: t.status, Detail: detail, Errors: fields}
+}
+
+// writeProblem answers with a problem of type t
+func writeProblem(w http.ResponseWriter, t problemType, detail string, fields ...fieldError) {
+	t.problem(detail, fields...).write(w)
+}
+
+// write answers with p, with the request id requestIdMiddleware put on the
+// response
+func (p *Problem) write(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	p.RequestId = h.Get("X-Request-ID")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// ingestProblem is the problem of a reading refused with a non-auth err from
+// prepareReading or validateReading
+func ingestProblem(err error) *Problem {
+	var invalid *invalidReadingError
+	if errors.As(err, &invalid) {
+		return problemInvalidReading.problem(invalid.fieldList(), invalid.Fields...)
+	}
+	return problemInvalidDeviceId.problem("", fieldError{"deviceId", deviceIdRule})
+}
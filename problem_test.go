@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) Problem {
+	t.Helper()
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	var p Problem
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&p))
+	assert.Equal(t, w.Code, p.Status)
+	return p
+}
+
+func TestWriteProblem(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := requestIdMiddleware(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		writeProblem(w, problemInvalidParameter, "", fieldError{"from", "must be a unix timestamp"})
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/data/export.csv?from=x", nil))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	p := decodeProblem(t, w)
+	assert.Equal(t, Problem{
+		Type:      "urn:esp8266-web:problem:invalid-parameter",
+		Title:     "Invalid query parameter",
+		Status:    http.StatusUnprocessableEntity,
+		RequestId: w.Header().Get("X-Request-ID"),
+		Errors:    []fieldError{{"from", "must be a unix timestamp"}},
+	}, p)
+	assert.NotEmpty(t, p.RequestId)
+}
+
+func TestHandlerProblems(t *testing.T) {
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret", hub: newEventHub(), maxBatchSize: 2}
+
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		req     *http.Request
+		status  int
+		typ     string
+	}{
+		{"method", app.dataHandler, httptest.NewRequest("PUT", "/data", nil), http.StatusMethodNotAllowed, "method-not-allowed"},
+		{"forbidden", app.dataHandler, httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(`{}`))), http.StatusForbidden, "forbidden"},
+		{"batch too large", app.dataBatchHandler, httptest.NewRequest("POST", "/data/batch?key=testsecret", bytes.NewReader([]byte(`[{}, {}, {}]`))), http.StatusRequestEntityTooLarge, "batch-too-large"},
+		{"body too large", app.dataHandler, httptest.NewRequest("POST", "/data?key=testsecret", bytes.NewReader(make([]byte, maxReadingSize+1))), http.StatusRequestEntityTooLarge, "body-too-large"},
+		{"batch body too large", app.dataBatchHandler, httptest.NewRequest("POST", "/data/batch?key=testsecret", bytes.NewReader(make([]byte, 2*maxReadingSize+1))), http.StatusRequestEntityTooLarge, "body-too-large"},
+		{"websocket handshake", app.wsHandler, httptest.NewRequest("GET", "/ws", nil), http.StatusBadRequest, "websocket-handshake"},
+	} {
+		tc.req.Header.Set("X-Secret-Key", tc.req.URL.Query().Get("key"))
+		w := httptest.NewRecorder()
+		tc.handler(w, tc.req)
+		assert.Equal(t, tc.status, w.Code, tc.name)
+		assert.Equal(t, problemTypeBase+tc.typ, decodeProblem(t, w).Type, tc.name)
+	}
+}
+
+func TestDataBatchHandlerItemProblems(t *testing.T) {
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret", hub: newEventHub(), validation: ds18b20Validation()}
+
+	body := `[
+		{"deviceId": "esp-a", "tempCo": 60, "tempRoom": 21, "humidity": 40, "timestamp": 1761388101},
+		{"deviceId": "esp-a", "tempCo": "hot"},
+		{"deviceId": "esp a", "tempCo": 60, "tempRoom": 21, "humidity": 40},
+		{"deviceId": "esp-a", "tempCo": 60, "tempRoom": -127, "humidity": 40}
+	]`
+	req := httptest.NewRequest("POST", "/data/batch", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	app.dataBatchHandler(w, req)
+	require.Equal(t, http.StatusMultiStatus, w.Code)
+
+	var result BatchResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Nil(t, result.Results[0].Problem)
+	for i, typ := range map[int]string{1: "invalid-json", 2: "invalid-device-id", 3: "invalid-reading"} {
+		res := result.Results[i]
+		require.NotNil(t, res.Problem, i)
+		assert.Equal(t, problemTypeBase+typ, res.Problem.Type, i)
+		assert.Equal(t, res.Status, res.Problem.Status, i)
+		assert.NotEmpty(t, res.Error, i)
+	}
+	assert.Equal(t, []fieldError{{"deviceId", deviceIdRule}}, result.Results[2].Problem.Errors)
+	assert.Equal(t, []fieldError{{"tempRoom", "-127 is a sensor fault value"}}, result.Results[3].Problem.Errors)
+}
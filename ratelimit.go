@@ -0,0 +1,263 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	slogctx "github.com/veqryn/slog-context"
+	"gopkg.in/yaml.v3"
+)
+
+// Rate limited ingest routes, the keys of rate_limit.routes
+const (
+	routeData      = "/data"
+	routeDataBatch = "/data/batch"
+	routeWebSocket = "/ws"
+)
+
+var rateLimitedRoutes = []string{routeData, routeDataBatch, routeWebSocket}
+
+// Rate limit kinds, what a bucket is keyed by
+const (
+	limitIP     = "ip"
+	limitDevice = "device"
+)
+
+const (
+	defaultRateLimitMaxKeys = 10000
+	defaultRateLimitIdle    = 10 * time.Minute
+)
+
+var rateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "esp8266_rate_limited_requests_total",
+	Help: "Requests refused with 429, by route and limit (ip or device).",
+}, []string{"route", "limit"})
+
+// rateLimit allows n requests per period, refilling evenly over the period.
+// n is also the burst. The zero value doesn't limit.
+type rateLimit struct {
+	n      int
+	period time.Duration
+}
+
+// parseRateLimit parses n/period, the period a duration or s, m or h alone,
+// like 10/s, 100/m or 5/10s. 0 is no limit.
+func parseRateLimit(s string) (rateLimit, error) {
+	if s == "0" || s == "" {
+		return rateLimit{}, nil
+	}
+	count, per, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q, expected n/period like 10/s", s)
+	}
+	if per == "s" || per == "m" || per == "h" {
+		per = "1" + per
+	}
+	period, err := time.ParseDuration(per)
+	if err != nil || period <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q, expected n/period like 10/s", s)
+	}
+	return rateLimit{n: n, period: period}, nil
+}
+
+func (l rateLimit) enabled() bool { return l.n > 0 }
+
+func (l rateLimit) String() string {
+	if !l.enabled() {
+		return "0"
+	}
+	var per string
+	switch l.period {
+	case time.Second:
+		per = "s"
+	case time.Minute:
+		per = "m"
+	case time.Hour:
+		per = "h"
+	default:
+		// 5m rather than 5m0s
+		per = l.period.String()
+		if strings.HasSuffix(per, "m0s") {
+			per = strings.TrimSuffix(per, "0s")
+		}
+		if strings.HasSuffix(per, "h0m") {
+			per = strings.TrimSuffix(per, "0m")
+		}
+	}
+	return fmt.Sprintf("%d/%s", l.n, per)
+}
+
+func (l *rateLimit) Set(s string) error {
+	v, err := parseRateLimit(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+func (l rateLimit) MarshalYAML() (any, error) { return l.String(), nil }
+
+func (l *rateLimit) UnmarshalYAML(n *yaml.Node) error { return l.Set(n.Value) }
+
+// routeRateLimits override the default limits for one route
+type routeRateLimits struct {
+	IP     *rateLimit `yaml:"ip,omitempty"`
+	Device *rateLimit `yaml:"device,omitempty"`
+}
+
+// rateLimits are the ingest limits of every route. A nil *rateLimits limits
+// nothing.
+type rateLimits struct {
+	ip, device rateLimit
+	routes     map[string]routeRateLimits
+	buckets    *bucketStore
+}
+
+func (l *rateLimits) limit(route, kind string) rateLimit {
+	override := l.routes[route]
+	switch kind {
+	case limitIP:
+		if override.IP != nil {
+			return *override.IP
+		}
+		return l.ip
+	default:
+		if override.Device != nil {
+			return *override.Device
+		}
+		return l.device
+	}
+}
+
+// allow takes a token from the bucket of key for the route's limit of kind,
+// or returns how long until one is available
+func (l *rateLimits) allow(route, kind, key string, now time.Time) (bool, time.Duration) {
+	if l == nil || key == "" {
+		return true, 0
+	}
+	limit := l.limit(route, kind)
+	if !limit.enabled() {
+		return true, 0
+	}
+	return l.buckets.take(kind+"|"+route+"|"+key, limit, now)
+}
+
+// bucketStore holds token buckets up to maxKeys, evicting the least recently
+// used when full and any idle for longer than idle. An evicted bucket starts
+// over full, so idle should be at least the longest limit period.
+type bucketStore struct {
+	maxKeys int
+	idle    time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	buckets map[string]*list.Element
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newBucketStore(maxKeys int, idle time.Duration) *bucketStore {
+	if maxKeys <= 0 {
+		maxKeys = defaultRateLimitMaxKeys
+	}
+	if idle <= 0 {
+		idle = defaultRateLimitIdle
+	}
+	return &bucketStore{maxKeys: maxKeys, idle: idle, lru: list.New(), buckets: map[string]*list.Element{}}
+}
+
+func (s *bucketStore) take(key string, limit rateLimit, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictIdle(now)
+
+	var b *bucket
+	if e, ok := s.buckets[key]; ok {
+		s.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		perToken := limit.period.Seconds() / float64(limit.n)
+		b.tokens = math.Min(float64(limit.n), b.tokens+now.Sub(b.last).Seconds()/perToken)
+	} else {
+		if s.lru.Len() >= s.maxKeys {
+			s.remove(s.lru.Back())
+		}
+		b = &bucket{key: key, tokens: float64(limit.n)}
+		s.buckets[key] = s.lru.PushFront(b)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	perToken := limit.period.Seconds() / float64(limit.n)
+	wait := time.Duration((1 - b.tokens) * perToken * float64(time.Second))
+	return false, wait
+}
+
+// evictIdle drops buckets unused for longer than idle, oldest first
+func (s *bucketStore) evictIdle(now time.Time) {
+	for e := s.lru.Back(); e != nil && now.Sub(e.Value.(*bucket).last) > s.idle; e = s.lru.Back() {
+		s.remove(e)
+	}
+}
+
+func (s *bucketStore) remove(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.buckets, e.Value.(*bucket).key)
+}
+
+func (s *bucketStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// clientIP is the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// rateLimited answers 429 with Retry-After if the request is over the route's
+// limit of kind for key, and reports whether it did
+func (a *app) rateLimited(w http.ResponseWriter, r *http.Request, route, kind, key string) bool {
+	p, retryAfter := a.takeToken(r.Context(), route, kind, key)
+	if p == nil {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	p.write(w)
+	return true
+}
+
+// takeToken charges key one request against the route's limit of kind. Over
+// the limit it returns the rate-limited problem and the seconds to wait.
+func (a *app) takeToken(ctx context.Context, route, kind, key string) (*Problem, int) {
+	ok, wait := a.rateLimits.allow(route, kind, key, time.Now())
+	if ok {
+		return nil, 0
+	}
+	slogctx.FromCtx(ctx).Warn("Rate limited", "limit", kind, "key", key, "retryAfter", wait)
+	rateLimitedRequests.WithLabelValues(route, kind).Inc()
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	return problemRateLimited.problem(fmt.Sprintf("%s limit exceeded, retry after %d seconds", kind, retryAfter)), retryAfter
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for s, want := range map[string]rateLimit{
+		"10/s":  {n: 10, period: time.Second},
+		"100/m": {n: 100, period: time.Minute},
+		"5/10s": {n: 5, period: 10 * time.Second},
+		"3/5m":  {n: 3, period: 5 * time.Minute},
+		"0":     {},
+	} {
+		got, err := parseRateLimit(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+		assert.Equal(t, s, got.String())
+	}
+	for _, s := range []string{"10", "x/s", "-1/s", "10/x", "10/0s"} {
+		_, err := parseRateLimit(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestBucketStore(t *testing.T) {
+	limit := rateLimit{n: 2, period: time.Minute}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newBucketStore(2, 10*time.Minute)
+
+	// the burst is n, then a token every period/n
+	for range 2 {
+		ok, _ := s.take("a", limit, now)
+		assert.True(t, ok)
+	}
+	ok, wait := s.take("a", limit, now)
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+	ok, _ = s.take("a", limit, now.Add(30*time.Second))
+	assert.True(t, ok)
+
+	// the least recently used key is forgotten when full
+	s.take("b", limit, now.Add(time.Minute))
+	s.take("c", limit, now.Add(time.Minute))
+	assert.Equal(t, 2, s.len())
+	assert.NotContains(t, s.buckets, "a")
+
+	// and idle keys expire
+	s.take("c", limit, now.Add(15*time.Minute))
+	assert.Equal(t, 1, s.len())
+}
+
+func TestDataHandlerRateLimit(t *testing.T) {
+	cfg := defaultConfig()
+	require.NoError(t, cfg.RateLimit.Device.Set("2/m"))
+	cfg.RateLimit.Routes[routeDataBatch] = routeRateLimits{IP: &rateLimit{n: 1, period: time.Minute}}
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret", rateLimits: cfg.rateLimits()}
+	limited := testutil.ToFloat64(rateLimitedRequests.WithLabelValues(routeData, limitDevice))
+	rejected := testutil.ToFloat64(ingestRejected.WithLabelValues(ingestHTTP, reasonRateLimited))
+
+	post := func(device string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"deviceId": %q, "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`, device)
+		req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+		req.Header.Set("X-Secret-Key", "testsecret")
+		w := httptest.NewRecorder()
+		app.dataHandler(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, post("esp-a").Code)
+	assert.Equal(t, http.StatusOK, post("esp-a").Code)
+	w := post("esp-a")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	// other devices have their own bucket
+	assert.Equal(t, http.StatusOK, post("esp-b").Code)
+
+	assert.Equal(t, limited+1, testutil.ToFloat64(rateLimitedRequests.WithLabelValues(routeData, limitDevice)))
+	assert.Equal(t, rejected+1, testutil.ToFloat64(ingestRejected.WithLabelValues(ingestHTTP, reasonRateLimited)))
+
+	// the batch route overrides the IP limit, and isn't limited by /data
+	for i, code := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/data/batch", bytes.NewReader([]byte(`[]`)))
+		req.Header.Set("X-Secret-Key", "testsecret")
+		w := httptest.NewRecorder()
+		app.dataBatchHandler(w, req)
+		assert.Equal(t, code, w.Code, i)
+	}
+}
+
+func TestDataBatchHandlerRateLimit(t *testing.T) {
+	cfg := defaultConfig()
+	require.NoError(t, cfg.RateLimit.Device.Set("2/m"))
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret", hub: newEventHub(), rateLimits: cfg.rateLimits()}
+
+	// each reading counts against its own device, even with the shared key
+	body := `[
+		{"deviceId": "esp-a", "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0},
+		{"deviceId": "esp-a", "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0},
+		{"deviceId": "esp-b", "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0},
+		{"deviceId": "esp-a", "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}
+	]`
+	req := httptest.NewRequest("POST", "/data/batch", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	app.dataBatchHandler(w, req)
+	require.Equal(t, http.StatusMultiStatus, w.Code)
+
+	var result BatchResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, 3, result.Accepted)
+	res := result.Results[3]
+	assert.Equal(t, http.StatusTooManyRequests, res.Status)
+	require.NotNil(t, res.Problem)
+	assert.Equal(t, problemTypeBase+"rate-limited", res.Problem.Type)
+}
+
+func TestWsHandlerRateLimit(t *testing.T) {
+	cfg := defaultConfig()
+	require.NoError(t, cfg.RateLimit.Device.Set("3/m"))
+	require.NoError(t, cfg.RateLimit.IP.Set("3/m"))
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret", hub: newEventHub(), rateLimits: cfg.rateLimits()}
+	srv := httptest.NewServer(loggingMiddleware(http.HandlerFunc(app.wsHandler)))
+	t.Cleanup(srv.Close)
+	rejected := testutil.ToFloat64(ingestRejected.WithLabelValues(ingestWebSocket, reasonRateLimited))
+
+	// the handshake and every reading take a token of the connection's
+	// device and of its IP
+	conn := dialWS(t, srv, http.Header{"X-Secret-Key": {"testsecret"}, headerDeviceId: {"esp-a"}})
+	for i, status := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		reply := wsRoundTrip(t, conn, wsMessage{Type: "reading", Id: fmt.Sprint(i), Reading: &TemperatureReadingPayload{TempCo: 25.5, Humidity: 60}})
+		assert.Equal(t, status, reply.Status, i)
+	}
+	assert.Equal(t, rejected+1, testutil.ToFloat64(ingestRejected.WithLabelValues(ingestWebSocket, reasonRateLimited)))
+
+	// dashboards count against the IP limit too
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultRetentionInterval  = time.Hour
+	defaultRetentionBatchSize = 1000
+	// retentionBatchPause lets ingest through between delete batches
+	retentionBatchPause = 100 * time.Millisecond
+)
+
+var (
+	retentionPrunedRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_retention_pruned_rows_total",
+		Help: "Readings deleted by the retention policy, by policy (default or a device id).",
+	}, []string{"policy"})
+	retentionPrunableRows = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esp8266_retention_prunable_rows",
+		Help: "Readings a dry run of the retention policy would delete, by policy (default or a device id).",
+	}, []string{"policy"})
+	retentionRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_retention_runs_total",
+		Help: "Retention policy runs, by result.",
+	}, []string{"result"})
+)
+
+// retentionPolicy is how long raw readings are kept. A zero duration keeps
+// readings forever, both as the default and for a device.
+type retentionPolicy struct {
+	Default   time.Duration
+	Devices   map[string]time.Duration
+	Interval  time.Duration
+	BatchSize int
+	DryRun    bool
+}
+
+func (p retentionPolicy) enabled() bool {
+	if p.Default > 0 {
+		return true
+	}
+	for _, d := range p.Devices {
+		if d > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// retentionRule is one prune of a retentionPolicy, policy names it in logs
+// and metrics
+type retentionRule struct {
+	policy string
+	keep   time.Duration
+	query  PruneQuery
+}
+
+// rules turns the policy into the prunes due at now, devices with their own
+// retention are left out of the default one.
+func (p retentionPolicy) rules(now time.Time) []retentionRule {
+	devices := slices.Sorted(maps.Keys(p.Devices))
+	var rules []retentionRule
+	if p.Default > 0 {
+		rules = append(rules, retentionRule{
+			policy: "default",
+			keep:   p.Default,
+			query:  PruneQuery{Except: devices, Before: now.Add(-p.Default).Unix()},
+		})
+	}
+	for _, device := range devices {
+		if keep := p.Devices[device]; keep > 0 {
+			rules = append(rules, retentionRule{
+				policy: device,
+				keep:   keep,
+				query:  PruneQuery{Device: device, Before: now.Add(-keep).Unix()},
+			})
+		}
+	}
+	return rules
+}
+
+// parseRetention parses a duration that may also be given in days, like 90d
+func parseRetention(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid retention %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid retention %q", s)
+	}
+	return d, nil
+}
+
+// parseDeviceRetention parses per-device overrides given as
+// device=retention pairs separated by commas, like esp-a=30d,esp-b=0
+func parseDeviceRetention(s string) (map[string]time.Duration, error) {
+	devices := map[string]time.Duration{}
+	if s == "" {
+		return devices, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		device, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !validDeviceId(device) {
+			return nil, fmt.Errorf("invalid device retention %q, expected device=retention", pair)
+		}
+		d, err := parseRetention(value)
+		if err != nil {
+			return nil, err
+		}
+		devices[device] = d
+	}
+	return devices, nil
+}
+
+type retentionPruner struct {
+	app    *app
+	logger *slog.Logger
+	policy retentionPolicy
+	pause  time.Duration
+}
+
+func newRetentionPruner(a *app, logger *slog.Logger) *retentionPruner {
+	policy := a.retention
+	if policy.Interval <= 0 {
+		policy.Interval = defaultRetentionInterval
+	}
+	if policy.BatchSize <= 0 {
+		policy.BatchSize = defaultRetentionBatchSize
+	}
+	return &retentionPruner{
+		app:    a,
+		logger: logger.With("component", "retention"),
+		policy: policy,
+		pause:  retentionBatchPause,
+	}
+}
+
+// run enforces the policy every interval until ctx is done
+func (p *retentionPruner) run(ctx context.Context) {
+	ticker := time.NewTicker(p.policy.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := p.prune(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			p.logger.Error("Failed to prune readings", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune applies every rule of the policy at now and returns the readings
+// deleted per policy, or in a dry run the readings that would be.
+func (p *retentionPruner) prune(ctx context.Context, now time.Time) (map[string]int64, error) {
+	counts := map[string]int64{}
+	for _, rule := range p.policy.rules(now) {
+		n, err := p.pruneRule(ctx, rule)
+		counts[rule.policy] = n
+		if err != nil {
+			retentionRuns.WithLabelValues("error").Inc()
+			return counts, fmt.Errorf("policy %s: %w", rule.policy, err)
+		}
+	}
+	retentionRuns.WithLabelValues("success").Inc()
+	return counts, nil
+}
+
+// pruneRule deletes in batches of BatchSize, each its own statement, so no
+// lock is held for long
+func (p *retentionPruner) pruneRule(ctx context.Context, rule retentionRule) (int64, error) {
+	logger := p.logger.With("policy", rule.policy, "keep", rule.keep.String(), "before", rule.query.Before)
+	if p.policy.DryRun {
+		n, err := p.app.readings.CountPrunable(ctx, rule.query)
+		if err != nil {
+			return 0, err
+		}
+		retentionPrunableRows.WithLabelValues(rule.policy).Set(float64(n))
+		logger.Info("Retention dry run", "rows", n)
+		return n, nil
+	}
+
+	var total int64
+	for {
+		n, err := p.app.readings.PruneReadings(ctx, rule.query, p.policy.BatchSize)
+		total += n
+		retentionPrunedRows.WithLabelValues(rule.policy).Add(float64(n))
+		if err != nil {
+			return total, err
+		}
+		if n < int64(p.policy.BatchSize) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(p.pause):
+		}
+	}
+	if total > 0 {
+		logger.Info("Pruned readings", "rows", total)
+	}
+	return total, nil
+}
+
+// pruneCommand applies the retention policy once and prints the rows deleted
+// per policy, or only counts them with --dry-run
+func (a *app) pruneCommand(ctx context.Context, args []string) error {
+	policy := a.retention
+	for _, arg := range args {
+		if arg != "--dry-run" {
+			return fmt.Errorf("usage: prune [--dry-run]")
+		}
+		policy.DryRun = true
+	}
+	if !policy.enabled() {
+		return fmt.Errorf("no retention configured, set --retention or --retention-devices")
+	}
+	p := newRetentionPruner(a, slog.Default())
+	p.policy.DryRun = policy.DryRun
+	counts, err := p.prune(ctx, time.Now())
+	verb := "pruned"
+	if policy.DryRun {
+		verb = "would prune"
+	}
+	for _, rule := range policy.rules(time.Now()) {
+		if n, ok := counts[rule.policy]; ok {
+			fmt.Printf("%s\tkeep %s\t%s %d\n", rule.policy, rule.keep, verb, n)
+		}
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetention(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"0":    0,
+		"90d":  90 * 24 * time.Hour,
+		"720h": 720 * time.Hour,
+		"30m":  30 * time.Minute,
+	} {
+		got, err := parseRetention(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+	for _, s := range []string{"", "d", "-1d", "1.5d", "-1h", "forever"} {
+		_, err := parseRetention(s)
+		assert.Error(t, err, s)
+	}
+
+	devices, err := parseDeviceRetention("esp-a=30d, esp-b=0")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"esp-a": 30 * 24 * time.Hour, "esp-b": 0}, devices)
+	_, err = parseDeviceRetention("esp-a")
+	assert.Error(t, err)
+	_, err = parseDeviceRetention("esp a=1d")
+	assert.Error(t, err)
+}
+
+func TestRetentionPruner(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(100*86400, 0)
+	store := newMemoryReadingStore()
+	insert := func(device string, age time.Duration) {
+		ts := now.Add(-age).Unix()
+		_, err := store.InsertReading(ctx, TemperatureReadingPayload{DeviceId: device, Timestamp: &ts})
+		require.NoError(t, err)
+	}
+	for range 5 {
+		insert("esp-a", 40*24*time.Hour)
+		insert("esp-b", 40*24*time.Hour)
+		insert("esp-c", 40*24*time.Hour)
+	}
+	insert("esp-a", 10*24*time.Hour)
+	insert("esp-b", 20*24*time.Hour)
+
+	app := &app{readings: store, retention: retentionPolicy{
+		Default:   30 * 24 * time.Hour,
+		Devices:   map[string]time.Duration{"esp-b": 15 * 24 * time.Hour, "esp-c": 0},
+		BatchSize: 2,
+		DryRun:    true,
+	}}
+	p := newRetentionPruner(app, slog.Default())
+	p.pause = 0
+
+	counts, err := p.prune(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"default": 5, "esp-b": 6}, counts)
+	all, err := store.QueryReadings(ctx, ReadingQuery{})
+	require.NoError(t, err)
+	assert.Len(t, all, 17)
+
+	p.policy.DryRun = false
+	counts, err = p.prune(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"default": 5, "esp-b": 6}, counts)
+
+	// esp-c is kept forever
+	for device, want := range map[string]int{"esp-a": 1, "esp-b": 0, "esp-c": 5} {
+		readings, err := store.QueryReadings(ctx, ReadingQuery{Device: device})
+		require.NoError(t, err)
+		assert.Len(t, readings, want, device)
+	}
+}
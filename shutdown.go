@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// drain takes the servers out of service. /health reports draining for delay
+// so load balancers stop routing to it, streams are closed, then the
+// listeners stop and in-flight requests get timeout to finish. Requests still
+// running after that are cut off.
+func (a *app) drain(servers []*http.Server, delay, timeout time.Duration, logger *slog.Logger) {
+	a.draining.Store(true)
+	if delay > 0 {
+		logger.Info("Draining, waiting before closing the listener", "delay", delay)
+		time.Sleep(delay)
+	}
+	a.hub.close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Go(func() {
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Warn("Requests still in flight after the shutdown timeout, closing them", "addr", server.Addr, "error", err)
+				server.Close()
+			}
+		})
+	}
+	wg.Wait()
+}
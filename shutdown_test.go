@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrain(t *testing.T) {
+	app := &app{hub: newEventHub()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", app.healthHandler)
+	mux.HandleFunc("/data/stream", app.dataStreamHandler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	stream := openStream(t, srv.URL+"/data/stream", "")
+	waitForSubscribers(t, app.hub, 1)
+
+	done := make(chan struct{})
+	go func() {
+		app.drain([]*http.Server{srv.Config}, 0, time.Second, slog.New(slog.DiscardHandler))
+		close(done)
+	}()
+
+	// the stream ends cleanly and the server stops without waiting out the
+	// timeout
+	_, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("drain waited on the closed stream")
+	}
+	assert.True(t, app.hub.isClosed())
+
+	w := httptest.NewRecorder()
+	app.healthHandler(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"status": "draining"}`, w.Body.String())
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Signed ingest requests carry these headers instead of X-Secret-Key. The
+// signature is the hex encoded HMAC-SHA256 of
+//
+//	timestamp + "\n" + nonce + "\n" + body
+//
+// keyed with the signing secret issued along with a device key, or with the
+// shared key itself.
+const (
+	headerDeviceId  = "X-Device-Id"
+	headerTimestamp = "X-Timestamp"
+	headerNonce     = "X-Nonce"
+	headerSignature = "X-Signature"
+)
+
+const defaultSignatureSkew = 5 * time.Minute
+
+var (
+	errInvalidSignature = errors.New("invalid signature")
+	errStaleRequest     = errors.New("timestamp outside allowed skew")
+	errReplayedNonce    = errors.New("nonce already used")
+)
+
+func isAuthError(err error) bool {
+	return errors.Is(err, errInvalidKey) ||
+		errors.Is(err, errDeviceMismatch) ||
+		errors.Is(err, errInvalidSignature) ||
+		errors.Is(err, errStaleRequest) ||
+		errors.Is(err, errReplayedNonce) ||
+		errors.Is(err, errClientCertRequired)
+}
+
+func signRequest(secret string, timestamp int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deviceSigningSecret is the secret the device key with keyHash signs
+// requests with. It is derived with the server's signing key, so unlike the
+// key it can't be recovered from device_keys alone. Without a signing key
+// device keys can't sign, "" is returned.
+func (a *app) deviceSigningSecret(keyHash string) string {
+	if a.signingKey == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(a.signingKey))
+	mac.Write([]byte(keyHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *app) signatureSkew() time.Duration {
+	if a.hmacSkew > 0 {
+		return a.hmacSkew
+	}
+	return defaultSignatureSkew
+}
+
+// authenticateRequest authenticates an ingest request by its client
+// certificate, its signature headers or by X-Secret-Key, see
+// authenticateDevice for the meaning of the returned device id. With
+// requireClientCert only the certificate is accepted.
+func (a *app) authenticateRequest(r *http.Request, body []byte) (string, error) {
+	if deviceId := clientCertDevice(r); deviceId != "" {
+		return deviceId, nil
+	}
+	if a.requireClientCert {
+		return "", errClientCertRequired
+	}
+	if r.Header.Get(headerSignature) == "" {
+		return a.authenticateDevice(r.Context(), r.Header.Get("X-Secret-Key"))
+	}
+	return a.verifySignedRequest(r.Context(), r.Header, body, time.Now().UTC())
+}
+
+func (a *app) verifySignedRequest(ctx context.Context, h http.Header, body []byte, now time.Time) (string, error) {
+	deviceId := h.Get(headerDeviceId)
+	nonce := h.Get(headerNonce)
+	if !validDeviceId(deviceId) || nonce == "" || len(nonce) > 64 {
+		return "", errInvalidSignature
+	}
+	timestamp, err := strconv.ParseInt(h.Get(headerTimestamp), 10, 64)
+	if err != nil {
+		return "", errInvalidSignature
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)).Abs(); skew > a.signatureSkew() {
+		return "", errStaleRequest
+	}
+	signature, err := hex.DecodeString(h.Get(headerSignature))
+	if err != nil {
+		return "", errInvalidSignature
+	}
+
+	valid := func(secret string) bool {
+		expected, _ := hex.DecodeString(signRequest(secret, timestamp, nonce, body))
+		return secret != "" && hmac.Equal(expected, signature)
+	}
+
+	// The device is the one the key was issued for. The shared key isn't
+	// bound to a device, like with X-Secret-Key the payload names it.
+	var keyDevice string
+	if a.rejectSharedKey || !valid(a.secretKey) {
+		// device keys are only kept in Postgres
+		if a.db == nil {
+			return "", errInvalidSignature
+		}
+		rows, err := a.db.Query(ctx, `
+			SELECT key_hash FROM device_keys
+			WHERE device_id = $1 AND revoked_at IS NULL`, deviceId)
+		if err != nil {
+			return "", err
+		}
+		keyHashes, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return "", err
+		}
+		if !slices.ContainsFunc(keyHashes, func(keyHash string) bool { return valid(a.deviceSigningSecret(keyHash)) }) {
+			return "", errInvalidSignature
+		}
+		keyDevice = deviceId
+	}
+
+	// Nonces only need to be remembered while their timestamp is still
+	// inside the skew window, anything older is rejected as stale anyway
+	cutoff := now.Add(-2 * a.signatureSkew()).Unix()
+	if a.db == nil {
+		if !a.nonces.use(keyDevice, nonce, now.Unix(), cutoff) {
+			return "", errReplayedNonce
+		}
+		return keyDevice, nil
+	}
+	err = pgx.BeginFunc(ctx, a.db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM ingest_nonces WHERE seen_at < $1`, cutoff); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO ingest_nonces (device_id, nonce, seen_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING
+		`, keyDevice, nonce, now.Unix())
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errReplayedNonce
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return keyDevice, nil
+}
+
+// nonceCache remembers the nonces of signed requests without a database, in
+// place of ingest_nonces. The zero value is ready to use.
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[[2]string]int64
+}
+
+// use records the nonce of deviceId as seen at now, forgetting those seen
+// before cutoff. It reports false if the nonce was already used.
+func (c *nonceCache) use(deviceId, nonce string, now, cutoff int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = map[[2]string]int64{}
+	}
+	maps.DeleteFunc(c.seen, func(_ [2]string, seenAt int64) bool { return seenAt < cutoff })
+	key := [2]string{deviceId, nonce}
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = now
+	return true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedDataRequest(t *testing.T, secret, deviceId, nonce string, ts int64, body string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+	req.Header.Set(headerDeviceId, deviceId)
+	req.Header.Set(headerTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(headerNonce, nonce)
+	req.Header.Set(headerSignature, signRequest(secret, ts, nonce, []byte(body)))
+	return req
+}
+
+func TestSignRequest(t *testing.T) {
+	sig := signRequest("keyhash", 1761388101, "abc", []byte(`{"tempCo": 1}`))
+	assert.Len(t, sig, 64)
+	assert.Equal(t, sig, signRequest("keyhash", 1761388101, "abc", []byte(`{"tempCo": 1}`)))
+	assert.NotEqual(t, sig, signRequest("keyhash", 1761388102, "abc", []byte(`{"tempCo": 1}`)))
+	assert.NotEqual(t, sig, signRequest("keyhash", 1761388101, "abd", []byte(`{"tempCo": 1}`)))
+	assert.NotEqual(t, sig, signRequest("keyhash", 1761388101, "abc", []byte(`{"tempCo": 2}`)))
+	assert.NotEqual(t, sig, signRequest("otherhash", 1761388101, "abc", []byte(`{"tempCo": 1}`)))
+}
+
+func TestDeviceSigningSecret(t *testing.T) {
+	a := &app{signingKey: "testsigning"}
+	keyHash := hashDeviceKey("esp_key")
+	secret := a.deviceSigningSecret(keyHash)
+	assert.Len(t, secret, 64)
+	assert.NotEqual(t, keyHash, secret)
+	assert.Equal(t, secret, a.deviceSigningSecret(keyHash))
+	assert.NotEqual(t, secret, a.deviceSigningSecret(hashDeviceKey("esp_other")))
+	assert.NotEqual(t, secret, (&app{signingKey: "othersigning"}).deviceSigningSecret(keyHash))
+
+	// without a signing key device keys can't sign at all
+	assert.Empty(t, (&app{}).deviceSigningSecret(keyHash))
+}
+
+func TestVerifySignedRequestMalformed(t *testing.T) {
+	app := &app{secretKey: "testsecret", hmacSkew: time.Minute}
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name      string
+		mutate    func(h http.Header)
+		expectErr error
+	}{
+		{"stale timestamp", func(h http.Header) { h.Set(headerTimestamp, strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10)) }, errStaleRequest},
+		{"future timestamp", func(h http.Header) { h.Set(headerTimestamp, strconv.FormatInt(now.Add(2*time.Minute).Unix(), 10)) }, errStaleRequest},
+		{"invalid timestamp", func(h http.Header) { h.Set(headerTimestamp, "soon") }, errInvalidSignature},
+		{"missing nonce", func(h http.Header) { h.Del(headerNonce) }, errInvalidSignature},
+		{"invalid device", func(h http.Header) { h.Set(headerDeviceId, "a/b") }, errInvalidSignature},
+		{"signature not hex", func(h http.Header) { h.Set(headerSignature, "zz") }, errInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := signedDataRequest(t, "testsecret", "default", "n1", now.Unix(), `{}`)
+			tt.mutate(req.Header)
+			_, err := app.verifySignedRequest(context.Background(), req.Header, []byte(`{}`), now)
+			assert.ErrorIs(t, err, tt.expectErr)
+		})
+	}
+}
+
+func TestDataHandlerPOSTSignedMemory(t *testing.T) {
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret", hub: newEventHub()}
+	now := time.Now().UTC().Unix()
+	body := `{"deviceId": "esp-a", "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`
+
+	// shared key signatures need no database, nonces are kept in memory
+	w := httptest.NewRecorder()
+	app.dataHandler(w, signedDataRequest(t, "testsecret", "esp-a", "n1", now, body))
+	require.Equal(t, http.StatusOK, w.Code)
+	var tr TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tr))
+	assert.Equal(t, "esp-a", tr.DeviceId)
+
+	w = httptest.NewRecorder()
+	app.dataHandler(w, signedDataRequest(t, "testsecret", "esp-a", "n1", now, body))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// there are no device keys to sign with
+	w = httptest.NewRecorder()
+	app.dataHandler(w, signedDataRequest(t, "othersecret", "esp-a", "n2", now, body))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestNonceCache(t *testing.T) {
+	var c nonceCache
+	assert.True(t, c.use("esp-a", "n1", 100, 0))
+	assert.False(t, c.use("esp-a", "n1", 101, 0))
+	assert.True(t, c.use("esp-b", "n1", 101, 0))
+	// forgotten once older than the cutoff
+	assert.True(t, c.use("esp-a", "n1", 300, 200))
+	assert.Len(t, c.seen, 1)
+}
+
+func TestDataHandlerPOSTSigned(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret", signingKey: "testsigning"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	_, err := db.Exec(context.Background(), "INSERT INTO devices (id) VALUES ('esp-a')")
+	require.NoError(t, err)
+	issued, err := app.issueDeviceKey(context.Background(), "esp-a")
+	require.NoError(t, err)
+
+	body := `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`
+	now := time.Now().UTC().Unix()
+
+	req := signedDataRequest(t, issued.SigningSecret, "esp-a", "nonce-1", now, body)
+	w := httptest.NewRecorder()
+	app.dataHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// replaying the exact same request is rejected
+	req = signedDataRequest(t, issued.SigningSecret, "esp-a", "nonce-1", now, body)
+	w = httptest.NewRecorder()
+	app.dataHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// tampered body
+	req = signedDataRequest(t, issued.SigningSecret, "esp-a", "nonce-2", now, body)
+	req.Body = httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(`{"tempCo": 99}`))).Body
+	w = httptest.NewRecorder()
+	app.dataHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// key of another device
+	req = signedDataRequest(t, issued.SigningSecret, "default", "nonce-3", now, body)
+	w = httptest.NewRecorder()
+	app.dataHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// the key hash stored in device_keys can't sign
+	req = signedDataRequest(t, hashDeviceKey(issued.Key), "esp-a", "nonce-6", now, body)
+	w = httptest.NewRecorder()
+	app.dataHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// shared key still works for gradual migration, the payload names the
+	// device rather than X-Device-Id
+	req = signedDataRequest(t, "testsecret", "esp-a", "nonce-4", now, body)
+	w = httptest.NewRecorder()
+	app.dataHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var tr TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tr))
+	assert.Equal(t, defaultDeviceId, tr.DeviceId)
+
+	// revoked keys stop verifying
+	ok, err := app.revokeDeviceKey(context.Background(), "esp-a", issued.Id)
+	require.NoError(t, err)
+	require.True(t, ok)
+	req = signedDataRequest(t, issued.SigningSecret, "esp-a", "nonce-5", now, body)
+	w = httptest.NewRecorder()
+	app.dataHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestSQLite(t *testing.T) *sql.DB {
+	db, err := openSQLite(context.Background(), filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func setupTestSQLiteApp(t *testing.T) *app {
+	app := &app{readings: newSQLiteReadingStore(setupTestSQLite(t)), secretKey: "testsecret"}
+	require.NoError(t, app.applyMigrations(context.Background()))
+	return app
+}
+
+func TestSQLiteReadingStore(t *testing.T) {
+	app := setupTestSQLiteApp(t)
+	testReadingStore(t, app.readings)
+}
+
+func TestSQLiteMigrateDownUp(t *testing.T) {
+	db := setupTestSQLite(t)
+	app := &app{readings: newSQLiteReadingStore(db)}
+	migrations, err := loadMigrations(migrationFiles, "migrations/sqlite")
+	require.NoError(t, err)
+	pgMigrations, err := loadMigrations(migrationFiles, "migrations")
+	require.NoError(t, err)
+	require.Len(t, migrations, len(pgMigrations))
+
+	require.NoError(t, app.migrateUp(context.Background(), 1))
+	_, err = db.Exec("INSERT INTO readings (temp_co, temp_room, humidity, timestamp) VALUES (25.5, 22, 60, 1761388101)")
+	require.NoError(t, err)
+
+	require.NoError(t, app.applyMigrations(context.Background()))
+	version, err := app.schemaVersion(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	// readings from before devices are kept and belong to the default device
+	latest, err := app.readings.LatestReading(context.Background(), defaultDeviceId)
+	require.NoError(t, err)
+	assert.Equal(t, 25.5, latest.TempCo)
+	// and are rolled up
+	day := int64(1761388101) / rollupDay * rollupDay
+	buckets, err := app.readings.AggregateReadings(context.Background(), defaultDeviceId, []int64{day}, []int64{day + rollupDay})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), buckets[0].Count)
+	// keys, alerts and webhooks are only kept in Postgres
+	var names []string
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	require.NoError(t, err)
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"devices", "readings", "readings_daily", "readings_hourly", "schema_migrations"}, names)
+
+	require.NoError(t, app.migrateDown(context.Background(), len(migrations)))
+	version, err = app.schemaVersion(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+	var tables int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'readings'").Scan(&tables))
+	assert.Equal(t, 0, tables)
+
+	require.NoError(t, app.migrateCommand(context.Background(), []string{"up"}))
+	version, err = app.schemaVersion(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+}
+
+func TestSQLiteMigrationMismatch(t *testing.T) {
+	app := setupTestSQLiteApp(t)
+	db := app.readings.(*sqliteReadingStore).db
+	_, err := db.Exec("UPDATE schema_migrations SET name = 'alerts' WHERE version = 2")
+	require.NoError(t, err)
+
+	// neither direction runs against a history this binary doesn't know
+	assert.ErrorContains(t, app.applyMigrations(context.Background()), "database has migration 0002_alerts applied where this binary has 0002_devices")
+	assert.ErrorContains(t, app.migrateDown(context.Background(), 1), "0002_alerts")
+}
+
+// 0004 used to be alerts, before readings_timestamp_index was inserted ahead
+// of it
+func TestSQLiteMigrateRenumberedHistory(t *testing.T) {
+	db := setupTestSQLite(t)
+	app := &app{readings: newSQLiteReadingStore(db)}
+	require.NoError(t, app.migrateUp(context.Background(), 3))
+	_, err := db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (4, 'alerts', 0)")
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, app.applyMigrations(context.Background()), "database has migration 0004_alerts applied where this binary has 0004_readings_timestamp_index")
+}
+
+func TestHealthHandlerSQLite(t *testing.T) {
+	app := setupTestSQLiteApp(t)
+	migrations, err := loadMigrations(migrationFiles, "migrations/sqlite")
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	app.healthHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok", "schemaVersion": `+strconv.Itoa(len(migrations))+`}`, w.Body.String())
+}
+
+func TestPostgresRoutesSQLite(t *testing.T) {
+	app := setupTestSQLiteApp(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", app.homeHandler)
+	app.handlePostgresRoutes(mux, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// without the routes these would get the dashboard
+	for _, path := range []string{"/devices", "/devices/esp-a/keys", "/alerts/rules/1", "/webhooks"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Secret-Key", "testsecret")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotImplemented, w.Code, path)
+		assert.Equal(t, problemTypeBase+"needs-postgres", decodeProblem(t, w).Type, path)
+	}
+
+	// commands don't touch the database and are left to main
+	req := httptest.NewRequest("POST", "/devices/esp-a/commands", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.NotEqual(t, http.StatusNotImplemented, w.Code)
+}
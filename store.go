@@ -0,0 +1,143 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+)
+
+var errNoReadings = errors.New("no readings")
+
+type readingOrder int
+
+const (
+	// orderNewestFirst sorts by timestamp then id, newest first, like GET /data
+	orderNewestFirst readingOrder = iota
+	// orderOldestFirst sorts by timestamp then id, like the CSV export
+	orderOldestFirst
+	// orderById sorts by id, which is insertion order
+	orderById
+)
+
+// readingKey is a position in timestamp then id order, what GET /data
+// cursors point at
+type readingKey struct {
+	Timestamp int64
+	Id        int
+}
+
+func keyOf(tr TemperatureReading) readingKey {
+	return readingKey{Timestamp: *tr.Timestamp, Id: tr.Id}
+}
+
+func (k readingKey) compare(o readingKey) int {
+	return cmp.Or(cmp.Compare(k.Timestamp, o.Timestamp), cmp.Compare(k.Id, o.Id))
+}
+
+// ReadingQuery selects readings, zero fields don't filter. A Limit of 0
+// returns every match. Before and After only match readings strictly before
+// or after a key.
+type ReadingQuery struct {
+	Device  string
+	From    *int64
+	To      *int64
+	AfterId int64
+	Before  *readingKey
+	After   *readingKey
+	Order   readingOrder
+	Limit   int
+	Offset  int
+}
+
+func (q ReadingQuery) matches(tr TemperatureReading) bool {
+	return (q.Device == "" || tr.DeviceId == q.Device) &&
+		(q.From == nil || *tr.Timestamp >= *q.From) &&
+		(q.To == nil || *tr.Timestamp <= *q.To) &&
+		int64(tr.Id) > q.AfterId &&
+		(q.Before == nil || keyOf(tr).compare(*q.Before) < 0) &&
+		(q.After == nil || keyOf(tr).compare(*q.After) > 0)
+}
+
+// Rollup resolutions in seconds, readings_hourly and readings_daily are
+// bucketed by UTC hour and day
+const (
+	rollupHour int64 = 3600
+	rollupDay  int64 = 86400
+)
+
+// rollupResolution is the coarsest rollup that aggregation buckets are made
+// of whole buckets of, 0 if they need raw readings
+func rollupResolution(starts, ends []int64) int64 {
+	for _, res := range []int64{rollupDay, rollupHour} {
+		aligned := true
+		for i := range starts {
+			aligned = aligned && starts[i]%res == 0 && ends[i]%res == 0
+		}
+		if aligned {
+			return res
+		}
+	}
+	return 0
+}
+
+// aggregateSource is the FROM table, bucket column and aggregate columns of
+// an aggregation over starts and ends, the rollups if they line up with the
+// buckets. Raw readings may have been pruned, rollups keep the whole history.
+// Suspect readings are left out of both.
+func aggregateSource(starts, ends []int64) (table, column, aggregates string) {
+	table = "readings_hourly"
+	switch rollupResolution(starts, ends) {
+	case 0:
+		return "(SELECT * FROM readings WHERE quality = 'good')", "timestamp", `COUNT(r.id),
+			AVG(r.temp_co), MIN(r.temp_co), MAX(r.temp_co),
+			AVG(r.temp_room), MIN(r.temp_room), MAX(r.temp_room),
+			AVG(r.humidity), MIN(r.humidity), MAX(r.humidity)`
+	case rollupDay:
+		table = "readings_daily"
+	}
+	return table, "bucket_start", `CAST(COALESCE(SUM(r.count), 0) AS BIGINT),
+			SUM(r.temp_co_sum) / CAST(SUM(r.count) AS DOUBLE PRECISION), MIN(r.temp_co_min), MAX(r.temp_co_max),
+			SUM(r.temp_room_sum) / CAST(SUM(r.count) AS DOUBLE PRECISION), MIN(r.temp_room_min), MAX(r.temp_room_max),
+			SUM(r.humidity_sum) / CAST(SUM(r.count) AS DOUBLE PRECISION), MIN(r.humidity_min), MAX(r.humidity_max)`
+}
+
+// PruneQuery selects readings older than Before, of Device or, if Device is
+// "", of every device not in Except.
+type PruneQuery struct {
+	Device string
+	Except []string
+	Before int64
+}
+
+func (q PruneQuery) matches(tr TemperatureReading) bool {
+	if q.Device != "" && tr.DeviceId != q.Device || slices.Contains(q.Except, tr.DeviceId) {
+		return false
+	}
+	return *tr.Timestamp < q.Before
+}
+
+// ReadingStore is where readings are kept. Payloads are prepared by the
+// caller, see prepareReading.
+type ReadingStore interface {
+	InsertReading(ctx context.Context, p TemperatureReadingPayload) (TemperatureReading, error)
+	// InsertReadings stores a batch atomically apart from readings that fail
+	// on their own, those get an error at their index and are skipped. The
+	// returned error is only for failures of the whole batch.
+	InsertReadings(ctx context.Context, ps []TemperatureReadingPayload) ([]TemperatureReading, []error, error)
+	QueryReadings(ctx context.Context, q ReadingQuery) ([]TemperatureReading, error)
+	// EachReading calls fn for every match as it is read, for results too
+	// large to hold in memory. An error from fn stops the iteration.
+	EachReading(ctx context.Context, q ReadingQuery, fn func(TemperatureReading) error) error
+	// LatestReading returns the newest reading of device, or of any device if
+	// device is "", and errNoReadings if there is none.
+	LatestReading(ctx context.Context, device string) (TemperatureReading, error)
+	// AggregateReadings summarises the readings in each [starts[i], ends[i])
+	// bucket, empty buckets included.
+	AggregateReadings(ctx context.Context, device string, starts, ends []int64) ([]AggregateBucket, error)
+	// CountPrunable counts the readings PruneReadings would delete
+	CountPrunable(ctx context.Context, q PruneQuery) (int64, error)
+	// PruneReadings deletes up to limit of the oldest readings matching q and
+	// returns how many it deleted.
+	PruneReadings(ctx context.Context, q PruneQuery, limit int) (int64, error)
+}
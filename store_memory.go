@@ -0,0 +1,237 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+)
+
+// memoryReadingStore keeps readings in memory, for tests and demos. Readings
+// are lost on restart.
+type memoryReadingStore struct {
+	mu       sync.RWMutex
+	readings []TemperatureReading // by id
+	lastId   int
+	// rollups by resolution, like readings_hourly and readings_daily they
+	// outlive pruned readings
+	rollups map[int64]map[rollupKey]*rollup
+}
+
+type rollupKey struct {
+	device string
+	start  int64
+}
+
+// rollup summarises readings of tempCo, tempRoom and humidity, in that order
+type rollup struct {
+	count         int64
+	sum, min, max [3]float64
+}
+
+func (r *rollup) add(o rollup) {
+	if r.count == 0 {
+		*r = o
+		return
+	}
+	r.count += o.count
+	for m := range r.sum {
+		r.sum[m] += o.sum[m]
+		r.min[m] = min(r.min[m], o.min[m])
+		r.max[m] = max(r.max[m], o.max[m])
+	}
+}
+
+func newMemoryReadingStore() *memoryReadingStore {
+	return &memoryReadingStore{rollups: map[int64]map[rollupKey]*rollup{
+		rollupHour: {},
+		rollupDay:  {},
+	}}
+}
+
+func readingRollup(tr TemperatureReading) rollup {
+	v := [3]float64{tr.TempCo, tr.TempRoom, tr.Humidity}
+	return rollup{count: 1, sum: v, min: v, max: v}
+}
+
+func (s *memoryReadingStore) insert(p TemperatureReadingPayload) TemperatureReading {
+	ts := *p.Timestamp
+	s.lastId++
+	tr := TemperatureReading{
+		Id:        s.lastId,
+		DeviceId:  p.DeviceId,
+		TempCo:    p.TempCo,
+		TempRoom:  p.TempRoom,
+		Humidity:  p.Humidity,
+		Timestamp: &ts,
+		Quality:   p.quality(),
+	}
+	s.readings = append(s.readings, tr)
+	if tr.Quality != qualityGood {
+		return tr
+	}
+	for res, rollups := range s.rollups {
+		key := rollupKey{tr.DeviceId, ts - ts%res}
+		if rollups[key] == nil {
+			rollups[key] = &rollup{}
+		}
+		rollups[key].add(readingRollup(tr))
+	}
+	return tr
+}
+
+func (s *memoryReadingStore) InsertReading(ctx context.Context, p TemperatureReadingPayload) (TemperatureReading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert(p), nil
+}
+
+func (s *memoryReadingStore) InsertReadings(ctx context.Context, ps []TemperatureReadingPayload) ([]TemperatureReading, []error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	readings := make([]TemperatureReading, len(ps))
+	for i, p := range ps {
+		readings[i] = s.insert(p)
+	}
+	return readings, make([]error, len(ps)), nil
+}
+
+func (s *memoryReadingStore) QueryReadings(ctx context.Context, q ReadingQuery) ([]TemperatureReading, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	readings := make([]TemperatureReading, 0)
+	for _, tr := range s.readings {
+		if q.matches(tr) {
+			readings = append(readings, tr)
+		}
+	}
+	switch q.Order {
+	case orderNewestFirst:
+		slices.SortFunc(readings, func(x, y TemperatureReading) int {
+			return keyOf(y).compare(keyOf(x))
+		})
+	case orderOldestFirst:
+		slices.SortFunc(readings, func(x, y TemperatureReading) int {
+			return keyOf(x).compare(keyOf(y))
+		})
+	}
+
+	readings = readings[min(q.Offset, len(readings)):]
+	if q.Limit > 0 && q.Limit < len(readings) {
+		readings = readings[:q.Limit]
+	}
+	return readings, nil
+}
+
+func (s *memoryReadingStore) EachReading(ctx context.Context, q ReadingQuery, fn func(TemperatureReading) error) error {
+	readings, err := s.QueryReadings(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, tr := range readings {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(tr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryReadingStore) LatestReading(ctx context.Context, device string) (TemperatureReading, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var latest *TemperatureReading
+	for i, tr := range s.readings {
+		if device != "" && tr.DeviceId != device {
+			continue
+		}
+		if latest == nil || *tr.Timestamp >= *latest.Timestamp {
+			latest = &s.readings[i]
+		}
+	}
+	if latest == nil {
+		return TemperatureReading{}, errNoReadings
+	}
+	return *latest, nil
+}
+
+func (s *memoryReadingStore) AggregateReadings(ctx context.Context, device string, starts, ends []int64) ([]AggregateBucket, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sums := make([]rollup, len(starts))
+	add := func(d string, ts int64, r rollup) {
+		if device != "" && d != device {
+			return
+		}
+		i, _ := slices.BinarySearch(starts, ts+1)
+		// buckets are contiguous and sorted, i-1 is the last one starting at
+		// or before ts
+		if i == 0 || ts >= ends[i-1] {
+			return
+		}
+		sums[i-1].add(r)
+	}
+	if res := rollupResolution(starts, ends); res != 0 {
+		for key, r := range s.rollups[res] {
+			add(key.device, key.start, *r)
+		}
+	} else {
+		for _, tr := range s.readings {
+			if tr.Quality == qualityGood {
+				add(tr.DeviceId, *tr.Timestamp, readingRollup(tr))
+			}
+		}
+	}
+
+	buckets := make([]AggregateBucket, len(starts))
+	for i, sum := range sums {
+		b := &buckets[i]
+		b.Start, b.End, b.Count = starts[i], ends[i], sum.count
+		if sum.count == 0 {
+			continue
+		}
+		for m, agg := range []*MetricAggregate{&b.TempCo, &b.TempRoom, &b.Humidity} {
+			avg := sum.sum[m] / float64(sum.count)
+			agg.Avg, agg.Min, agg.Max = &avg, &sum.min[m], &sum.max[m]
+		}
+	}
+	return buckets, nil
+}
+
+func (s *memoryReadingStore) CountPrunable(ctx context.Context, q PruneQuery) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var n int64
+	for _, tr := range s.readings {
+		if q.matches(tr) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryReadingStore) PruneReadings(ctx context.Context, q PruneQuery, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matched []TemperatureReading
+	for _, tr := range s.readings {
+		if q.matches(tr) {
+			matched = append(matched, tr)
+		}
+	}
+	slices.SortStableFunc(matched, func(x, y TemperatureReading) int {
+		return cmp.Compare(*x.Timestamp, *y.Timestamp)
+	})
+	pruned := map[int]bool{}
+	for _, tr := range matched[:min(limit, len(matched))] {
+		pruned[tr.Id] = true
+	}
+	s.readings = slices.DeleteFunc(s.readings, func(tr TemperatureReading) bool { return pruned[tr.Id] })
+	return int64(len(pruned)), nil
+}
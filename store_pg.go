@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type pgReadingStore struct {
+	db *pgxpool.Pool
+}
+
+func newPgReadingStore(db *pgxpool.Pool) *pgReadingStore {
+	return &pgReadingStore{db: db}
+}
+
+const readingColumns = `id, device_id, temp_co, temp_room, humidity, timestamp, quality`
+
+func scanReading(row pgx.CollectableRow) (TemperatureReading, error) {
+	var tr TemperatureReading
+	err := row.Scan(&tr.Id, &tr.DeviceId, &tr.TempCo, &tr.TempRoom, &tr.Humidity, &tr.Timestamp, &tr.Quality)
+	return tr, err
+}
+
+// InsertReading stores a reading and marks its device as seen, registering
+// the device first if it has never reported before.
+func (s *pgReadingStore) InsertReading(ctx context.Context, p TemperatureReadingPayload) (TemperatureReading, error) {
+	var tr TemperatureReading
+	err := pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		var err error
+		tr, err = insertReadingTx(ctx, tx, p)
+		return err
+	})
+	return tr, err
+}
+
+// InsertReadings inserts every reading under its own savepoint, so a bad
+// reading doesn't discard the rest of the batch.
+func (s *pgReadingStore) InsertReadings(ctx context.Context, ps []TemperatureReadingPayload) ([]TemperatureReading, []error, error) {
+	var (
+		readings []TemperatureReading
+		errs     []error
+	)
+	err := pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		readings = make([]TemperatureReading, len(ps))
+		errs = make([]error, len(ps))
+		for i, p := range ps {
+			savepoint, err := tx.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			tr, err := insertReadingTx(ctx, savepoint, p)
+			if err != nil {
+				errs[i] = err
+				if err := savepoint.Rollback(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := savepoint.Commit(ctx); err != nil {
+				return err
+			}
+			readings[i] = tr
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return readings, errs, nil
+}
+
+func insertReadingTx(ctx context.Context, tx pgx.Tx, p TemperatureReadingPayload) (TemperatureReading, error) {
+	now := time.Now().UTC().Unix()
+	_, err := tx.Exec(ctx, `
+		INSERT INTO devices (id, name, created_at, last_seen_at)
+		VALUES ($1, $1, $2, $2)
+		ON CONFLICT (id) DO UPDATE SET last_seen_at = EXCLUDED.last_seen_at, offline_at = NULL
+	`, p.DeviceId, now)
+	if err != nil {
+		return TemperatureReading{}, err
+	}
+	rows, err := tx.Query(ctx, `
+		INSERT INTO readings (device_id, temp_co, temp_room, humidity, timestamp, quality)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+readingColumns,
+		p.DeviceId, p.TempCo, p.TempRoom, p.Humidity, *p.Timestamp, p.quality())
+	if err != nil {
+		return TemperatureReading{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, scanReading)
+}
+
+func (s *pgReadingStore) query(ctx context.Context, q ReadingQuery) (pgx.Rows, error) {
+	query := `
+		SELECT ` + readingColumns + `
+		FROM readings
+		WHERE 1=1`
+	args := []interface{}{}
+	argIndex := 1
+
+	if q.Device != "" {
+		query += fmt.Sprintf(" AND device_id = $%d", argIndex)
+		args = append(args, q.Device)
+		argIndex++
+	}
+	if q.From != nil {
+		query += fmt.Sprintf(" AND timestamp >= $%d", argIndex)
+		args = append(args, *q.From)
+		argIndex++
+	}
+	if q.To != nil {
+		query += fmt.Sprintf(" AND timestamp <= $%d", argIndex)
+		args = append(args, *q.To)
+		argIndex++
+	}
+	if q.AfterId > 0 {
+		query += fmt.Sprintf(" AND id > $%d", argIndex)
+		args = append(args, q.AfterId)
+		argIndex++
+	}
+	if q.Before != nil {
+		query += fmt.Sprintf(" AND (timestamp, id) < ($%d, $%d)", argIndex, argIndex+1)
+		args = append(args, q.Before.Timestamp, q.Before.Id)
+		argIndex += 2
+	}
+	if q.After != nil {
+		query += fmt.Sprintf(" AND (timestamp, id) > ($%d, $%d)", argIndex, argIndex+1)
+		args = append(args, q.After.Timestamp, q.After.Id)
+		argIndex += 2
+	}
+
+	switch q.Order {
+	case orderNewestFirst:
+		query += ` ORDER BY timestamp DESC, id DESC`
+	case orderOldestFirst:
+		query += ` ORDER BY timestamp, id`
+	case orderById:
+		query += ` ORDER BY id`
+	}
+	if q.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT $%d`, argIndex)
+		args = append(args, q.Limit)
+		argIndex++
+	}
+	if q.Offset > 0 {
+		query += fmt.Sprintf(` OFFSET $%d`, argIndex)
+		args = append(args, q.Offset)
+	}
+	return s.db.Query(ctx, query, args...)
+}
+
+func (s *pgReadingStore) QueryReadings(ctx context.Context, q ReadingQuery) ([]TemperatureReading, error) {
+	rows, err := s.query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	readings, err := pgx.CollectRows(rows, scanReading)
+	if readings == nil {
+		readings = make([]TemperatureReading, 0)
+	}
+	return readings, err
+}
+
+func (s *pgReadingStore) EachReading(ctx context.Context, q ReadingQuery, fn func(TemperatureReading) error) error {
+	rows, err := s.query(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		tr, err := scanReading(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(tr); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *pgReadingStore) LatestReading(ctx context.Context, device string) (TemperatureReading, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT `+readingColumns+`
+		FROM readings
+		WHERE $1::TEXT = '' OR device_id = $1
+		ORDER BY timestamp DESC, id DESC
+		LIMIT 1
+	`, device)
+	if err != nil {
+		return TemperatureReading{}, err
+	}
+	tr, err := pgx.CollectExactlyOneRow(rows, scanReading)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return tr, errNoReadings
+	}
+	return tr, err
+}
+
+func (s *pgReadingStore) AggregateReadings(ctx context.Context, device string, starts, ends []int64) ([]AggregateBucket, error) {
+	table, column, aggregates := aggregateSource(starts, ends)
+	rows, err := s.db.Query(ctx, `
+		SELECT b.start_ts, b.end_ts, `+aggregates+`
+		FROM unnest($1::BIGINT[], $2::BIGINT[]) AS b (start_ts, end_ts)
+		LEFT JOIN `+table+` r
+			ON r.`+column+` >= b.start_ts AND r.`+column+` < b.end_ts
+			AND ($3::TEXT = '' OR r.device_id = $3)
+		GROUP BY b.start_ts, b.end_ts
+		ORDER BY b.start_ts
+	`, starts, ends, device)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make([]AggregateBucket, 0, len(starts))
+	for rows.Next() {
+		var b AggregateBucket
+		if err := rows.Scan(&b.Start, &b.End, &b.Count,
+			&b.TempCo.Avg, &b.TempCo.Min, &b.TempCo.Max,
+			&b.TempRoom.Avg, &b.TempRoom.Min, &b.TempRoom.Max,
+			&b.Humidity.Avg, &b.Humidity.Min, &b.Humidity.Max); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+func pruneExcept(q PruneQuery) []string {
+	// a NULL array would match nothing
+	if q.Except == nil {
+		return []string{}
+	}
+	return q.Except
+}
+
+func (s *pgReadingStore) CountPrunable(ctx context.Context, q PruneQuery) (int64, error) {
+	var n int64
+	err := s.db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM readings
+		WHERE timestamp < $1
+			AND ($2::TEXT = '' OR device_id = $2)
+			AND NOT device_id = ANY($3::TEXT[])
+	`, q.Before, q.Device, pruneExcept(q)).Scan(&n)
+	return n, err
+}
+
+func (s *pgReadingStore) PruneReadings(ctx context.Context, q PruneQuery, limit int) (int64, error) {
+	tag, err := s.db.Exec(ctx, `
+		DELETE FROM readings WHERE id IN (
+			SELECT id FROM readings
+			WHERE timestamp < $1
+				AND ($2::TEXT = '' OR device_id = $2)
+				AND NOT device_id = ANY($3::TEXT[])
+			ORDER BY timestamp
+			LIMIT $4
+		)
+	`, q.Before, q.Device, pruneExcept(q), limit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
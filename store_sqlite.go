@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteReadingStore keeps readings in a SQLite file, for single-board
+// deployments without a Postgres server. It only serves readings; devices
+// are recorded as readings arrive but device management, keys, alerts and
+// webhooks need Postgres, and their tables aren't created.
+type sqliteReadingStore struct {
+	db *sql.DB
+}
+
+// openSQLite opens the database at path, creating it if needed. Writes take
+// the lock when their transaction begins so concurrent writers wait on
+// busy_timeout rather than failing halfway.
+func openSQLite(ctx context.Context, path string) (*sql.DB, error) {
+	params := url.Values{}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func newSQLiteReadingStore(db *sql.DB) *sqliteReadingStore {
+	return &sqliteReadingStore{db: db}
+}
+
+func scanSQLiteReading(row interface{ Scan(...any) error }) (TemperatureReading, error) {
+	var tr TemperatureReading
+	err := row.Scan(&tr.Id, &tr.DeviceId, &tr.TempCo, &tr.TempRoom, &tr.Humidity, &tr.Timestamp, &tr.Quality)
+	return tr, err
+}
+
+func (s *sqliteReadingStore) InsertReading(ctx context.Context, p TemperatureReadingPayload) (TemperatureReading, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return TemperatureReading{}, err
+	}
+	defer tx.Rollback()
+	tr, err := insertSQLiteReadingTx(ctx, tx, p)
+	if err != nil {
+		return TemperatureReading{}, err
+	}
+	return tr, tx.Commit()
+}
+
+// InsertReadings inserts every reading under its own savepoint, like the
+// Postgres store.
+func (s *sqliteReadingStore) InsertReadings(ctx context.Context, ps []TemperatureReadingPayload) ([]TemperatureReading, []error, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	readings := make([]TemperatureReading, len(ps))
+	errs := make([]error, len(ps))
+	for i, p := range ps {
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT reading`); err != nil {
+			return nil, nil, err
+		}
+		tr, err := insertSQLiteReadingTx(ctx, tx, p)
+		if err != nil {
+			errs[i] = err
+			if _, err := tx.ExecContext(ctx, `ROLLBACK TO reading`); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			readings[i] = tr
+		}
+		if _, err := tx.ExecContext(ctx, `RELEASE reading`); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return readings, errs, nil
+}
+
+func insertSQLiteReadingTx(ctx context.Context, tx *sql.Tx, p TemperatureReadingPayload) (TemperatureReading, error) {
+	now := time.Now().UTC().Unix()
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO devices (id, name, created_at, last_seen_at)
+		VALUES (?1, ?1, ?2, ?2)
+		ON CONFLICT (id) DO UPDATE SET last_seen_at = excluded.last_seen_at, offline_at = NULL
+	`, p.DeviceId, now)
+	if err != nil {
+		return TemperatureReading{}, err
+	}
+	return scanSQLiteReading(tx.QueryRowContext(ctx, `
+		INSERT INTO readings (device_id, temp_co, temp_room, humidity, timestamp, quality)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING `+readingColumns,
+		p.DeviceId, p.TempCo, p.TempRoom, p.Humidity, *p.Timestamp, p.quality()))
+}
+
+func (s *sqliteReadingStore) query(ctx context.Context, q ReadingQuery) (*sql.Rows, error) {
+	query := `
+		SELECT ` + readingColumns + `
+		FROM readings
+		WHERE 1=1`
+	args := []interface{}{}
+
+	if q.Device != "" {
+		query += ` AND device_id = ?`
+		args = append(args, q.Device)
+	}
+	if q.From != nil {
+		query += ` AND timestamp >= ?`
+		args = append(args, *q.From)
+	}
+	if q.To != nil {
+		query += ` AND timestamp <= ?`
+		args = append(args, *q.To)
+	}
+	if q.AfterId > 0 {
+		query += ` AND id > ?`
+		args = append(args, q.AfterId)
+	}
+	if q.Before != nil {
+		query += ` AND (timestamp, id) < (?, ?)`
+		args = append(args, q.Before.Timestamp, q.Before.Id)
+	}
+	if q.After != nil {
+		query += ` AND (timestamp, id) > (?, ?)`
+		args = append(args, q.After.Timestamp, q.After.Id)
+	}
+
+	switch q.Order {
+	case orderNewestFirst:
+		query += ` ORDER BY timestamp DESC, id DESC`
+	case orderOldestFirst:
+		query += ` ORDER BY timestamp, id`
+	case orderById:
+		query += ` ORDER BY id`
+	}
+	// SQLite only accepts OFFSET after a LIMIT, -1 is no limit
+	if q.Limit > 0 || q.Offset > 0 {
+		limit := q.Limit
+		if limit == 0 {
+			limit = -1
+		}
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, limit, q.Offset)
+	}
+	return s.db.QueryContext(ctx, query, args...)
+}
+
+func (s *sqliteReadingStore) QueryReadings(ctx context.Context, q ReadingQuery) ([]TemperatureReading, error) {
+	readings := make([]TemperatureReading, 0)
+	err := s.EachReading(ctx, q, func(tr TemperatureReading) error {
+		readings = append(readings, tr)
+		return nil
+	})
+	return readings, err
+}
+
+func (s *sqliteReadingStore) EachReading(ctx context.Context, q ReadingQuery, fn func(TemperatureReading) error) error {
+	rows, err := s.query(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		tr, err := scanSQLiteReading(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(tr); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteReadingStore) LatestReading(ctx context.Context, device string) (TemperatureReading, error) {
+	tr, err := scanSQLiteReading(s.db.QueryRowContext(ctx, `
+		SELECT `+readingColumns+`
+		FROM readings
+		WHERE ?1 = '' OR device_id = ?1
+		ORDER BY timestamp DESC, id DESC
+		LIMIT 1
+	`, device))
+	if errors.Is(err, sql.ErrNoRows) {
+		return tr, errNoReadings
+	}
+	return tr, err
+}
+
+// AggregateReadings passes the buckets as a JSON array of [start, end] pairs,
+// SQLite has no arrays to unnest.
+func (s *sqliteReadingStore) AggregateReadings(ctx context.Context, device string, starts, ends []int64) ([]AggregateBucket, error) {
+	pairs := make([][2]int64, len(starts))
+	for i := range starts {
+		pairs[i] = [2]int64{starts[i], ends[i]}
+	}
+	bounds, err := json.Marshal(pairs)
+	if err != nil {
+		return nil, err
+	}
+	table, column, aggregates := aggregateSource(starts, ends)
+	rows, err := s.db.QueryContext(ctx, `
+		WITH b (start_ts, end_ts) AS (
+			SELECT json_extract(value, '$[0]'), json_extract(value, '$[1]')
+			FROM json_each(?1)
+		)
+		SELECT b.start_ts, b.end_ts, `+aggregates+`
+		FROM b
+		LEFT JOIN `+table+` r
+			ON r.`+column+` >= b.start_ts AND r.`+column+` < b.end_ts
+			AND (?2 = '' OR r.device_id = ?2)
+		GROUP BY b.start_ts, b.end_ts
+		ORDER BY b.start_ts
+	`, string(bounds), device)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make([]AggregateBucket, 0, len(starts))
+	for rows.Next() {
+		var b AggregateBucket
+		if err := rows.Scan(&b.Start, &b.End, &b.Count,
+			&b.TempCo.Avg, &b.TempCo.Min, &b.TempCo.Max,
+			&b.TempRoom.Avg, &b.TempRoom.Min, &b.TempRoom.Max,
+			&b.Humidity.Avg, &b.Humidity.Min, &b.Humidity.Max); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// sqlitePruneFilter selects the readings of a PruneQuery given as ?1 before, ?2
+// device and ?3 a JSON array of excluded devices.
+const sqlitePruneFilter = `
+	timestamp < ?1
+	AND (?2 = '' OR device_id = ?2)
+	AND device_id NOT IN (SELECT value FROM json_each(?3))`
+
+func sqlitePruneArgs(q PruneQuery) ([]any, error) {
+	except, err := json.Marshal(pruneExcept(q))
+	if err != nil {
+		return nil, err
+	}
+	return []any{q.Before, q.Device, string(except)}, nil
+}
+
+func (s *sqliteReadingStore) CountPrunable(ctx context.Context, q PruneQuery) (int64, error) {
+	args, err := sqlitePruneArgs(q)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM readings WHERE `+sqlitePruneFilter, args...).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteReadingStore) PruneReadings(ctx context.Context, q PruneQuery, limit int) (int64, error) {
+	args, err := sqlitePruneArgs(q)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM readings WHERE id IN (
+			SELECT id FROM readings
+			WHERE `+sqlitePruneFilter+`
+			ORDER BY timestamp
+			LIMIT ?4
+		)
+	`, append(args, limit)...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// sqliteMigrator migrates a SQLite database. There's no advisory lock, each
+// migration's transaction takes the write lock and skips the migration if
+// another process applied it first.
+type sqliteMigrator struct {
+	db *sql.DB
+}
+
+func (m *sqliteMigrator) dir() string { return "migrations/sqlite" }
+
+func (m *sqliteMigrator) lock(ctx context.Context) (func(), error) {
+	_, err := m.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at BIGINT NOT NULL
+		)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return func() {}, nil
+}
+
+func (m *sqliteMigrator) applied(ctx context.Context) ([]appliedMigration, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied []appliedMigration
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.version, &a.name, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+func (m *sqliteMigrator) apply(ctx context.Context, mig migration, up bool) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var done bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)`, mig.version).Scan(&done)
+	if err != nil {
+		return err
+	}
+	if done == up {
+		return nil
+	}
+	if up {
+		if _, err := tx.ExecContext(ctx, mig.up); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			mig.version, mig.name, time.Now().UTC().Unix())
+	} else {
+		if _, err := tx.ExecContext(ctx, mig.down); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = ?`, mig.version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testReadingStore checks the behaviour every ReadingStore shares
+func testReadingStore(t *testing.T, store ReadingStore) {
+	ctx := context.Background()
+	payload := func(device string, tempCo float64, ts int64) TemperatureReadingPayload {
+		return TemperatureReadingPayload{DeviceId: device, TempCo: tempCo, TempRoom: 20, Humidity: 50, Timestamp: &ts}
+	}
+
+	_, err := store.LatestReading(ctx, "")
+	assert.ErrorIs(t, err, errNoReadings)
+
+	first, err := store.InsertReading(ctx, payload("esp-a", 21, 1000))
+	require.NoError(t, err)
+	assert.Equal(t, "esp-a", first.DeviceId)
+	assert.Equal(t, int64(1000), *first.Timestamp)
+
+	// a late reading gets a higher id but an older timestamp
+	readings, errs, err := store.InsertReadings(ctx, []TemperatureReadingPayload{
+		payload("esp-b", 22, 1100),
+		payload("esp-a", 23, 1200),
+		payload("esp-a", 24, 900),
+	})
+	require.NoError(t, err)
+	require.Len(t, readings, 3)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Greater(t, readings[0].Id, first.Id)
+
+	tempCos := func(readings []TemperatureReading) []float64 {
+		var v []float64
+		for _, tr := range readings {
+			v = append(v, tr.TempCo)
+		}
+		return v
+	}
+
+	all, err := store.QueryReadings(ctx, ReadingQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{23, 22, 21, 24}, tempCos(all))
+
+	from, to := int64(1000), int64(1200)
+	page, err := store.QueryReadings(ctx, ReadingQuery{Device: "esp-a", From: &from, To: &to, Limit: 1, Offset: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{21}, tempCos(page))
+
+	after, err := store.QueryReadings(ctx, ReadingQuery{AfterId: int64(first.Id), Order: orderById})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{22, 23, 24}, tempCos(after))
+
+	// keyset positions compare by timestamp then id
+	before, err := store.QueryReadings(ctx, ReadingQuery{Before: &readingKey{Timestamp: 1100, Id: readings[0].Id}, Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{21, 24}, tempCos(before))
+	newer, err := store.QueryReadings(ctx, ReadingQuery{After: &readingKey{Timestamp: 1000, Id: first.Id}, Order: orderOldestFirst})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{22, 23}, tempCos(newer))
+
+	var oldest []TemperatureReading
+	err = store.EachReading(ctx, ReadingQuery{Order: orderOldestFirst}, func(tr TemperatureReading) error {
+		oldest = append(oldest, tr)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{24, 21, 22, 23}, tempCos(oldest))
+
+	stop := errors.New("stop")
+	n := 0
+	err = store.EachReading(ctx, ReadingQuery{}, func(TemperatureReading) error {
+		n++
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, n)
+
+	empty, err := store.QueryReadings(ctx, ReadingQuery{Device: "esp-c"})
+	require.NoError(t, err)
+	assert.NotNil(t, empty)
+	assert.Empty(t, empty)
+
+	latest, err := store.LatestReading(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, 23.0, latest.TempCo)
+	latest, err = store.LatestReading(ctx, "esp-b")
+	require.NoError(t, err)
+	assert.Equal(t, 22.0, latest.TempCo)
+
+	buckets, err := store.AggregateReadings(ctx, "esp-a", []int64{800, 1000, 1300}, []int64{1000, 1300, 1400})
+	require.NoError(t, err)
+	require.Len(t, buckets, 3)
+	assert.Equal(t, int64(1), buckets[0].Count)
+	assert.Equal(t, int64(2), buckets[1].Count)
+	assert.Equal(t, 22.0, *buckets[1].TempCo.Avg)
+	assert.Equal(t, 21.0, *buckets[1].TempCo.Min)
+	assert.Equal(t, 23.0, *buckets[1].TempCo.Max)
+	assert.Equal(t, int64(0), buckets[2].Count)
+	assert.Nil(t, buckets[2].TempCo.Avg)
+
+	prunable, err := store.CountPrunable(ctx, PruneQuery{Before: 1150})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), prunable)
+	prunable, err = store.CountPrunable(ctx, PruneQuery{Before: 1150, Except: []string{"esp-b"}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), prunable)
+
+	// the oldest go first
+	pruned, err := store.PruneReadings(ctx, PruneQuery{Device: "esp-a", Before: 1150}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), pruned)
+	remaining, err := store.QueryReadings(ctx, ReadingQuery{Device: "esp-a"})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{23, 21}, tempCos(remaining))
+
+	// ids aren't reused after pruning
+	last, err := store.InsertReading(ctx, payload("esp-a", 25, 1300))
+	require.NoError(t, err)
+	assert.Greater(t, last.Id, readings[2].Id)
+
+	// whole hours and days come from the rollups, which keep pruned readings
+	for _, res := range []int64{rollupHour, rollupDay} {
+		buckets, err = store.AggregateReadings(ctx, "esp-a", []int64{0, res}, []int64{res, 2 * res})
+		require.NoError(t, err)
+		require.Len(t, buckets, 2)
+		assert.Equal(t, int64(4), buckets[0].Count, res)
+		assert.Equal(t, 23.25, *buckets[0].TempCo.Avg, res)
+		assert.Equal(t, 21.0, *buckets[0].TempCo.Min, res)
+		assert.Equal(t, 25.0, *buckets[0].TempCo.Max, res)
+		assert.Equal(t, int64(0), buckets[1].Count, res)
+		assert.Nil(t, buckets[1].TempCo.Avg, res)
+	}
+	assert.Equal(t, qualityGood, last.Quality)
+
+	// suspect readings are stored but left out of aggregates and rollups
+	suspect := payload("esp-a", 85, 1350)
+	suspect.Quality = qualitySuspect
+	flagged, err := store.InsertReading(ctx, suspect)
+	require.NoError(t, err)
+	assert.Equal(t, qualitySuspect, flagged.Quality)
+	latest, err = store.LatestReading(ctx, "esp-a")
+	require.NoError(t, err)
+	assert.Equal(t, flagged, latest)
+	buckets, err = store.AggregateReadings(ctx, "esp-a", []int64{1300}, []int64{1400})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), buckets[0].Count)
+	assert.Equal(t, 25.0, *buckets[0].TempCo.Max)
+	for _, res := range []int64{rollupHour, rollupDay} {
+		buckets, err = store.AggregateReadings(ctx, "esp-a", []int64{0}, []int64{res})
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), buckets[0].Count, res)
+		assert.Equal(t, 25.0, *buckets[0].TempCo.Max, res)
+	}
+}
+
+func TestMemoryReadingStore(t *testing.T) {
+	testReadingStore(t, newMemoryReadingStore())
+}
+
+func TestPgReadingStore(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	testReadingStore(t, newPgReadingStore(db))
+}
+
+func TestDataHandlerMemoryStore(t *testing.T) {
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret"}
+
+	for i, body := range []string{
+		`{"deviceId": "esp-a", "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0, "timestamp": 1761388101}`,
+		`{"deviceId": "esp-b", "tempCo": 26.5, "tempRoom": 23.0, "humidity": 61.0, "timestamp": 1761388102}`,
+		`{"deviceId": "esp-a", "tempCo": 27.5, "tempRoom": 24.0, "humidity": 62.0, "timestamp": 1761388103}`,
+	} {
+		req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+		req.Header.Set("X-Secret-Key", "testsecret")
+		w := httptest.NewRecorder()
+		app.dataHandler(w, req)
+		require.Equal(t, http.StatusOK, w.Code, i)
+	}
+
+	req := httptest.NewRequest("GET", "/data?device=esp-a&limit=1&offset=1", nil)
+	w := httptest.NewRecorder()
+	app.dataHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var readings []TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&readings))
+	require.Len(t, readings, 1)
+	assert.Equal(t, 25.5, readings[0].TempCo)
+
+	req = httptest.NewRequest("GET", "/data/latest?device=esp-b", nil)
+	w = httptest.NewRecorder()
+	app.dataLatestHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var latest TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&latest))
+	assert.Equal(t, 26.5, latest.TempCo)
+
+	req = httptest.NewRequest("GET", "/data/latest?device=esp-c", nil)
+	w = httptest.NewRecorder()
+	app.dataLatestHandler(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// sseReplayPageSize is how many missed readings are queried at once
+const sseReplayPageSize = 1000
+
+var sseHeartbeatInterval = 15 * time.Second
+
+func readingEvent(tr TemperatureReading) Event {
+	return Event{Type: eventReading, Id: int64(tr.Id), DeviceId: tr.DeviceId, Data: tr}
+}
+
+func writeSSE(w io.Writer, e Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+	return err
+}
+
+// dataStreamHandler pushes readings as server-sent events. A client resuming
+// with Last-Event-ID (or the lastEventId query parameter, for the first
+// EventSource connection) first receives the readings it missed.
+func (a *app) dataStreamHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		writeProblem(w, problemMethodNotAllowed, "")
+		return
+	}
+
+	device := r.URL.Query().Get("device")
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	var resumeFrom int64 = -1
+	if lastEventId != "" {
+		id, err := strconv.ParseInt(lastEventId, 10, 64)
+		if err != nil || id < 0 {
+			writeProblem(w, problemMalformedRequest, "Last-Event-ID must be a reading id")
+			return
+		}
+		resumeFrom = id
+	}
+
+	// Subscribe before replaying so nothing inserted in between is lost,
+	// duplicates are skipped by id below
+	sub := a.hub.subscribe(func(e Event) bool {
+		return e.Type == eventReading && (device == "" || e.DeviceId == device)
+	})
+	defer a.hub.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	// Streams outlive the server write timeout
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Missed readings are replayed a page at a time until the replay has
+	// caught up with the live events, which resume after the last one
+	replayedUpTo := resumeFrom
+	for resumeFrom >= 0 {
+		missed, err := a.readings.QueryReadings(r.Context(), ReadingQuery{
+			Device:  device,
+			AfterId: replayedUpTo,
+			Order:   orderById,
+			Limit:   sseReplayPageSize,
+		})
+		if err != nil {
+			logger.Error("Failed to query missed temperature readings", "error", err)
+			return
+		}
+		for _, tr := range missed {
+			if err := writeSSE(w, readingEvent(tr)); err != nil {
+				return
+			}
+			replayedUpTo = int64(tr.Id)
+		}
+		if len(missed) < sseReplayPageSize {
+			break
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		logger.Error("Streaming not supported", "error", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.events:
+			if !ok {
+				if !a.hub.isClosed() {
+					logger.Info("Stream subscriber dropped")
+				}
+				return
+			}
+			if e.Id <= replayedUpTo {
+				continue
+			}
+			if err := writeSSE(w, e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
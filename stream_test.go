@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readSSE returns the next event of a stream, skipping comments
+func readSSE(t *testing.T, r *bufio.Reader) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(fields) > 0 {
+				return fields
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			fields["comment"] = strings.TrimSpace(line[1:])
+			continue
+		}
+		k, v, _ := strings.Cut(line, ": ")
+		fields[k] = v
+	}
+}
+
+func openStream(t *testing.T, url string, lastEventId string) *bufio.Reader {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	require.NoError(t, err)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewReader(resp.Body)
+}
+
+func waitForSubscribers(t *testing.T, hub *eventHub, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return len(hub.subs) == n
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestDataStreamHandler(t *testing.T) {
+	app := &app{hub: newEventHub()}
+	srv := httptest.NewServer(loggingMiddleware(http.HandlerFunc(app.dataStreamHandler)))
+	t.Cleanup(srv.Close)
+
+	all := openStream(t, srv.URL+"/data/stream", "")
+	filtered := openStream(t, srv.URL+"/data/stream?device=esp-b", "")
+	waitForSubscribers(t, app.hub, 2)
+
+	ts := int64(1761388101)
+	app.hub.publish(readingEvent(TemperatureReading{Id: 7, DeviceId: "esp-a", TempCo: 25.5, Timestamp: &ts}))
+	app.hub.publish(readingEvent(TemperatureReading{Id: 8, DeviceId: "esp-b", TempCo: 26.5, Timestamp: &ts}))
+
+	e := readSSE(t, all)
+	assert.Equal(t, "7", e["id"])
+	assert.Equal(t, "reading", e["event"])
+	var tr TemperatureReading
+	require.NoError(t, json.Unmarshal([]byte(e["data"]), &tr))
+	assert.Equal(t, 25.5, tr.TempCo)
+	assert.Equal(t, "8", readSSE(t, all)["id"])
+
+	assert.Equal(t, "8", readSSE(t, filtered)["id"])
+}
+
+func TestDataStreamHandlerHeartbeat(t *testing.T) {
+	interval := sseHeartbeatInterval
+	sseHeartbeatInterval = 10 * time.Millisecond
+	defer func() { sseHeartbeatInterval = interval }()
+
+	app := &app{hub: newEventHub()}
+	srv := httptest.NewServer(http.HandlerFunc(app.dataStreamHandler))
+	t.Cleanup(srv.Close)
+
+	stream := openStream(t, srv.URL+"/data/stream", "")
+	line, err := stream.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, ": heartbeat\n", line)
+}
+
+func TestDataStreamHandlerInvalidLastEventId(t *testing.T) {
+	app := &app{hub: newEventHub()}
+	req := httptest.NewRequest("GET", "/data/stream", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	w := httptest.NewRecorder()
+
+	app.dataStreamHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDataStreamHandlerResume(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "dummy", hub: newEventHub()}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	var ids []int
+	for i := range 3 {
+		var id int
+		err := db.QueryRow(context.Background(),
+			"INSERT INTO readings (temp_co, temp_room, humidity, timestamp) VALUES ($1, 18, 50, $2) RETURNING id",
+			20.0+float64(i), 1761388101+i).Scan(&id)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(app.dataStreamHandler))
+	t.Cleanup(srv.Close)
+
+	stream := openStream(t, srv.URL+"/data/stream", fmt.Sprint(ids[0]))
+	assert.Equal(t, fmt.Sprint(ids[1]), readSSE(t, stream)["id"])
+	assert.Equal(t, fmt.Sprint(ids[2]), readSSE(t, stream)["id"])
+
+	// live events already replayed are not sent twice
+	waitForSubscribers(t, app.hub, 1)
+	app.hub.publish(readingEvent(TemperatureReading{Id: ids[2]}))
+	app.hub.publish(readingEvent(TemperatureReading{Id: ids[2] + 1}))
+	assert.Equal(t, fmt.Sprint(ids[2]+1), readSSE(t, stream)["id"])
+}
+
+func TestDataStreamHandlerResumePaged(t *testing.T) {
+	app := &app{readings: newMemoryReadingStore(), hub: newEventHub()}
+	ts := int64(1761388101)
+	payloads := make([]TemperatureReadingPayload, sseReplayPageSize*2+1)
+	for i := range payloads {
+		payloads[i] = TemperatureReadingPayload{DeviceId: "esp-a", Timestamp: &ts}
+	}
+	_, _, err := app.readings.InsertReadings(context.Background(), payloads)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(app.dataStreamHandler))
+	t.Cleanup(srv.Close)
+
+	// every missed reading is replayed, not just the first page
+	stream := openStream(t, srv.URL+"/data/stream", "1")
+	for id := 2; id <= len(payloads); id++ {
+		require.Equal(t, fmt.Sprint(id), readSSE(t, stream)["id"])
+	}
+	waitForSubscribers(t, app.hub, 1)
+	app.hub.publish(readingEvent(TemperatureReading{Id: len(payloads) + 1}))
+	assert.Equal(t, fmt.Sprint(len(payloads)+1), readSSE(t, stream)["id"])
+}
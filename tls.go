@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for
+// changes, SIGHUP reloads them straight away
+const tlsReloadInterval = 30 * time.Second
+
+// Client certificate modes, tls.client_auth
+const (
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+// certReloader serves a certificate and key pair from disk, reloading it
+// when either file changes so renewed certificates are picked up without a
+// restart. A pair that fails to load keeps the previous one in service.
+type certReloader struct {
+	certFile, keyFile string
+	logger            *slog.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string, logger *slog.Logger) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger.With("component", "tls"),
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// filesModTime is the latest modification time of the pair
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// reloadIfChanged reloads the pair if either file changed since it was
+// loaded, it reports whether a new pair is in service
+func (c *certReloader) reloadIfChanged() (bool, error) {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	changed := !modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	return true, c.reload()
+}
+
+// run reloads the pair when the files change or on SIGHUP until ctx is done
+func (c *certReloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := c.reload(); err != nil {
+				c.logger.Error("Failed to reload certificate, keeping the previous one", "error", err)
+				continue
+			}
+			c.logger.Info("Reloaded certificate on SIGHUP", "cert", c.certFile)
+		case <-ticker.C:
+			reloaded, err := c.reloadIfChanged()
+			if err != nil {
+				c.logger.Error("Failed to reload certificate, keeping the previous one", "error", err)
+				continue
+			}
+			if reloaded {
+				c.logger.Info("Reloaded changed certificate", "cert", c.certFile)
+			}
+		}
+	}
+}
+
+// errClientCertRequired refuses device requests without a client certificate
+// under tls.client_auth require
+var errClientCertRequired = errors.New("client certificate required")
+
+// newTLSConfig serves the reloader's certificate. With a client CA, client
+// certificates it signed authenticate devices. Connections without one are
+// accepted either way, the dashboard and /metrics don't have one;
+// tls.client_auth require is enforced on device requests, see
+// authenticateRequest.
+func newTLSConfig(certs *certReloader, clientCA string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+	if clientCA == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCA)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, nil
+}
+
+// clientCertDevice is the device a request was authenticated as by its
+// client certificate, the certificate's common name. It is "" without a
+// certificate verified against the client CA.
+func clientCertDevice(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; validDeviceId(cn) {
+		return cn
+	}
+	return ""
+}
+
+// redirectHandler sends plain HTTP requests to the same URL over HTTPS on
+// httpsPort
+func redirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert issues a certificate for cn signed by parent, or self-signed
+// CA without a parent
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves the certificate and key as PEM files in dir
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test ca", nil)
+	certFile, keyFile := newTestCert(t, "first", ca).write(t, dir, "server")
+
+	certs, err := newCertReloader(certFile, keyFile, slog.Default())
+	require.NoError(t, err)
+	commonName := func() string {
+		cert, err := certs.getCertificate(nil)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+	assert.Equal(t, "first", commonName())
+
+	reloaded, err := certs.reloadIfChanged()
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	// a renewed pair is picked up
+	newTestCert(t, "second", ca).write(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	reloaded, err = certs.reloadIfChanged()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "second", commonName())
+
+	// a broken pair keeps the previous one in service
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	assert.Error(t, certs.reload())
+	assert.Equal(t, "second", commonName())
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, dir, "server")
+	certs, err := newCertReloader(certFile, keyFile, slog.Default())
+	require.NoError(t, err)
+
+	// httptest.Server would serve its own certificate
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret"}
+	srv := &http.Server{Handler: http.HandlerFunc(app.dataHandler)}
+	srv.TLSConfig, err = newTLSConfig(certs, caFile)
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+	url := "https://" + ln.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+	post := func(c *http.Client, body string) *http.Response {
+		resp, err := c.Post(url+"/data", "application/json", bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// the certificate authenticates its device without a key
+	device := newTestCert(t, "esp-a", ca).tlsCertificate()
+	resp := post(client(device), `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var tr TemperatureReading
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&tr))
+	assert.Equal(t, "esp-a", tr.DeviceId)
+
+	// and can't claim another device
+	resp = post(client(device), `{"deviceId": "esp-b", "tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// without a certificate the key is still needed in optional mode
+	resp = post(client(), `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// nor does a certificate from another CA
+	other := newTestCert(t, "esp-a", newTestCert(t, "other ca", nil)).tlsCertificate()
+	resp = post(client(other), `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// require refuses the key on device requests only, the dashboard still
+	// connects without a certificate
+	app.requireClientCert = true
+	req, err := http.NewRequest("POST", url+"/data", bytes.NewReader([]byte(`{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`)))
+	require.NoError(t, err)
+	req.Header.Set("X-Secret-Key", "testsecret")
+	resp, err = client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = post(client(device), `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = client().Get(url + "/data")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		port      int
+		host, url string
+		want      string
+	}{
+		{443, "example.com", "/data?device=esp-a", "https://example.com/data?device=esp-a"},
+		{443, "example.com:80", "/", "https://example.com/"},
+		{8443, "example.com:8080", "/health", "https://example.com:8443/health"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.url, nil)
+		req.Host = tt.host
+		w := httptest.NewRecorder()
+		redirectHandler(tt.port).ServeHTTP(w, req)
+		assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+		assert.Equal(t, tt.want, w.Header().Get("Location"))
+	}
+}
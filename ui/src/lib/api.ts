@@ -7,6 +7,9 @@ export type GetReadingsQueryParams = {
 	from?: number;
 	limit?: number;
 	offset?: number;
+	// cursor from the X-Next-Cursor or X-Prev-Cursor header of a previous page
+	cursor?: string;
+	device?: string;
 };
 
 export async function getReadings(params: GetReadingsQueryParams): Promise<Reading[]> {
@@ -16,6 +19,8 @@ export async function getReadings(params: GetReadingsQueryParams): Promise<Readi
 	if (params.from !== undefined) searchParams.append('from', params.from.toString());
 	if (params.limit !== undefined) searchParams.append('limit', params.limit.toString());
 	if (params.offset !== undefined) searchParams.append('offset', params.offset.toString());
+	if (params.cursor !== undefined) searchParams.append('cursor', params.cursor);
+	if (params.device !== undefined) searchParams.append('device', params.device);
 
 	const url = `${baseUrl}/data${searchParams.toString() ? '?' + searchParams.toString() : ''}`;
 	console.log({ url });
@@ -27,8 +32,26 @@ export async function getReadings(params: GetReadingsQueryParams): Promise<Readi
 	});
 
 	if (!response.ok) {
-		throw new Error(`Failed to fetch data: ${response.statusText}`);
+		throw new Error(`Failed to fetch data: ${await errorMessage(response)}`);
 	}
 
 	return response.json();
 }
+
+// errorMessage is the detail of a problem+json error response, see the
+// Errors section of the README
+async function errorMessage(response: Response): Promise<string> {
+	if (response.headers.get('Content-Type')?.startsWith('application/problem+json')) {
+		const problem = await response.json();
+		return problem.detail || problem.title;
+	}
+	return response.statusText;
+}
+
+// subscribeReadings calls onReading for every new reading pushed by the
+// server, EventSource reconnects and resumes by itself
+export function subscribeReadings(onReading: (reading: Reading) => void): () => void {
+	const source = new EventSource(`${baseUrl}/data/stream`);
+	source.addEventListener('reading', (e) => onReading(JSON.parse((e as MessageEvent).data)));
+	return () => source.close();
+}
@@ -1,5 +1,6 @@
 export interface Reading {
 	id: number;
+	deviceId: string;
 	timestamp: number; // Unix timestamp in seconds
 	tempCo: number;
 	tempRoom: number;
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// Reading qualities, the quality column
+const (
+	qualityGood    = "good"
+	qualitySuspect = "suspect"
+)
+
+// Validation modes, validation.mode
+const (
+	validationReject = "reject"
+	validationFlag   = "flag"
+)
+
+var errInvalidReading = errors.New("invalid reading")
+
+// fieldError is a problem with one field of a reading, named as in the JSON
+// payload
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// invalidReadingError lists every field of a reading that failed validation
+type invalidReadingError struct {
+	Fields []fieldError
+	// storable is false if a value can't be stored at all, like NaN
+	storable bool
+}
+
+func (e *invalidReadingError) Error() string { return "invalid reading: " + e.fieldList() }
+
+func (e *invalidReadingError) fieldList() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, ", ")
+}
+
+func (e *invalidReadingError) Is(target error) bool { return target == errInvalidReading }
+
+// metricLimits is the valid range of a metric and the values its sensor
+// reports on a fault, like 85 and -127 from a DS18B20. Only -127 is a fault
+// by default, 85 °C is also a temperature the sensor can really read.
+type metricLimits struct {
+	Min    float64   `yaml:"min"`
+	Max    float64   `yaml:"max"`
+	Faults floatList `yaml:"faults"`
+}
+
+// readingValidation checks readings against the limits of each metric. A nil
+// *readingValidation only rejects values that aren't finite.
+type readingValidation struct {
+	mode                       string
+	tempCo, tempRoom, humidity metricLimits
+}
+
+func defaultReadingValidation() *readingValidation {
+	return &readingValidation{
+		mode:     validationReject,
+		tempCo:   metricLimits{Min: -55, Max: 125, Faults: floatList{-127}},
+		tempRoom: metricLimits{Min: -40, Max: 80, Faults: floatList{-127}},
+		humidity: metricLimits{Min: 0, Max: 100},
+	}
+}
+
+// check returns an *invalidReadingError naming every field of p that isn't
+// valid, or nil
+func (v *readingValidation) check(p *TemperatureReadingPayload) error {
+	var limits [3]*metricLimits
+	if v != nil {
+		limits = [3]*metricLimits{&v.tempCo, &v.tempRoom, &v.humidity}
+	}
+	invalid := &invalidReadingError{storable: true}
+	for i, m := range []struct {
+		field string
+		value float64
+	}{{"tempCo", p.TempCo}, {"tempRoom", p.TempRoom}, {"humidity", p.Humidity}} {
+		fail := func(format string, args ...any) {
+			invalid.Fields = append(invalid.Fields, fieldError{Field: m.field, Message: fmt.Sprintf(format, args...)})
+		}
+		switch l := limits[i]; {
+		case math.IsNaN(m.value) || math.IsInf(m.value, 0):
+			fail("must be a finite number")
+			invalid.storable = false
+		case l == nil:
+		case slices.Contains(l.Faults, m.value):
+			fail("%g is a sensor fault value", m.value)
+		case m.value < l.Min || m.value > l.Max:
+			fail("%g is outside the valid range %g to %g", m.value, l.Min, l.Max)
+		}
+	}
+	if len(invalid.Fields) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// validateReading sets the quality of p. An invalid reading is rejected, or
+// in flag mode stored as suspect if its values can be stored at all.
+func (a *app) validateReading(ctx context.Context, p *TemperatureReadingPayload) error {
+	err := a.validation.check(p)
+	var invalid *invalidReadingError
+	if !errors.As(err, &invalid) {
+		p.Quality = qualityGood
+		return err
+	}
+	if a.validation == nil || a.validation.mode != validationFlag || !invalid.storable {
+		return err
+	}
+	slogctx.FromCtx(ctx).Warn("Storing suspect reading", "device", p.DeviceId, "error", err)
+	p.Quality = qualitySuspect
+	return nil
+}
+
+// quality is the quality to store p with, readings that skipped validation
+// count as good
+func (p TemperatureReadingPayload) quality() string {
+	if p.Quality == "" {
+		return qualityGood
+	}
+	return p.Quality
+}
+
+// ingestErrorMessage is the message a reading refused with err is answered
+// with, the field errors of an invalid reading or else the device id problem
+func ingestErrorMessage(err error) string {
+	var invalid *invalidReadingError
+	if errors.As(err, &invalid) {
+		return "Invalid reading: " + invalid.fieldList()
+	}
+	return "Invalid device id"
+}
+
+// floatList is a list in the config file and comma separated as a flag
+type floatList []float64
+
+func (l floatList) String() string {
+	values := make([]string, len(l))
+	for i, f := range l {
+		values[i] = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *floatList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		*l = append(*l, f)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ds18b20Validation is the default validation with 85 also a fault value
+func ds18b20Validation() *readingValidation {
+	v := defaultReadingValidation()
+	v.tempCo.Faults = floatList{85, -127}
+	v.tempRoom.Faults = floatList{85, -127}
+	return v
+}
+
+func TestReadingValidation(t *testing.T) {
+	// a genuine 85 °C passes the defaults, a disconnected probe doesn't
+	assert.NoError(t, defaultReadingValidation().check(&TemperatureReadingPayload{TempCo: 85, TempRoom: 21.5, Humidity: 45}))
+	var invalid *invalidReadingError
+	require.ErrorAs(t, defaultReadingValidation().check(&TemperatureReadingPayload{TempCo: -127, TempRoom: 21.5, Humidity: 45}), &invalid)
+	assert.Equal(t, []fieldError{{"tempCo", "-127 is a sensor fault value"}}, invalid.Fields)
+
+	v := ds18b20Validation()
+	for _, tc := range []struct {
+		name                       string
+		tempCo, tempRoom, humidity float64
+		want                       []fieldError
+	}{
+		{"valid", 60, 21.5, 45, nil},
+		{"bounds are valid", 125, -40, 0, nil},
+		{"DS18B20 power-on value", 85, 21.5, 45, []fieldError{{"tempCo", "85 is a sensor fault value"}}},
+		{"DS18B20 disconnected", 60, -127, 45, []fieldError{{"tempRoom", "-127 is a sensor fault value"}}},
+		{"out of range", 60, 21.5, 300, []fieldError{{"humidity", "300 is outside the valid range 0 to 100"}}},
+		{"every field", math.NaN(), 85, -1, []fieldError{
+			{"tempCo", "must be a finite number"},
+			{"tempRoom", "85 is a sensor fault value"},
+			{"humidity", "-1 is outside the valid range 0 to 100"},
+		}},
+	} {
+		err := v.check(&TemperatureReadingPayload{TempCo: tc.tempCo, TempRoom: tc.tempRoom, Humidity: tc.humidity})
+		if tc.want == nil {
+			assert.NoError(t, err, tc.name)
+			continue
+		}
+		var invalid *invalidReadingError
+		require.ErrorAs(t, err, &invalid, tc.name)
+		assert.Equal(t, tc.want, invalid.Fields, tc.name)
+		assert.ErrorIs(t, err, errInvalidReading, tc.name)
+	}
+
+	// without limits only values that can't be stored are refused
+	var none *readingValidation
+	assert.NoError(t, none.check(&TemperatureReadingPayload{TempCo: 85, Humidity: 300}))
+	assert.ErrorIs(t, none.check(&TemperatureReadingPayload{Humidity: math.Inf(1)}), errInvalidReading)
+}
+
+func TestValidationConfig(t *testing.T) {
+	env := envMap(map[string]string{
+		"APP_VALIDATION_MODE":  "flag",
+		"APP_TEMP_CO_FAULTS":   "85, -127, 127.9375",
+		"APP_HUMIDITY_MAX":     "95",
+		"APP_TEMP_ROOM_FAULTS": "x",
+	})
+	cfg, _, err := loadConfig([]string{"--temp-room-min=-10"}, env)
+	assert.EqualError(t, err, `env APP_TEMP_ROOM_FAULTS: invalid value "x"`)
+
+	v := cfg.readingValidation()
+	assert.Equal(t, validationFlag, v.mode)
+	assert.Equal(t, floatList{85, -127, 127.9375}, v.tempCo.Faults)
+	assert.Equal(t, metricLimits{Min: 0, Max: 95}, v.humidity)
+	assert.Equal(t, metricLimits{Min: -10, Max: 80, Faults: floatList{-127}}, v.tempRoom)
+	assert.Equal(t, "85,-127,127.9375", v.tempCo.Faults.String())
+
+	// the default fault value can be turned off
+	cfg, _, err = loadConfig([]string{"--temp-co-faults="}, envMap(nil))
+	require.NoError(t, err)
+	assert.Empty(t, cfg.readingValidation().tempCo.Faults)
+	assert.Equal(t, floatList{-127}, cfg.readingValidation().tempRoom.Faults)
+}
+
+func TestDataHandlerValidation(t *testing.T) {
+	app := &app{readings: newMemoryReadingStore(), secretKey: "testsecret", hub: newEventHub(), validation: ds18b20Validation()}
+	rejected := testutil.ToFloat64(ingestRejected.WithLabelValues(ingestHTTP, "invalid_reading"))
+	suspect := testutil.ToFloat64(ingestSuspect.WithLabelValues(ingestHTTP))
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+		req.Header.Set("X-Secret-Key", "testsecret")
+		w := httptest.NewRecorder()
+		app.dataHandler(w, req)
+		return w
+	}
+
+	w := post(`{"deviceId": "esp-a", "tempCo": 85, "tempRoom": 22.0, "humidity": 300, "timestamp": 1761388101}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.JSONEq(t, `{
+		"type": "urn:esp8266-web:problem:invalid-reading",
+		"title": "Invalid reading",
+		"status": 422,
+		"detail": "tempCo: 85 is a sensor fault value, humidity: 300 is outside the valid range 0 to 100",
+		"errors": [
+			{"field": "tempCo", "message": "85 is a sensor fault value"},
+			{"field": "humidity", "message": "300 is outside the valid range 0 to 100"}
+		]
+	}`, w.Body.String())
+	assert.Equal(t, rejected+1, testutil.ToFloat64(ingestRejected.WithLabelValues(ingestHTTP, "invalid_reading")))
+
+	// devices can't claim a quality
+	w = post(`{"deviceId": "esp-a", "tempCo": 60, "tempRoom": 22.0, "humidity": 50, "quality": "suspect", "timestamp": 1761388102}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var tr TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tr))
+	assert.Equal(t, qualityGood, tr.Quality)
+
+	app.validation.mode = validationFlag
+	w = post(`{"deviceId": "esp-a", "tempCo": 85, "tempRoom": 22.0, "humidity": 50, "timestamp": 1761388103}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tr))
+	assert.Equal(t, qualitySuspect, tr.Quality)
+	assert.Equal(t, 85.0, tr.TempCo)
+	assert.Equal(t, suspect+1, testutil.ToFloat64(ingestSuspect.WithLabelValues(ingestHTTP)))
+
+	// the suspect reading is kept out of the aggregates
+	buckets, err := app.readings.AggregateReadings(context.Background(), "esp-a", []int64{1761388000}, []int64{1761388200})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), buckets[0].Count)
+	assert.Equal(t, 60.0, *buckets[0].TempCo.Max)
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// Webhook event types, a webhook subscribes to some of them or to all
+const (
+	webhookAlertFiring   = "alert.firing"
+	webhookAlertResolved = "alert.resolved"
+	webhookDeviceOffline = "device.offline"
+)
+
+var webhookEventTypes = []string{webhookAlertFiring, webhookAlertResolved, webhookDeviceOffline}
+
+const (
+	headerWebhookDelivery  = "X-Webhook-Delivery"
+	headerWebhookEvent     = "X-Webhook-Event"
+	headerWebhookTimestamp = "X-Webhook-Timestamp"
+	headerWebhookSignature = "X-Webhook-Signature"
+)
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+const (
+	webhookMaxAttempts  = 8
+	webhookBackoffBase  = 30 * time.Second
+	webhookBackoffMax   = time.Hour
+	webhookTimeout      = 10 * time.Second
+	webhookPollInterval = 5 * time.Second
+	webhookClaimBatch   = 20
+	// devices that send no reading for defaultOfflineAfter are offline
+	defaultOfflineAfter  = 15 * time.Minute
+	offlineCheckInterval = time.Minute
+)
+
+var errInvalidWebhook = errors.New("invalid webhook")
+
+// Webhook is an endpoint events are POSTed to. Secret is only returned when
+// the webhook is created.
+type Webhook struct {
+	Id            int      `json:"id"`
+	URL           string   `json:"url"`
+	Events        []string `json:"events"`
+	Enabled       bool     `json:"enabled"`
+	Secret        string   `json:"secret,omitempty"`
+	CreatedAt     int64    `json:"createdAt"`
+	LastStatus    *int     `json:"lastStatus"`
+	LastError     *string  `json:"lastError"`
+	LastAttemptAt *int64   `json:"lastAttemptAt"`
+}
+
+type WebhookPayload struct {
+	Type      string `json:"type"`
+	DeviceId  string `json:"deviceId,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	Data      any    `json:"data"`
+}
+
+type WebhookDelivery struct {
+	Id            int             `json:"id"`
+	WebhookId     int             `json:"webhookId"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt int64           `json:"nextAttemptAt"`
+	LastStatus    *int            `json:"lastStatus"`
+	LastError     *string         `json:"lastError"`
+	CreatedAt     int64           `json:"createdAt"`
+	DeliveredAt   *int64          `json:"deliveredAt"`
+}
+
+func (w Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http(s) URL", errInvalidWebhook)
+	}
+	for _, e := range w.Events {
+		found := false
+		for _, t := range webhookEventTypes {
+			found = found || e == t
+		}
+		if !found {
+			return fmt.Errorf("%w: unknown event %q", errInvalidWebhook, e)
+		}
+	}
+	return nil
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256 of ts and body, receivers
+// recompute it with the webhook secret to check the sender.
+func signWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n", ts)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the delay before retrying a delivery that failed
+// attempts times, doubling from base up to limit.
+func webhookBackoff(attempts int, base, limit time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// queueWebhookEvent records a delivery of event to every enabled webhook
+// subscribed to it. It runs in the transaction making the change the event
+// reports, so an event can't be lost before it is delivered.
+func queueWebhookEvent(ctx context.Context, tx pgx.Tx, event, deviceId string, data any) error {
+	now := time.Now().UTC().Unix()
+	payload, err := json.Marshal(WebhookPayload{Type: event, DeviceId: deviceId, Timestamp: now, Data: data})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, created_at)
+		SELECT id, $1, $2, $3, 0, $4, $4
+		FROM webhooks
+		WHERE enabled AND (cardinality(events) = 0 OR $1 = ANY(events))
+	`, event, payload, deliveryPending, now)
+	return err
+}
+
+// webhookSettings tune delivery, zero values fall back to the defaults.
+// offlineAfter is how long a device may go without a reading before it's
+// reported offline, a negative one turns that off.
+type webhookSettings struct {
+	timeout      time.Duration
+	maxAttempts  int
+	backoffBase  time.Duration
+	backoffMax   time.Duration
+	pollInterval time.Duration
+	offlineAfter time.Duration
+}
+
+type webhookDispatcher struct {
+	app          *app
+	logger       *slog.Logger
+	client       *http.Client
+	timeout      time.Duration
+	pollInterval time.Duration
+	backoffBase  time.Duration
+	backoffMax   time.Duration
+	maxAttempts  int
+	offlineAfter time.Duration
+	wake         chan struct{}
+}
+
+func newWebhookDispatcher(a *app, logger *slog.Logger) *webhookDispatcher {
+	s := a.webhooks
+	if s.timeout <= 0 {
+		s.timeout = webhookTimeout
+	}
+	if s.maxAttempts <= 0 {
+		s.maxAttempts = webhookMaxAttempts
+	}
+	if s.backoffBase <= 0 {
+		s.backoffBase = webhookBackoffBase
+	}
+	if s.backoffMax <= 0 {
+		s.backoffMax = webhookBackoffMax
+	}
+	if s.pollInterval <= 0 {
+		s.pollInterval = webhookPollInterval
+	}
+	if s.offlineAfter == 0 {
+		s.offlineAfter = defaultOfflineAfter
+	}
+	return &webhookDispatcher{
+		app:          a,
+		logger:       logger.With("component", "webhooks"),
+		client:       &http.Client{Timeout: s.timeout},
+		timeout:      s.timeout,
+		pollInterval: s.pollInterval,
+		backoffBase:  s.backoffBase,
+		backoffMax:   s.backoffMax,
+		maxAttempts:  s.maxAttempts,
+		offlineAfter: s.offlineAfter,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// run delivers due deliveries and reports devices gone offline until ctx is
+// done. Deliveries are queued in the database by whatever produced their
+// event, so they survive restarts and the hub only wakes the dispatcher early.
+func (d *webhookDispatcher) run(ctx context.Context) {
+	go d.wakeLoop(ctx)
+
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	var offline <-chan time.Time
+	if d.offlineAfter > 0 {
+		offlineTicker := time.NewTicker(offlineCheckInterval)
+		defer offlineTicker.Stop()
+		offline = offlineTicker.C
+	}
+	for {
+		if err := d.deliverDue(ctx); err != nil && ctx.Err() == nil {
+			d.logger.Error("Failed to deliver webhooks", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		case <-offline:
+			if err := d.checkOffline(ctx, time.Now().UTC()); err != nil && ctx.Err() == nil {
+				d.logger.Error("Failed to check for offline devices", "error", err)
+			}
+		}
+	}
+}
+
+// wakeLoop wakes the dispatcher on alert events, which have just queued their
+// deliveries. Falling behind only delays them until the next poll.
+func (d *webhookDispatcher) wakeLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		sub := d.app.hub.subscribe(func(e Event) bool { return e.Type == eventAlert })
+	events:
+		for {
+			select {
+			case <-ctx.Done():
+				d.app.hub.unsubscribe(sub)
+				return
+			case _, ok := <-sub.events:
+				if !ok {
+					if d.app.hub.isClosed() {
+						return
+					}
+					break events
+				}
+				d.wakeUp()
+			}
+		}
+	}
+}
+
+func (d *webhookDispatcher) wakeUp() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// checkOffline marks the devices that haven't sent a reading for
+// offlineAfter as offline and queues a device.offline event for each. A
+// device is reported once, its next reading brings it back online. Claiming
+// devices in the update keeps replicas from reporting one twice.
+func (d *webhookDispatcher) checkOffline(ctx context.Context, now time.Time) error {
+	var offline []DeviceStatus
+	err := pgx.BeginFunc(ctx, d.app.db, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			UPDATE devices SET offline_at = $2
+			WHERE offline_at IS NULL AND last_seen_at < $1
+			RETURNING id, last_seen_at
+		`, now.Add(-d.offlineAfter).Unix(), now.Unix())
+		if err != nil {
+			return err
+		}
+		offline, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (DeviceStatus, error) {
+			s := DeviceStatus{Status: "offline", Timestamp: now.Unix()}
+			var lastSeenAt int64
+			err := row.Scan(&s.DeviceId, &lastSeenAt)
+			s.Data = map[string]int64{"lastSeenAt": lastSeenAt}
+			return s, err
+		})
+		if err != nil {
+			return err
+		}
+		for _, s := range offline {
+			if err := queueWebhookEvent(ctx, tx, webhookDeviceOffline, s.DeviceId, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range offline {
+		d.logger.Info("Device went offline", "device_id", s.DeviceId)
+		d.app.hub.publish(Event{Type: eventDeviceStatus, DeviceId: s.DeviceId, Data: s})
+	}
+	if len(offline) > 0 {
+		d.wakeUp()
+	}
+	return nil
+}
+
+type claimedDelivery struct {
+	id       int
+	event    string
+	payload  []byte
+	attempts int
+	url      string
+	secret   string
+}
+
+// deliverDue sends every delivery that is due. Claiming pushes the next
+// attempt past the request timeout, so replicas don't send the same one.
+// Deliveries of a disabled webhook wait until it is enabled again.
+func (d *webhookDispatcher) deliverDue(ctx context.Context) error {
+	for {
+		now := time.Now().UTC()
+		rows, err := d.app.db.Query(ctx, `
+			UPDATE webhook_deliveries AS wd
+			SET next_attempt_at = $2
+			FROM webhooks AS w
+			WHERE w.id = wd.webhook_id AND wd.id IN (
+				SELECT d.id FROM webhook_deliveries AS d
+				JOIN webhooks ON webhooks.id = d.webhook_id
+				WHERE d.status = $3 AND d.next_attempt_at <= $1 AND webhooks.enabled
+				ORDER BY d.next_attempt_at, d.id
+				LIMIT $4
+				FOR UPDATE OF d SKIP LOCKED
+			)
+			RETURNING wd.id, wd.event, wd.payload, wd.attempts, w.url, w.secret
+		`, now.Unix(), now.Add(2*d.timeout).Unix(), deliveryPending, webhookClaimBatch)
+		if err != nil {
+			return err
+		}
+		claimed, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (claimedDelivery, error) {
+			var c claimedDelivery
+			err := row.Scan(&c.id, &c.event, &c.payload, &c.attempts, &c.url, &c.secret)
+			return c, err
+		})
+		if err != nil {
+			return err
+		}
+		for _, c := range claimed {
+			if err := d.attempt(ctx, c); err != nil {
+				return err
+			}
+		}
+		if len(claimed) < webhookClaimBatch {
+			return nil
+		}
+	}
+}
+
+// attempt sends one delivery and records the outcome on the delivery and on
+// its webhook. Only a failure to record it is returned.
+func (d *webhookDispatcher) attempt(ctx context.Context, c claimedDelivery) error {
+	status, sendErr := d.send(ctx, c)
+	if ctx.Err() != nil {
+		// Shutting down, the claim runs out and the delivery is retried later
+		return ctx.Err()
+	}
+
+	now := time.Now().UTC()
+	attempts := c.attempts + 1
+	var lastStatus *int
+	if status != 0 {
+		lastStatus = &status
+	}
+	var lastError *string
+	deliveryStatus := deliveryDelivered
+	nextAttempt := now
+	var deliveredAt *int64
+	if sendErr == nil {
+		ts := now.Unix()
+		deliveredAt = &ts
+	} else {
+		msg := sendErr.Error()
+		lastError = &msg
+		deliveryStatus = deliveryPending
+		nextAttempt = now.Add(webhookBackoff(attempts, d.backoffBase, d.backoffMax))
+		if attempts >= d.maxAttempts {
+			deliveryStatus = deliveryFailed
+		}
+		d.logger.Warn("Webhook delivery failed", "delivery", c.id, "url", c.url, "attempts", attempts, "error", sendErr)
+	}
+
+	return pgx.BeginFunc(ctx, d.app.db, func(tx pgx.Tx) error {
+		var webhookId int
+		err := tx.QueryRow(ctx, `
+			UPDATE webhook_deliveries
+			SET status = $2, attempts = $3, next_attempt_at = $4, last_status = $5, last_error = $6, delivered_at = $7
+			WHERE id = $1
+			RETURNING webhook_id
+		`, c.id, deliveryStatus, attempts, nextAttempt.Unix(), lastStatus, lastError, deliveredAt).Scan(&webhookId)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE webhooks SET last_status = $2, last_error = $3, last_attempt_at = $4
+			WHERE id = $1
+		`, webhookId, lastStatus, lastError, now.Unix())
+		return err
+	})
+}
+
+// send POSTs the delivery, any status other than 2xx is a failure
+func (d *webhookDispatcher) send(ctx context.Context, c claimedDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(c.payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := time.Now().UTC().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "esp8266-web")
+	req.Header.Set(headerWebhookDelivery, strconv.Itoa(c.id))
+	req.Header.Set(headerWebhookEvent, c.event)
+	req.Header.Set(headerWebhookTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(headerWebhookSignature, signWebhook(c.secret, ts, c.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+const webhookColumns = `id, url, events, enabled, created_at, last_status, last_error, last_attempt_at`
+
+func scanWebhook(row pgx.CollectableRow) (Webhook, error) {
+	var w Webhook
+	err := row.Scan(&w.Id, &w.URL, &w.Events, &w.Enabled, &w.CreatedAt, &w.LastStatus, &w.LastError, &w.LastAttemptAt)
+	return w, err
+}
+
+func decodeWebhook(r *http.Request) (Webhook, error) {
+	wh := Webhook{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		return wh, fmt.Errorf("%w: %s", errInvalidWebhook, err)
+	}
+	if wh.Events == nil {
+		wh.Events = []string{}
+	}
+	return wh, wh.validate()
+}
+
+// webhooksHandler lists and creates webhooks. Webhooks hold secrets, so
+// every method is admin only.
+func (a *app) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !a.isAdmin(r) {
+		writeProblem(w, problemForbidden, "")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(r.Context(), `SELECT `+webhookColumns+` FROM webhooks ORDER BY id`)
+		if err != nil {
+			logger.Error("Failed to query webhooks", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		webhooks, err := pgx.CollectRows(rows, scanWebhook)
+		if err != nil {
+			logger.Error("Failed to scan webhooks", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		if webhooks == nil {
+			webhooks = make([]Webhook, 0)
+		}
+		json.NewEncoder(w).Encode(webhooks)
+
+	case http.MethodPost:
+		wh, err := decodeWebhook(r)
+		if err != nil {
+			writeProblem(w, problemInvalidWebhook, err.Error())
+			return
+		}
+		secret := wh.Secret
+		if secret == "" {
+			if secret, err = newWebhookSecret(); err != nil {
+				logger.Error("Failed to generate webhook secret", "error", err)
+				writeProblem(w, problemInternal, "")
+				return
+			}
+		}
+		rows, err := a.db.Query(r.Context(), `
+			INSERT INTO webhooks (url, secret, events, enabled, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING `+webhookColumns,
+			wh.URL, secret, wh.Events, wh.Enabled, time.Now().UTC().Unix())
+		if err != nil {
+			logger.Error("Failed to insert webhook", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		wh, err = pgx.CollectExactlyOneRow(rows, scanWebhook)
+		if err != nil {
+			logger.Error("Failed to insert webhook", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		wh.Secret = secret
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(wh)
+
+	default:
+		writeProblem(w, problemMethodNotAllowed, "")
+	}
+}
+
+func (a *app) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !a.isAdmin(r) {
+		writeProblem(w, problemForbidden, "")
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeProblem(w, problemNotFound, "")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(r.Context(), `SELECT `+webhookColumns+` FROM webhooks WHERE id = $1`, id)
+		if err != nil {
+			logger.Error("Failed to query webhook", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		wh, err := pgx.CollectExactlyOneRow(rows, scanWebhook)
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeProblem(w, problemNotFound, "")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to scan webhook", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		json.NewEncoder(w).Encode(wh)
+
+	case http.MethodPut:
+		wh, err := decodeWebhook(r)
+		if err != nil {
+			writeProblem(w, problemInvalidWebhook, err.Error())
+			return
+		}
+		// The secret is kept unless a new one is given
+		rows, err := a.db.Query(r.Context(), `
+			UPDATE webhooks
+			SET url = $2, events = $3, enabled = $4, secret = COALESCE(NULLIF($5, ''), secret)
+			WHERE id = $1
+			RETURNING `+webhookColumns,
+			id, wh.URL, wh.Events, wh.Enabled, wh.Secret)
+		if err != nil {
+			logger.Error("Failed to update webhook", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		wh, err = pgx.CollectExactlyOneRow(rows, scanWebhook)
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeProblem(w, problemNotFound, "")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to update webhook", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		json.NewEncoder(w).Encode(wh)
+
+	case http.MethodDelete:
+		tag, err := a.db.Exec(r.Context(), `DELETE FROM webhooks WHERE id = $1`, id)
+		if err != nil {
+			logger.Error("Failed to delete webhook", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeProblem(w, problemNotFound, "")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeProblem(w, problemMethodNotAllowed, "")
+	}
+}
+
+// webhookDeliveriesHandler is the delivery log of a webhook, newest first
+func (a *app) webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		writeProblem(w, problemMethodNotAllowed, "")
+		return
+	}
+	if !a.isAdmin(r) {
+		writeProblem(w, problemForbidden, "")
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeProblem(w, problemNotFound, "")
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 50
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	offset := 0
+	if o, err := strconv.Atoi(query.Get("offset")); err == nil && o >= 0 {
+		offset = o
+	}
+
+	rows, err := a.db.Query(r.Context(), `
+		SELECT id, webhook_id, event, payload, status, attempts, next_attempt_at, last_status, last_error, created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1 AND ($2::TEXT = '' OR status = $2)
+		ORDER BY id DESC
+		LIMIT $3 OFFSET $4
+	`, id, query.Get("status"), limit, offset)
+	if err != nil {
+		logger.Error("Failed to query webhook deliveries", "error", err)
+		writeProblem(w, problemInternal, "")
+		return
+	}
+	deliveries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (WebhookDelivery, error) {
+		var d WebhookDelivery
+		err := row.Scan(&d.Id, &d.WebhookId, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastStatus, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+		return d, err
+	})
+	if err != nil {
+		logger.Error("Failed to scan webhook deliveries", "error", err)
+		writeProblem(w, problemInternal, "")
+		return
+	}
+	if deliveries == nil {
+		deliveries = make([]WebhookDelivery, 0)
+	}
+	json.NewEncoder(w).Encode(deliveries)
+}
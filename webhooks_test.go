@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, webhookBackoff(1, 30*time.Second, time.Hour))
+	assert.Equal(t, 60*time.Second, webhookBackoff(2, 30*time.Second, time.Hour))
+	assert.Equal(t, 4*time.Minute, webhookBackoff(4, 30*time.Second, time.Hour))
+	assert.Equal(t, time.Hour, webhookBackoff(20, 30*time.Second, time.Hour))
+}
+
+func TestWebhookSettingsOfflineAfter(t *testing.T) {
+	cfg, _, err := loadConfig(nil, envMap(nil))
+	require.NoError(t, err)
+	assert.Equal(t, defaultOfflineAfter, cfg.webhookSettings().offlineAfter)
+
+	cfg, _, err = loadConfig([]string{"--offline-after=0"}, envMap(nil))
+	require.NoError(t, err)
+	d := newWebhookDispatcher(&app{webhooks: cfg.webhookSettings()}, slog.Default())
+	assert.Negative(t, d.offlineAfter)
+}
+
+func TestWebhookValidate(t *testing.T) {
+	assert.NoError(t, Webhook{URL: "https://example.com/hook", Events: []string{webhookAlertFiring}}.validate())
+	assert.ErrorIs(t, Webhook{URL: "example.com/hook"}.validate(), errInvalidWebhook)
+	assert.ErrorIs(t, Webhook{URL: "ftp://example.com"}.validate(), errInvalidWebhook)
+	assert.ErrorIs(t, Webhook{URL: "https://example.com", Events: []string{"reading"}}.validate(), errInvalidWebhook)
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret", hub: newEventHub()}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	var (
+		mu       sync.Mutex
+		requests []received
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, received{r.Header, body})
+		// the first attempt fails and is retried
+		if len(requests) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	body := `{"url": "` + receiver.URL + `", "events": ["alert.firing"]}`
+	req := httptest.NewRequest("POST", "/webhooks", bytes.NewReader([]byte(body)))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	app.webhooksHandler(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var webhook Webhook
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&webhook))
+	require.NotEmpty(t, webhook.Secret)
+
+	d := newWebhookDispatcher(app, slog.Default())
+	d.pollInterval = 10 * time.Millisecond
+	d.backoffBase = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.run(ctx)
+	waitForSubscribers(t, app.hub, 1)
+
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		e := AlertEvent{Id: 1, RuleName: "Hot room", DeviceId: "esp-a"}
+		if err := queueWebhookEvent(ctx, tx, webhookAlertFiring, e.DeviceId, e); err != nil {
+			return err
+		}
+		// not subscribed to
+		return queueWebhookEvent(ctx, tx, webhookDeviceOffline, "esp-a", DeviceStatus{DeviceId: "esp-a", Status: "offline"})
+	})
+	require.NoError(t, err)
+	app.hub.publish(Event{Type: eventAlert, DeviceId: "esp-a", Data: AlertEvent{Id: 1}})
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(requests) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	last := requests[1]
+	mu.Unlock()
+	assert.Equal(t, webhookAlertFiring, last.header.Get(headerWebhookEvent))
+	ts, err := strconv.ParseInt(last.header.Get(headerWebhookTimestamp), 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, signWebhook(webhook.Secret, ts, last.body), last.header.Get(headerWebhookSignature))
+	var payload WebhookPayload
+	require.NoError(t, json.Unmarshal(last.body, &payload))
+	assert.Equal(t, webhookAlertFiring, payload.Type)
+	assert.Equal(t, "esp-a", payload.DeviceId)
+
+	req = httptest.NewRequest("GET", "/webhooks/1/deliveries", nil)
+	req.SetPathValue("id", strconv.Itoa(webhook.Id))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	require.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		app.webhookDeliveriesHandler(w, req)
+		var deliveries []WebhookDelivery
+		return json.NewDecoder(w.Body).Decode(&deliveries) == nil &&
+			len(deliveries) == 1 && deliveries[0].Status == deliveryDelivered && deliveries[0].Attempts == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	req = httptest.NewRequest("GET", "/webhooks/1", nil)
+	req.SetPathValue("id", strconv.Itoa(webhook.Id))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	app.webhookHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&webhook))
+	assert.Empty(t, webhook.Secret)
+	require.NotNil(t, webhook.LastStatus)
+	assert.Equal(t, http.StatusOK, *webhook.LastStatus)
+}
+
+func TestWebhookDispatcherDisabled(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret", hub: newEventHub()}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	var sent atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { sent.Add(1) }))
+	t.Cleanup(receiver.Close)
+
+	ctx := context.Background()
+	_, err := db.Exec(ctx, `INSERT INTO webhooks (url, secret, events, enabled, created_at) VALUES ($1, 's', '{}', TRUE, 0)`, receiver.URL)
+	require.NoError(t, err)
+	require.NoError(t, pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		return queueWebhookEvent(ctx, tx, webhookDeviceOffline, "esp-a", DeviceStatus{DeviceId: "esp-a", Status: "offline"})
+	}))
+
+	// a delivery queued before the webhook was disabled waits for it
+	_, err = db.Exec(ctx, `UPDATE webhooks SET enabled = FALSE`)
+	require.NoError(t, err)
+	d := newWebhookDispatcher(app, slog.Default())
+	require.NoError(t, d.deliverDue(ctx))
+	assert.Zero(t, sent.Load())
+	var status string
+	require.NoError(t, db.QueryRow(ctx, `SELECT status FROM webhook_deliveries`).Scan(&status))
+	assert.Equal(t, deliveryPending, status)
+
+	_, err = db.Exec(ctx, `UPDATE webhooks SET enabled = TRUE`)
+	require.NoError(t, err)
+	require.NoError(t, d.deliverDue(ctx))
+	assert.Equal(t, int32(1), sent.Load())
+}
+
+func TestWebhooksHandlerForbidden(t *testing.T) {
+	app := &app{secretKey: "testsecret"}
+
+	req := httptest.NewRequest("GET", "/webhooks", nil)
+	w := httptest.NewRecorder()
+	app.webhooksHandler(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestWebhookDispatcherOfflineDevices(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), hub: newEventHub()}
+	ctx := context.Background()
+	require.NoError(t, app.applyMigrations(ctx))
+	_, err := db.Exec(ctx, `INSERT INTO webhooks (url, secret, created_at) VALUES ('http://127.0.0.1:1', 's', 0)`)
+	require.NoError(t, err)
+
+	// esp-a reported over HTTP, MQTT or a WebSocket a while ago, esp-b just now
+	for _, device := range []string{"esp-a", "esp-b"} {
+		_, err := app.readings.InsertReading(ctx, TemperatureReadingPayload{DeviceId: device, Timestamp: new(int64)})
+		require.NoError(t, err)
+	}
+	now := time.Now().UTC()
+	_, err = db.Exec(ctx, `UPDATE devices SET last_seen_at = $1 WHERE id = 'esp-a'`, now.Add(-time.Hour).Unix())
+	require.NoError(t, err)
+
+	d := newWebhookDispatcher(app, slog.Default())
+	sub := app.hub.subscribe(func(e Event) bool { return e.Type == eventDeviceStatus })
+	defer app.hub.unsubscribe(sub)
+	require.NoError(t, d.checkOffline(ctx, now))
+	e := <-sub.events
+	assert.Equal(t, "esp-a", e.DeviceId)
+
+	countOffline := func() int {
+		var n int
+		require.NoError(t, db.QueryRow(ctx, `SELECT COUNT(*) FROM webhook_deliveries WHERE event = $1`, webhookDeviceOffline).Scan(&n))
+		return n
+	}
+	assert.Equal(t, 1, countOffline())
+
+	// reported once, until a reading brings the device back
+	require.NoError(t, d.checkOffline(ctx, now))
+	assert.Equal(t, 1, countOffline())
+	_, err = app.readings.InsertReading(ctx, TemperatureReadingPayload{DeviceId: "esp-a", Timestamp: new(int64)})
+	require.NoError(t, err)
+	require.NoError(t, d.checkOffline(ctx, now.Add(time.Hour)))
+	assert.Equal(t, 3, countOffline())
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// WebSocket channels a dashboard can subscribe to
+const (
+	channelReadings = "readings"
+	channelAlerts   = "alerts"
+	channelDevices  = "devices"
+)
+
+const (
+	eventAlert        = "alert"
+	eventDeviceStatus = "device_status"
+	eventCommand      = "command"
+)
+
+var eventChannels = map[string]string{
+	eventReading:      channelReadings,
+	eventAlert:        channelAlerts,
+	eventDeviceStatus: channelDevices,
+}
+
+const (
+	wsReadLimit  = 64 * 1024
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsOutBuffer  = 16
+)
+
+// wsMessage is the envelope of every WebSocket message in both directions.
+//
+// Clients send:
+//
+//	{"type": "subscribe", "channels": ["readings"], "device": "esp-a"}
+//	{"type": "unsubscribe", "channels": ["readings"]}
+//	{"type": "reading", "id": "1", "reading": {...}}  devices only
+//	{"type": "ack", "id": "<command id>", "data": {...}}  devices only
+//	{"type": "ping"}
+//
+// The server sends "event", "result", "command", "error" and "pong" messages.
+type wsMessage struct {
+	Type     string                     `json:"type"`
+	Id       string                     `json:"id,omitempty"`
+	Channels []string                   `json:"channels,omitempty"`
+	Channel  string                     `json:"channel,omitempty"`
+	Device   string                     `json:"device,omitempty"`
+	Reading  *TemperatureReadingPayload `json:"reading,omitempty"`
+	Command  string                     `json:"command,omitempty"`
+	Status   int                        `json:"status,omitempty"`
+	Error    string                     `json:"error,omitempty"`
+	Data     any                        `json:"data,omitempty"`
+}
+
+type DeviceStatus struct {
+	DeviceId  string `json:"deviceId"`
+	Status    string `json:"status"`
+	CommandId string `json:"commandId,omitempty"`
+	Data      any    `json:"data,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type DeviceCommand struct {
+	Id      string `json:"id"`
+	Command string `json:"command"`
+	Args    any    `json:"args,omitempty"`
+}
+
+func deviceStatusEvent(deviceId, status string) Event {
+	return Event{Type: eventDeviceStatus, DeviceId: deviceId, Data: DeviceStatus{
+		DeviceId:  deviceId,
+		Status:    status,
+		Timestamp: time.Now().UTC().Unix(),
+	}}
+}
+
+// originAllowed applies the same policy as corsMiddleware to WebSocket
+// handshakes, which browsers don't subject to CORS.
+func (a *app) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || a.corsOrigin(origin) != ""
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Error:           wsHandshakeError,
+}
+
+// wsHandshakeError answers a failed handshake with a problem like any other
+// error, with the status the upgrader chose
+func wsHandshakeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	p := problemWebSocketHandshake.problem(reason.Error())
+	p.Status = status
+	p.write(w)
+}
+
+// wsConn is one WebSocket client. Dashboards connect without a key and may
+// only subscribe; devices authenticate the handshake like POST /data and may
+// also push readings and receive commands.
+type wsConn struct {
+	app      *app
+	ctx      context.Context
+	conn     *websocket.Conn
+	logger   *slog.Logger
+	device   bool
+	deviceId string
+	ip       string
+	out      chan wsMessage
+
+	mu       sync.Mutex
+	channels map[string]bool
+	filter   string
+}
+
+func (c *wsConn) wants(e Event) bool {
+	if e.Type == eventCommand {
+		return c.device && c.deviceId != "" && e.DeviceId == c.deviceId
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.channels[eventChannels[e.Type]] {
+		return false
+	}
+	return c.filter == "" || e.DeviceId == c.filter
+}
+
+// send queues a reply without blocking the reader, a client that doesn't
+// read its replies is disconnected.
+func (c *wsConn) send(m wsMessage) bool {
+	select {
+	case c.out <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *app) wsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		writeProblem(w, problemMethodNotAllowed, "")
+		return
+	}
+
+	c := &wsConn{
+		app:      a,
+		ctx:      r.Context(),
+		logger:   logger,
+		ip:       clientIP(r),
+		out:      make(chan wsMessage, wsOutBuffer),
+		channels: make(map[string]bool),
+	}
+
+	// Browsers can't set headers on the handshake, so the key may also be
+	// passed as a query parameter
+	key := r.Header.Get("X-Secret-Key")
+	if key == "" {
+		key = r.URL.Query().Get("key")
+	}
+	// dashboards count against the IP limit too
+	if a.rateLimited(w, r, routeWebSocket, limitIP, c.ip) {
+		return
+	}
+	if key != "" || r.Header.Get(headerSignature) != "" || clientCertDevice(r) != "" {
+		if key != "" {
+			r.Header.Set("X-Secret-Key", key)
+		}
+		deviceId, err := a.authenticateRequest(r, nil)
+		if isAuthError(err) {
+			logger.Warn("Rejected websocket connection", "error", err)
+			writeProblem(w, problemForbidden, "")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to authenticate device", "error", err)
+			writeProblem(w, problemInternal, "")
+			return
+		}
+		// A shared key connection is bound to the device named on the
+		// handshake, the default device if none, so it can only push that
+		// device's readings and receives its commands
+		claimed := r.Header.Get(headerDeviceId)
+		if claimed == "" {
+			claimed = r.URL.Query().Get("device")
+		}
+		deviceId, err = resolveDevice(deviceId, claimed)
+		if err != nil {
+			logger.Warn("Rejected websocket connection", "error", err)
+			writeProblem(w, problemForbidden, "")
+			return
+		}
+		if !validDeviceId(deviceId) {
+			writeProblem(w, problemInvalidDeviceId, "", fieldError{"deviceId", deviceIdRule})
+			return
+		}
+		if a.rateLimited(w, r, routeWebSocket, limitDevice, deviceId) {
+			return
+		}
+		c.device = true
+		c.deviceId = deviceId
+	}
+
+	upgrader := wsUpgrader
+	upgrader.CheckOrigin = a.originAllowed
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("Failed to upgrade websocket connection", "error", err)
+		return
+	}
+	c.conn = conn
+	defer conn.Close()
+
+	sub := a.hub.subscribe(c.wants)
+	defer a.hub.unsubscribe(sub)
+
+	if c.deviceId != "" {
+		a.hub.publish(deviceStatusEvent(c.deviceId, "online"))
+		defer a.hub.publish(deviceStatusEvent(c.deviceId, "offline"))
+	}
+
+	logger.Info("Websocket connected", "device", c.device, "device_id", c.deviceId)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.readLoop()
+	}()
+	c.writeLoop(sub, done)
+
+	logger.Info("Websocket disconnected", "device_id", c.deviceId)
+}
+
+func (c *wsConn) readLoop() {
+	c.conn.SetReadLimit(wsReadLimit)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var m wsMessage
+		if err := c.conn.ReadJSON(&m); err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				c.logger.Debug("Websocket read failed", "error", err)
+			}
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		if !c.send(c.handle(m)) {
+			c.logger.Warn("Websocket client not reading replies")
+			return
+		}
+	}
+}
+
+func (c *wsConn) handle(m wsMessage) wsMessage {
+	reply := wsMessage{Type: "result", Id: m.Id, Status: http.StatusOK}
+
+	switch m.Type {
+	case "subscribe", "unsubscribe":
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, ch := range m.Channels {
+			if ch != channelReadings && ch != channelAlerts && ch != channelDevices {
+				return wsMessage{Type: "error", Id: m.Id, Status: http.StatusUnprocessableEntity, Error: "Unknown channel " + ch}
+			}
+		}
+		for _, ch := range m.Channels {
+			c.channels[ch] = m.Type == "subscribe"
+		}
+		if m.Type == "subscribe" {
+			c.filter = m.Device
+		}
+		return reply
+
+	case "ping":
+		return wsMessage{Type: "pong", Id: m.Id}
+
+	case "reading":
+		if !c.device {
+			return wsMessage{Type: "error", Id: m.Id, Status: http.StatusForbidden, Error: "Forbidden"}
+		}
+		// every reading counts against the limits, not just the handshake
+		if p, _ := c.app.takeToken(c.ctx, routeWebSocket, limitIP, c.ip); p != nil {
+			ingestRejected.WithLabelValues(ingestWebSocket, reasonRateLimited).Inc()
+			return wsMessage{Type: "error", Id: m.Id, Status: p.Status, Error: p.Detail}
+		}
+		if m.Reading == nil {
+			ingestRejected.WithLabelValues(ingestWebSocket, reasonBadRequest).Inc()
+			return wsMessage{Type: "error", Id: m.Id, Status: http.StatusUnprocessableEntity, Error: "Bad request"}
+		}
+		tri := *m.Reading
+		err := prepareReading(c.deviceId, &tri)
+		if err == nil {
+			err = c.app.validateReading(c.ctx, &tri)
+		}
+		if err != nil {
+			ingestRejected.WithLabelValues(ingestWebSocket, rejectReason(err)).Inc()
+			if isAuthError(err) {
+				return wsMessage{Type: "error", Id: m.Id, Status: http.StatusForbidden, Error: "Forbidden"}
+			}
+			return wsMessage{Type: "error", Id: m.Id, Status: http.StatusUnprocessableEntity, Error: ingestErrorMessage(err)}
+		}
+		if p, _ := c.app.takeToken(c.ctx, routeWebSocket, limitDevice, tri.DeviceId); p != nil {
+			ingestRejected.WithLabelValues(ingestWebSocket, reasonRateLimited).Inc()
+			return wsMessage{Type: "error", Id: m.Id, Status: p.Status, Error: p.Detail}
+		}
+		tr, err := c.app.insertReading(c.ctx, tri)
+		if err != nil {
+			c.logger.Error("Failed to insert temperature reading", "error", err)
+			ingestFailed.WithLabelValues(ingestWebSocket, reasonDatabase).Inc()
+			return wsMessage{Type: "error", Id: m.Id, Status: http.StatusInternalServerError, Error: "Internal server error"}
+		}
+		observeAccepted(ingestWebSocket, tr)
+		reply.Data = tr
+		return reply
+
+	case "ack":
+		if c.deviceId == "" {
+			return wsMessage{Type: "error", Id: m.Id, Status: http.StatusForbidden, Error: "Forbidden"}
+		}
+		c.app.hub.publish(Event{Type: eventDeviceStatus, DeviceId: c.deviceId, Data: DeviceStatus{
+			DeviceId:  c.deviceId,
+			Status:    "command_ack",
+			CommandId: m.Id,
+			Data:      m.Data,
+			Timestamp: time.Now().UTC().Unix(),
+		}})
+		return reply
+
+	default:
+		return wsMessage{Type: "error", Id: m.Id, Status: http.StatusUnprocessableEntity, Error: "Unknown message type"}
+	}
+}
+
+func (c *wsConn) writeLoop(sub *subscription, done <-chan struct{}) {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	write := func(m wsMessage) error {
+		c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return c.conn.WriteJSON(m)
+	}
+
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case m := <-c.out:
+			err = write(m)
+		case e, ok := <-sub.events:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+				if !c.app.hub.isClosed() {
+					c.logger.Info("Websocket subscriber dropped")
+					msg = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow")
+				}
+				c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+				return
+			}
+			if e.Type == eventCommand {
+				cmd := e.Data.(DeviceCommand)
+				err = write(wsMessage{Type: "command", Id: cmd.Id, Command: cmd.Command, Data: cmd.Args})
+			} else {
+				err = write(wsMessage{Type: "event", Channel: eventChannels[e.Type], Data: e.Data})
+			}
+		case <-ping.C:
+			err = c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+		}
+		if err != nil {
+			c.logger.Debug("Websocket write failed", "error", err)
+			return
+		}
+	}
+}
+
+// deviceCommandsHandler sends a command to the device's open WebSocket
+// connections, it fails with 409 if the device isn't connected.
+func (a *app) deviceCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !a.isAdmin(r) {
+		writeProblem(w, problemForbidden, "")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeProblem(w, problemMethodNotAllowed, "")
+		return
+	}
+
+	var cmd DeviceCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		writeProblem(w, problemInvalidJSON, err.Error())
+		return
+	}
+	if cmd.Command == "" {
+		writeProblem(w, problemInvalidJSON, "", fieldError{"command", "is required"})
+		return
+	}
+	cmd.Id = uuid.New().String()
+
+	deviceId := r.PathValue("id")
+	delivered := a.hub.publish(Event{Type: eventCommand, DeviceId: deviceId, Data: cmd})
+	if delivered == 0 {
+		writeProblem(w, problemDeviceOffline, "")
+		return
+	}
+	logger.Info("Sent device command", "device_id", deviceId, "command", cmd.Command, "command_id", cmd.Id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(cmd)
+}
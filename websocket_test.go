@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dialWS(t *testing.T, srv *httptest.Server, header http.Header) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	resp.Body.Close()
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func wsRoundTrip(t *testing.T, conn *websocket.Conn, m wsMessage) wsMessage {
+	t.Helper()
+	require.NoError(t, conn.WriteJSON(m))
+	return readWS(t, conn)
+}
+
+func readWS(t *testing.T, conn *websocket.Conn) wsMessage {
+	t.Helper()
+	var reply wsMessage
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, conn.ReadJSON(&reply))
+	return reply
+}
+
+func TestWsHandlerDashboard(t *testing.T) {
+	app := &app{hub: newEventHub()}
+	srv := httptest.NewServer(loggingMiddleware(http.HandlerFunc(app.wsHandler)))
+	t.Cleanup(srv.Close)
+
+	conn := dialWS(t, srv, nil)
+
+	reply := wsRoundTrip(t, conn, wsMessage{Type: "subscribe", Id: "1", Channels: []string{channelReadings, channelDevices}, Device: "esp-a"})
+	assert.Equal(t, "result", reply.Type)
+	assert.Equal(t, http.StatusOK, reply.Status)
+
+	reply = wsRoundTrip(t, conn, wsMessage{Type: "subscribe", Id: "2", Channels: []string{"weather"}})
+	assert.Equal(t, "error", reply.Type)
+
+	ts := int64(1761388101)
+	app.hub.publish(readingEvent(TemperatureReading{Id: 1, DeviceId: "esp-b", Timestamp: &ts}))
+	app.hub.publish(readingEvent(TemperatureReading{Id: 2, DeviceId: "esp-a", TempCo: 25.5, Timestamp: &ts}))
+
+	reply = readWS(t, conn)
+	assert.Equal(t, "event", reply.Type)
+	assert.Equal(t, channelReadings, reply.Channel)
+	assert.Equal(t, 2.0, reply.Data.(map[string]any)["id"])
+
+	// dashboards can't push readings
+	reply = wsRoundTrip(t, conn, wsMessage{Type: "reading", Id: "3", Reading: &TemperatureReadingPayload{TempCo: 1}})
+	assert.Equal(t, "error", reply.Type)
+	assert.Equal(t, http.StatusForbidden, reply.Status)
+
+	reply = wsRoundTrip(t, conn, wsMessage{Type: "ping", Id: "4"})
+	assert.Equal(t, "pong", reply.Type)
+
+	// unsubscribed channels are not delivered
+	wsRoundTrip(t, conn, wsMessage{Type: "unsubscribe", Channels: []string{channelReadings}})
+	app.hub.publish(readingEvent(TemperatureReading{Id: 3, DeviceId: "esp-a", Timestamp: &ts}))
+	app.hub.publish(deviceStatusEvent("esp-a", "online"))
+	reply = readWS(t, conn)
+	assert.Equal(t, channelDevices, reply.Channel)
+}
+
+func TestWsHandlerInvalidKey(t *testing.T) {
+	app := &app{hub: newEventHub(), secretKey: "testsecret"}
+	srv := httptest.NewServer(http.HandlerFunc(app.wsHandler))
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{headerSignature: {"00"}})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestWsHandlerSharedKey(t *testing.T) {
+	app := &app{readings: newMemoryReadingStore(), hub: newEventHub(), secretKey: "testsecret"}
+	srv := httptest.NewServer(http.HandlerFunc(app.wsHandler))
+	t.Cleanup(srv.Close)
+
+	// the shared key binds the connection to the device of the handshake
+	device := dialWS(t, srv, http.Header{"X-Secret-Key": {"testsecret"}, headerDeviceId: {"esp-a"}})
+	reply := wsRoundTrip(t, device, wsMessage{Type: "reading", Id: "r1", Reading: &TemperatureReadingPayload{TempCo: 25.5, Humidity: 60}})
+	require.Equal(t, "result", reply.Type, reply.Error)
+	assert.Equal(t, "esp-a", reply.Data.(map[string]any)["deviceId"])
+
+	reply = wsRoundTrip(t, device, wsMessage{Type: "reading", Id: "r2", Reading: &TemperatureReadingPayload{DeviceId: "esp-b", TempCo: 25.5}})
+	assert.Equal(t, http.StatusForbidden, reply.Status)
+
+	// and it receives the device's commands
+	req := httptest.NewRequest("POST", "/devices/esp-a/commands", bytes.NewReader([]byte(`{"command": "reboot"}`)))
+	req.SetPathValue("id", "esp-a")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	app.deviceCommandsHandler(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "reboot", readWS(t, device).Command)
+
+	// without a device it is the default device's
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?key=testsecret"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	defer conn.Close()
+	reply = wsRoundTrip(t, conn, wsMessage{Type: "reading", Id: "r3", Reading: &TemperatureReadingPayload{TempCo: 25.5}})
+	require.Equal(t, "result", reply.Type, reply.Error)
+	assert.Equal(t, defaultDeviceId, reply.Data.(map[string]any)["deviceId"])
+
+	_, resp, err = websocket.DefaultDialer.Dial(url+"&device=esp%20a", nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestDeviceCommandsHandlerNotConnected(t *testing.T) {
+	app := &app{hub: newEventHub(), secretKey: "testsecret"}
+
+	req := httptest.NewRequest("POST", "/devices/esp-a/commands", bytes.NewReader([]byte(`{"command": "reboot"}`)))
+	req.SetPathValue("id", "esp-a")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+
+	app.deviceCommandsHandler(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestWsHandlerDevice(t *testing.T) {
+	db := setupTestDB(t)
+	app := &app{db: db, readings: newPgReadingStore(db), secretKey: "testsecret", hub: newEventHub()}
+	require.NoError(t, app.applyMigrations(context.Background()))
+
+	_, err := db.Exec(context.Background(), "INSERT INTO devices (id) VALUES ('esp-a')")
+	require.NoError(t, err)
+	issued, err := app.issueDeviceKey(context.Background(), "esp-a")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(app.wsHandler))
+	t.Cleanup(srv.Close)
+
+	dashboard := dialWS(t, srv, nil)
+	wsRoundTrip(t, dashboard, wsMessage{Type: "subscribe", Channels: []string{channelReadings, channelDevices}})
+
+	device := dialWS(t, srv, http.Header{"X-Secret-Key": {issued.Key}})
+	status := readWS(t, dashboard)
+	assert.Equal(t, channelDevices, status.Channel)
+	assert.Equal(t, "online", status.Data.(map[string]any)["status"])
+
+	// readings are stamped with the key's device
+	reply := wsRoundTrip(t, device, wsMessage{Type: "reading", Id: "r1", Reading: &TemperatureReadingPayload{TempCo: 25.5, TempRoom: 22, Humidity: 60}})
+	require.Equal(t, "result", reply.Type, reply.Error)
+	assert.Equal(t, "r1", reply.Id)
+	assert.Equal(t, "esp-a", reply.Data.(map[string]any)["deviceId"])
+
+	event := readWS(t, dashboard)
+	assert.Equal(t, channelReadings, event.Channel)
+
+	reply = wsRoundTrip(t, device, wsMessage{Type: "reading", Id: "r2", Reading: &TemperatureReadingPayload{DeviceId: "esp-b"}})
+	assert.Equal(t, http.StatusForbidden, reply.Status)
+
+	// commands reach the connected device
+	req := httptest.NewRequest("POST", "/devices/esp-a/commands", bytes.NewReader([]byte(`{"command": "reboot", "args": {"delay": 5}}`)))
+	req.SetPathValue("id", "esp-a")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	app.deviceCommandsHandler(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	cmd := readWS(t, device)
+	assert.Equal(t, "command", cmd.Type)
+	assert.Equal(t, "reboot", cmd.Command)
+	assert.NotEmpty(t, cmd.Id)
+
+	reply = wsRoundTrip(t, device, wsMessage{Type: "ack", Id: cmd.Id})
+	assert.Equal(t, "result", reply.Type)
+	status = readWS(t, dashboard)
+	assert.Equal(t, "command_ack", status.Data.(map[string]any)["status"])
+
+	device.Close()
+	status = readWS(t, dashboard)
+	assert.Equal(t, "offline", status.Data.(map[string]any)["status"])
+}